@@ -8,6 +8,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"github.com/wangxiaochuang/k3s/pkg/cli/cmds"
+	"github.com/wangxiaochuang/k3s/pkg/cli/etcdmember"
+	"github.com/wangxiaochuang/k3s/pkg/cli/etcdsnapshot"
 	"github.com/wangxiaochuang/k3s/pkg/cli/server"
 	"github.com/wangxiaochuang/k3s/pkg/configfilearg"
 )
@@ -16,12 +18,28 @@ func main() {
 	app := cmds.NewApp()
 	app.Commands = []cli.Command{
 		cmds.NewServerCommand(server.Run),
+		cmds.NewEtcdSnapshotCommand(etcdsnapshot.Run,
+			cmds.NewEtcdSnapshotSubcommands(
+				etcdsnapshot.Delete,
+				etcdsnapshot.List,
+				etcdsnapshot.Prune,
+				etcdsnapshot.Run,
+				etcdsnapshot.Verify,
+				etcdsnapshot.RestorePlan,
+				etcdsnapshot.Inspect,
+				etcdsnapshot.Diff,
+				etcdsnapshot.Extract),
+		),
+		cmds.NewEtcdMemberCommand(
+			cmds.NewEtcdMemberSubcommands(
+				etcdmember.List,
+				etcdmember.Remove,
+				etcdmember.Promote,
+				etcdmember.MoveLeader),
+		),
 	}
 
 	if err := app.Run(configfilearg.MustParse(os.Args)); err != nil && !errors.Is(err, context.Canceled) {
 		logrus.Fatal(err)
 	}
-
-	var c chan struct{}
-	<-c
 }
@@ -0,0 +1,5 @@
+// +k8s:deepcopy-gen=package
+// +groupName=k3s.cattle.io
+
+// Package v1 contains the k3s.cattle.io/v1 API types.
+package v1
@@ -0,0 +1,79 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ETCDSnapshotFile is the metadata of a single etcd snapshot, held in the snapshot directory
+// of a server node or in a remote snapshot store.
+type ETCDSnapshotFile struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ETCDSnapshotSpec   `json:"spec,omitempty"`
+	Status ETCDSnapshotStatus `json:"status,omitempty"`
+}
+
+// ETCDSnapshotSpec describes where a snapshot is stored, and how it was saved.
+type ETCDSnapshotSpec struct {
+	// SnapshotName is the name of the snapshot file.
+	SnapshotName string `json:"snapshotName"`
+	// NodeName is the name of the node holding the snapshot, or the name of the
+	// remote store holding it, such as s3 or mirror.
+	NodeName string `json:"nodeName"`
+	// Location is the URI of the snapshot. Local paths are prefixed with file://.
+	Location string `json:"location,omitempty"`
+	// Metadata holds the extra metadata recorded when the snapshot was taken.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// S3 holds the settings of the S3 store holding the snapshot, if any.
+	S3 *ETCDSnapshotS3 `json:"s3,omitempty"`
+	// Compressed is true if the snapshot is compressed.
+	Compressed bool `json:"compressed,omitempty"`
+	// Encrypted is true if the snapshot is encrypted.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Checksum is the hex-encoded SHA-256 digest of the snapshot file.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// ETCDSnapshotS3 holds the settings of the S3 store holding a snapshot.
+type ETCDSnapshotS3 struct {
+	Endpoint      string `json:"endpoint,omitempty"`
+	EndpointCA    string `json:"endpointCA,omitempty"`
+	SkipSSLVerify bool   `json:"skipSSLVerify,omitempty"`
+	Bucket        string `json:"bucket,omitempty"`
+	Region        string `json:"region,omitempty"`
+	Folder        string `json:"folder,omitempty"`
+	Insecure      bool   `json:"insecure,omitempty"`
+}
+
+// ETCDSnapshotStatus describes the outcome of saving a snapshot.
+type ETCDSnapshotStatus struct {
+	// ReadyToUse is true if the snapshot was saved successfully.
+	ReadyToUse *bool `json:"readyToUse,omitempty"`
+	// CreationTime is the time the snapshot was taken.
+	CreationTime *metav1.Time `json:"creationTime,omitempty"`
+	// Size is the size of the snapshot file, in bytes.
+	Size int64 `json:"size,omitempty"`
+	// Error describes why the snapshot could not be saved, if it failed.
+	Error *ETCDSnapshotError `json:"error,omitempty"`
+}
+
+// ETCDSnapshotError describes a failure to save a snapshot.
+type ETCDSnapshotError struct {
+	Time    *metav1.Time `json:"time,omitempty"`
+	Message string       `json:"message,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ETCDSnapshotFileList is a list of ETCDSnapshotFile resources.
+type ETCDSnapshotFileList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ETCDSnapshotFile `json:"items"`
+}
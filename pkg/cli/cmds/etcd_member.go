@@ -0,0 +1,63 @@
+package cmds
+
+import (
+	"github.com/urfave/cli"
+)
+
+const EtcdMemberCommand = "etcd-member"
+
+var EtcdMemberFlags = []cli.Flag{
+	DebugFlag,
+	ConfigFlag,
+	LogFile,
+	AlsoLogToStderr,
+	DataDirFlag,
+	EtcdClientPortFlag,
+	EtcdBindAddressFlag,
+}
+
+func NewEtcdMemberCommand(subcommands []cli.Command) cli.Command {
+	return cli.Command{
+		Name:        EtcdMemberCommand,
+		Usage:       "Manage the members of the embedded etcd cluster",
+		Subcommands: subcommands,
+	}
+}
+
+func NewEtcdMemberSubcommands(list, remove, promote, moveLeader func(ctx *cli.Context) error) []cli.Command {
+	return []cli.Command{
+		{
+			Name:            "ls",
+			Aliases:         []string{"list", "l"},
+			Usage:           "List etcd members, with their learner and leader status, raft index and database size",
+			SkipFlagParsing: false,
+			SkipArgReorder:  true,
+			Action:          list,
+			Flags:           EtcdMemberFlags,
+		},
+		{
+			Name:            "remove",
+			Usage:           "Remove the etcd member with the given name or ID",
+			SkipFlagParsing: false,
+			SkipArgReorder:  true,
+			Action:          remove,
+			Flags:           EtcdMemberFlags,
+		},
+		{
+			Name:            "promote",
+			Usage:           "Promote the etcd learner with the given name or ID to a voting member",
+			SkipFlagParsing: false,
+			SkipArgReorder:  true,
+			Action:          promote,
+			Flags:           EtcdMemberFlags,
+		},
+		{
+			Name:            "move-leader",
+			Usage:           "Transfer etcd leadership to the voting member with the given name or ID",
+			SkipFlagParsing: false,
+			SkipArgReorder:  true,
+			Action:          moveLeader,
+			Flags:           EtcdMemberFlags,
+		},
+	}
+}
@@ -9,6 +9,19 @@ import (
 
 const EtcdSnapshotCommand = "etcd-snapshot"
 
+// EtcdSnapshotExtract holds the options of the etcd-snapshot extract subcommand.
+type EtcdSnapshotExtract struct {
+	Resource  string
+	Namespace string
+	Name      string
+	Output    string
+	Format    string
+	Restore   bool
+	Overwrite bool
+}
+
+var ExtractConfig EtcdSnapshotExtract
+
 var EtcdSnapshotFlags = []cli.Flag{
 	DebugFlag,
 	ConfigFlag,
@@ -21,6 +34,8 @@ var EtcdSnapshotFlags = []cli.Flag{
 		Destination: &AgentConfig.NodeName,
 	},
 	DataDirFlag,
+	EtcdClientPortFlag,
+	EtcdBindAddressFlag,
 	&cli.StringFlag{
 		Name:        "dir,etcd-snapshot-dir",
 		Usage:       "(db) Directory to save etcd on-demand snapshot. (default: ${data-dir}/db/snapshots)",
@@ -37,6 +52,37 @@ var EtcdSnapshotFlags = []cli.Flag{
 		Usage:       "(db) Compress etcd snapshot",
 		Destination: &ServerConfig.EtcdSnapshotCompress,
 	},
+	&cli.StringFlag{
+		Name:        "snapshot-compression,etcd-snapshot-compression",
+		Usage:       "(db) Format used to compress etcd snapshots (zip, gzip or zstd). Setting a format enables compression; if only etcd-snapshot-compress is set, zip is used. Compressed snapshots are detected by content on restore",
+		Destination: &ServerConfig.EtcdSnapshotCompression,
+	},
+	&cli.StringFlag{
+		Name:        "mirror-dir,etcd-snapshot-mirror-dir",
+		Usage:       "(db) Additional directory, such as an NFS mount, to copy etcd snapshots to",
+		Destination: &ServerConfig.EtcdSnapshotMirrorDir,
+	},
+	&cli.StringFlag{
+		Name:        "encryption-key-file,etcd-snapshot-encryption-key-file",
+		Usage:       "(db) File containing the passphrase used to encrypt etcd snapshots",
+		Destination: &ServerConfig.EtcdSnapshotKeyFile,
+	},
+	&cli.StringSliceFlag{
+		Name:  "pre-hook,etcd-snapshot-pre-hook",
+		Usage: "(db) Executable or http(s) URL called with the details of each snapshot before it is taken. A hook that fails prevents the snapshot from being taken",
+		Value: &ServerConfig.EtcdSnapshotPreHooks,
+	},
+	&cli.StringSliceFlag{
+		Name:  "post-hook,etcd-snapshot-post-hook",
+		Usage: "(db) Executable or http(s) URL called with the results of each snapshot, including failures, vetoes and uploads to S3",
+		Value: &ServerConfig.EtcdSnapshotPostHooks,
+	},
+	&cli.DurationFlag{
+		Name:        "hook-timeout,etcd-snapshot-hook-timeout",
+		Usage:       "(db) Timeout for each snapshot hook",
+		Destination: &ServerConfig.EtcdSnapshotHookTimeout,
+		Value:       defaultSnapshotHookTimeout,
+	},
 	&cli.BoolFlag{
 		Name:        "s3,etcd-s3",
 		Usage:       "(db) Enable backup to S3",
@@ -70,6 +116,45 @@ var EtcdSnapshotFlags = []cli.Flag{
 		EnvVar:      "AWS_SECRET_ACCESS_KEY",
 		Destination: &ServerConfig.EtcdS3SecretKey,
 	},
+	&cli.StringFlag{
+		Name:        "s3-session-token,etcd-s3-session-token",
+		Usage:       "(db) S3 session token, used with temporary access and secret keys",
+		EnvVar:      "AWS_SESSION_TOKEN",
+		Destination: &ServerConfig.EtcdS3SessionToken,
+	},
+	&cli.StringFlag{
+		Name:        "s3-credentials-file,etcd-s3-credentials-file",
+		Usage:       "(db) AWS shared credentials file to read S3 credentials from. The file is re-read when it changes",
+		EnvVar:      "AWS_SHARED_CREDENTIALS_FILE",
+		Destination: &ServerConfig.EtcdS3CredentialsFile,
+	},
+	&cli.StringFlag{
+		Name:        "s3-config-file,etcd-s3-config-file",
+		Usage:       "(db) AWS shared config file to read S3 credentials or a web identity role from",
+		EnvVar:      "AWS_CONFIG_FILE",
+		Destination: &ServerConfig.EtcdS3ConfigFile,
+	},
+	&cli.StringFlag{
+		Name:        "s3-profile,etcd-s3-profile",
+		Usage:       "(db) Profile to use from the AWS shared credentials or config file (default: default)",
+		EnvVar:      "AWS_PROFILE",
+		Destination: &ServerConfig.EtcdS3Profile,
+	},
+	&cli.StringFlag{
+		Name:        "s3-role-arn,etcd-s3-role-arn",
+		Usage:       "(db) ARN of the role to assume with the S3 web identity token file",
+		Destination: &ServerConfig.EtcdS3RoleARN,
+	},
+	&cli.StringFlag{
+		Name:        "s3-web-identity-token-file,etcd-s3-web-identity-token-file",
+		Usage:       "(db) Web identity token file used to assume the S3 role. The file is re-read when credentials are refreshed",
+		Destination: &ServerConfig.EtcdS3WebIdentityFile,
+	},
+	&cli.StringFlag{
+		Name:        "s3-sts-endpoint,etcd-s3-sts-endpoint",
+		Usage:       "(db) STS endpoint used to assume the S3 role (default: https://sts.amazonaws.com)",
+		Destination: &ServerConfig.EtcdS3STSEndpoint,
+	},
 	&cli.StringFlag{
 		Name:        "s3-bucket,etcd-s3-bucket",
 		Usage:       "(db) S3 bucket name",
@@ -91,12 +176,91 @@ var EtcdSnapshotFlags = []cli.Flag{
 		Usage:       "(db) Disables S3 over HTTPS",
 		Destination: &ServerConfig.EtcdS3Insecure,
 	},
+	&cli.StringFlag{
+		Name:        "s3-proxy,etcd-s3-proxy",
+		Usage:       "(db) Proxy URL used for S3 traffic only. If not set, the proxy environment variables are used",
+		Destination: &ServerConfig.EtcdS3Proxy,
+	},
+	&cli.IntFlag{
+		Name:        "s3-max-connections,etcd-s3-max-connections",
+		Usage:       "(db) Maximum number of connections to the S3 endpoint (default: unlimited)",
+		Destination: &ServerConfig.EtcdS3MaxConns,
+	},
+	&cli.IntFlag{
+		Name:        "s3-max-idle-connections,etcd-s3-max-idle-connections",
+		Usage:       "(db) Maximum number of idle connections to the S3 endpoint to keep open",
+		Destination: &ServerConfig.EtcdS3MaxIdleConns,
+	},
+	&cli.StringFlag{
+		Name:        "s3-tls-min-version,etcd-s3-tls-min-version",
+		Usage:       "(db) Minimum TLS version for connections to the S3 endpoint, eg. VersionTLS12",
+		Destination: &ServerConfig.EtcdS3TLSMinVersion,
+	},
 	&cli.DurationFlag{
 		Name:        "s3-timeout,etcd-s3-timeout",
 		Usage:       "(db) S3 timeout",
 		Destination: &ServerConfig.EtcdS3Timeout,
 		Value:       30 * time.Second,
 	},
+	&cli.BoolFlag{
+		Name:        "s3-stream,etcd-s3-stream",
+		Usage:       "(db) Stream the snapshot directly to S3 without saving it or its checksum file to the local snapshot directory. Cannot be used with mirror-dir",
+		Destination: &ServerConfig.EtcdS3Stream,
+	},
+	&cli.IntFlag{
+		Name:        "s3-part-size,etcd-s3-part-size",
+		Usage:       "(db) Size in MiB of each part of S3 multipart uploads (minimum 5)",
+		Destination: &ServerConfig.EtcdS3PartSize,
+		Value:       defaultS3PartSize,
+	},
+	&cli.IntFlag{
+		Name:        "s3-concurrency,etcd-s3-concurrency",
+		Usage:       "(db) Number of parts of S3 multipart uploads to upload in parallel",
+		Destination: &ServerConfig.EtcdS3Concurrency,
+		Value:       defaultS3Concurrency,
+	},
+	&cli.DurationFlag{
+		Name:        "s3-part-timeout,etcd-s3-part-timeout",
+		Usage:       "(db) Timeout for each attempt to upload a part of an S3 multipart upload",
+		Destination: &ServerConfig.EtcdS3PartTimeout,
+		Value:       defaultS3PartTimeout,
+	},
+	&cli.IntFlag{
+		Name:        "s3-part-retries,etcd-s3-part-retries",
+		Usage:       "(db) Number of times to retry the upload of a part of an S3 multipart upload",
+		Destination: &ServerConfig.EtcdS3PartRetries,
+		Value:       defaultS3PartRetries,
+	},
+	&cli.StringFlag{
+		Name:        "s3-sse,etcd-s3-sse",
+		Usage:       "(db) S3 server-side encryption to request for snapshots: AES256 (SSE-S3) or aws:kms (SSE-KMS)",
+		Destination: &ServerConfig.EtcdS3SSE,
+	},
+	&cli.StringFlag{
+		Name:        "s3-sse-kms-key-id,etcd-s3-sse-kms-key-id",
+		Usage:       "(db) S3 KMS key ID used to encrypt snapshots with SSE-KMS",
+		Destination: &ServerConfig.EtcdS3SSEKMSKeyID,
+	},
+	&cli.StringFlag{
+		Name:        "s3-sse-c-key-file,etcd-s3-sse-c-key-file",
+		Usage:       "(db) File containing the 32 byte customer key, raw or base64 encoded, used to encrypt snapshots with SSE-C",
+		Destination: &ServerConfig.EtcdS3SSECKeyFile,
+	},
+	&cli.StringFlag{
+		Name:        "s3-storage-class,etcd-s3-storage-class",
+		Usage:       "(db) S3 storage class of uploaded snapshots, eg. STANDARD_IA",
+		Destination: &ServerConfig.EtcdS3StorageClass,
+	},
+	&cli.StringSliceFlag{
+		Name:  "s3-tag,etcd-s3-tag",
+		Usage: "(db) Tag to add to uploaded snapshots, in the form key=value",
+		Value: &ServerConfig.EtcdS3Tags,
+	},
+	&cli.StringSliceFlag{
+		Name:  "s3-metadata,etcd-s3-metadata",
+		Usage: "(db) User metadata to add to uploaded snapshots, in the form key=value",
+		Value: &ServerConfig.EtcdS3Metadata,
+	},
 }
 
 func NewEtcdSnapshotCommand(action func(*cli.Context) error, subcommands []cli.Command) cli.Command {
@@ -111,7 +275,7 @@ func NewEtcdSnapshotCommand(action func(*cli.Context) error, subcommands []cli.C
 	}
 }
 
-func NewEtcdSnapshotSubcommands(delete, list, prune, save func(ctx *cli.Context) error) []cli.Command {
+func NewEtcdSnapshotSubcommands(delete, list, prune, save, verify, restorePlan, inspect, diff, extract func(ctx *cli.Context) error) []cli.Command {
 	return []cli.Command{
 		{
 			Name:            "delete",
@@ -132,16 +296,38 @@ func NewEtcdSnapshotSubcommands(delete, list, prune, save func(ctx *cli.Context)
 		},
 		{
 			Name:            "prune",
-			Usage:           "Remove snapshots that match the name prefix that exceed the configured retention count",
+			Usage:           "Remove snapshots that match the name prefix that are not kept by the configured retention policy",
 			SkipFlagParsing: false,
 			SkipArgReorder:  true,
 			Action:          prune,
-			Flags: append(EtcdSnapshotFlags, &cli.IntFlag{
-				Name:        "snapshot-retention",
-				Usage:       "(db) Number of snapshots to retain.",
-				Destination: &ServerConfig.EtcdSnapshotRetention,
-				Value:       defaultSnapshotRentention,
-			}),
+			Flags: append(EtcdSnapshotFlags,
+				&cli.IntFlag{
+					Name:        "snapshot-retention",
+					Usage:       "(db) Number of snapshots to retain. Only applied by default if no maximum age or retention tier is set.",
+					Destination: &ServerConfig.EtcdSnapshotRetention,
+					Value:       defaultSnapshotRentention,
+				},
+				&cli.DurationFlag{
+					Name:        "max-age,etcd-snapshot-max-age",
+					Usage:       "(db) Remove snapshots older than this age, eg. 720h. The newest snapshot is always kept.",
+					Destination: &ServerConfig.EtcdSnapshotMaxAge,
+				},
+				&cli.IntFlag{
+					Name:        "keep-hourly,etcd-snapshot-keep-hourly",
+					Usage:       "(db) Number of hours for which the newest snapshot of each hour is retained.",
+					Destination: &ServerConfig.EtcdSnapshotKeepHourly,
+				},
+				&cli.IntFlag{
+					Name:        "keep-daily,etcd-snapshot-keep-daily",
+					Usage:       "(db) Number of days for which the newest snapshot of each day is retained.",
+					Destination: &ServerConfig.EtcdSnapshotKeepDaily,
+				},
+				&cli.IntFlag{
+					Name:        "keep-weekly,etcd-snapshot-keep-weekly",
+					Usage:       "(db) Number of weeks for which the newest snapshot of each week is retained.",
+					Destination: &ServerConfig.EtcdSnapshotKeepWeekly,
+				},
+			),
 		},
 		{
 			Name:            "save",
@@ -151,5 +337,98 @@ func NewEtcdSnapshotSubcommands(delete, list, prune, save func(ctx *cli.Context)
 			Action:          save,
 			Flags:           EtcdSnapshotFlags,
 		},
+		{
+			Name:            "verify",
+			Usage:           "Verify the checksum and contents of given snapshot(s), or of all snapshots if none are given",
+			SkipFlagParsing: false,
+			SkipArgReorder:  true,
+			Action:          verify,
+			Flags:           EtcdSnapshotFlags,
+		},
+		{
+			Name:            "restore-plan",
+			Usage:           "Print the snapshot that a restore from the given path would use. The path may be a snapshot name or file, latest, latest:<node> or latest:<name-prefix> (default: latest)",
+			SkipFlagParsing: false,
+			SkipArgReorder:  true,
+			Action:          restorePlan,
+			Flags:           EtcdSnapshotFlags,
+		},
+		{
+			Name:            "inspect",
+			Usage:           "Print the revision, key count and size by resource of the given snapshot",
+			SkipFlagParsing: false,
+			SkipArgReorder:  true,
+			Action:          inspect,
+			Flags:           EtcdSnapshotFlags,
+		},
+		{
+			Name:            "diff",
+			Usage:           "Print the keys added, deleted or modified between two snapshots",
+			SkipFlagParsing: false,
+			SkipArgReorder:  true,
+			Action:          diff,
+			Flags:           EtcdSnapshotFlags,
+		},
+		{
+			Name:            "extract",
+			Usage:           "Extract the selected objects from the given snapshot, writing them to a file or restoring them to the datastore",
+			SkipFlagParsing: false,
+			SkipArgReorder:  true,
+			Action:          extract,
+			Flags: append(EtcdSnapshotFlags,
+				&cli.StringFlag{
+					Name:        "object-resource",
+					Usage:       "(extract) Resource of the objects to extract, as it appears in the datastore key, eg. configmaps, services/specs or example.com/widgets",
+					Destination: &ExtractConfig.Resource,
+				},
+				&cli.StringFlag{
+					Name:        "object-namespace",
+					Usage:       "(extract) Namespace of the objects to extract (default: all namespaces and cluster-scoped objects)",
+					Destination: &ExtractConfig.Namespace,
+				},
+				&cli.StringFlag{
+					Name:        "object-name",
+					Usage:       "(extract) Name of the object to extract (default: all objects)",
+					Destination: &ExtractConfig.Name,
+				},
+				&cli.StringFlag{
+					Name:        "output,o",
+					Usage:       "(extract) File to write the extracted objects to, or - for stdout",
+					Destination: &ExtractConfig.Output,
+					Value:       "-",
+				},
+				&cli.StringFlag{
+					Name:        "format",
+					Usage:       "(extract) Format of the extracted objects: yaml or json",
+					Destination: &ExtractConfig.Format,
+					Value:       "yaml",
+				},
+				&cli.BoolFlag{
+					Name:        "restore",
+					Usage:       "(extract) Write the extracted objects back into the datastore instead of to a file. Objects that still exist are left unchanged",
+					Destination: &ExtractConfig.Restore,
+				},
+				&cli.BoolFlag{
+					Name:        "overwrite",
+					Usage:       "(extract) Replace objects that still exist when restoring",
+					Destination: &ExtractConfig.Overwrite,
+				},
+			),
+		},
+	}
+}
+
+// SnapshotRetentionCount returns the number of snapshots to retain. If the count was not set explicitly and
+// a maximum age or retention tier is set, the default count is not applied, so that it does not remove
+// snapshots that the other rules would keep.
+func SnapshotRetentionCount(ctx *cli.Context, cfg *Server) int {
+	for _, name := range []string{"etcd-snapshot-retention", "snapshot-retention"} {
+		if ctx.IsSet(name) {
+			return cfg.EtcdSnapshotRetention
+		}
+	}
+	if cfg.EtcdSnapshotMaxAge > 0 || cfg.EtcdSnapshotKeepHourly > 0 || cfg.EtcdSnapshotKeepDaily > 0 || cfg.EtcdSnapshotKeepWeekly > 0 {
+		return 0
 	}
+	return cfg.EtcdSnapshotRetention
 }
@@ -12,6 +12,11 @@ import (
 const (
 	defaultSnapshotRentention    = 5
 	defaultSnapshotIntervalHours = 12
+	defaultS3PartSize            = 16
+	defaultS3Concurrency         = 2
+	defaultS3PartTimeout         = 5 * time.Minute
+	defaultS3PartRetries         = 3
+	defaultSnapshotHookTimeout   = time.Minute
 )
 
 type StartupHookArgs struct {
@@ -82,21 +87,67 @@ type Server struct {
 	EtcdSnapshotName         string
 	EtcdDisableSnapshots     bool
 	EtcdExposeMetrics        bool
+	EtcdSnapshotMetrics      bool
+	EtcdClientPort           int
+	EtcdPeerPort             int
+	EtcdMetricsPort          int
+	EtcdBindAddress          string
+	EtcdDefragCron           string
+	EtcdDefragThreshold      float64
+	EtcdDefragMinSize        int
+	EtcdNospaceRecovery      bool
+	EtcdLearnerInterval      time.Duration
+	EtcdLearnerMaxStall      time.Duration
+	EtcdLearnerNoEvict       bool
 	EtcdSnapshotDir          string
 	EtcdSnapshotCron         string
+	EtcdSnapshotSchedules    cli.StringSlice
+	EtcdSnapshotCoordinated  bool
 	EtcdSnapshotRetention    int
+	EtcdSnapshotMaxAge       time.Duration
+	EtcdSnapshotKeepHourly   int
+	EtcdSnapshotKeepDaily    int
+	EtcdSnapshotKeepWeekly   int
 	EtcdSnapshotCompress     bool
+	EtcdSnapshotCompression  string
+	EtcdSnapshotMirrorDir    string
+	EtcdSnapshotKeyFile      string
+	EtcdSnapshotPreHooks     cli.StringSlice
+	EtcdSnapshotPostHooks    cli.StringSlice
+	EtcdSnapshotHookTimeout  time.Duration
 	EtcdS3                   bool
 	EtcdS3Endpoint           string
 	EtcdS3EndpointCA         string
 	EtcdS3SkipSSLVerify      bool
 	EtcdS3AccessKey          string
 	EtcdS3SecretKey          string
+	EtcdS3SessionToken       string
+	EtcdS3CredentialsFile    string
+	EtcdS3ConfigFile         string
+	EtcdS3Profile            string
+	EtcdS3RoleARN            string
+	EtcdS3WebIdentityFile    string
+	EtcdS3STSEndpoint        string
 	EtcdS3BucketName         string
 	EtcdS3Region             string
 	EtcdS3Folder             string
 	EtcdS3Timeout            time.Duration
+	EtcdS3Stream             bool
+	EtcdS3PartSize           int
+	EtcdS3Concurrency        int
+	EtcdS3PartTimeout        time.Duration
+	EtcdS3PartRetries        int
+	EtcdS3SSE                string
+	EtcdS3SSEKMSKeyID        string
+	EtcdS3SSECKeyFile        string
+	EtcdS3StorageClass       string
+	EtcdS3Tags               cli.StringSlice
+	EtcdS3Metadata           cli.StringSlice
 	EtcdS3Insecure           bool
+	EtcdS3Proxy              string
+	EtcdS3MaxConns           int
+	EtcdS3MaxIdleConns       int
+	EtcdS3TLSMinVersion      string
 }
 
 var (
@@ -149,6 +200,17 @@ var (
 		Usage: "(flags) Customized flag for etcd process",
 		Value: &ServerConfig.ExtraEtcdArgs,
 	}
+	EtcdClientPortFlag = cli.IntFlag{
+		Name:        "etcd-client-port",
+		Usage:       "(db) Port that etcd listens on for clients",
+		Destination: &ServerConfig.EtcdClientPort,
+		Value:       2379,
+	}
+	EtcdBindAddressFlag = cli.StringFlag{
+		Name:        "etcd-bind-address",
+		Usage:       "(db) Address that etcd listens on for clients and peers (default: the advertised address, and loopback for clients)",
+		Destination: &ServerConfig.EtcdBindAddress,
+	}
 	ExtraSchedulerArgs = cli.StringSliceFlag{
 		Name:  "kube-scheduler-arg",
 		Usage: "(flags) Customized flag for kube-scheduler process",
@@ -268,6 +330,64 @@ var ServerFlags = []cli.Flag{
 		Usage:       "(db) Expose etcd metrics to client interface. (Default false)",
 		Destination: &ServerConfig.EtcdExposeMetrics,
 	},
+	&cli.BoolFlag{
+		Name:        "etcd-snapshot-metrics",
+		Usage:       "(db) Serve etcd snapshot metrics in Prometheus format at /db/metrics on the supervisor port, to clients in the system:masters group. (Default false)",
+		Destination: &ServerConfig.EtcdSnapshotMetrics,
+	},
+	EtcdClientPortFlag,
+	&cli.IntFlag{
+		Name:        "etcd-peer-port",
+		Usage:       "(db) Port that etcd listens on for peers",
+		Destination: &ServerConfig.EtcdPeerPort,
+		Value:       2380,
+	},
+	&cli.IntFlag{
+		Name:        "etcd-metrics-port",
+		Usage:       "(db) Port that etcd serves metrics on",
+		Destination: &ServerConfig.EtcdMetricsPort,
+		Value:       2381,
+	},
+	EtcdBindAddressFlag,
+	&cli.StringFlag{
+		Name:        "etcd-defrag-schedule-cron",
+		Usage:       "(db) Interval in cron spec at which etcd members are checked and defragmented, one at a time. eg. daily at 3am '0 3 * * *'. Defragmentation is disabled if not set",
+		Destination: &ServerConfig.EtcdDefragCron,
+	},
+	&cli.Float64Flag{
+		Name:        "etcd-defrag-threshold",
+		Usage:       "(db) Fraction of an etcd member's database that must be unused before it is defragmented",
+		Destination: &ServerConfig.EtcdDefragThreshold,
+		Value:       0.5,
+	},
+	&cli.IntFlag{
+		Name:        "etcd-defrag-min-size",
+		Usage:       "(db) Size in MiB below which an etcd member's database is not defragmented",
+		Destination: &ServerConfig.EtcdDefragMinSize,
+		Value:       100,
+	},
+	&cli.BoolFlag{
+		Name:        "etcd-nospace-recovery",
+		Usage:       "(db) When etcd raises a NOSPACE alarm, compact and defragment all members, and disarm the alarm once space has been reclaimed",
+		Destination: &ServerConfig.EtcdNospaceRecovery,
+	},
+	&cli.DurationFlag{
+		Name:        "etcd-learner-check-interval",
+		Usage:       "(db) Interval at which the etcd leader checks whether joining learners can be promoted",
+		Destination: &ServerConfig.EtcdLearnerInterval,
+		Value:       15 * time.Second,
+	},
+	&cli.DurationFlag{
+		Name:        "etcd-learner-max-stall-time",
+		Usage:       "(db) Time for which a joining etcd learner may make no progress before it is evicted from the cluster",
+		Destination: &ServerConfig.EtcdLearnerMaxStall,
+		Value:       5 * time.Minute,
+	},
+	&cli.BoolFlag{
+		Name:        "etcd-learner-disable-eviction",
+		Usage:       "(db) Do not evict stalled etcd learners from the cluster; report them with a warning event instead",
+		Destination: &ServerConfig.EtcdLearnerNoEvict,
+	},
 	&cli.BoolFlag{
 		Name:        "etcd-disable-snapshots",
 		Usage:       "(db) Disable automatic etcd snapshots",
@@ -281,16 +401,46 @@ var ServerFlags = []cli.Flag{
 	},
 	&cli.StringFlag{
 		Name:        "etcd-snapshot-schedule-cron",
-		Usage:       "(db) Snapshot interval time in cron spec. eg. every 5 hours '* */5 * * *'",
+		Usage:       "(db) Snapshot interval time in cron spec. eg. every 5 hours '* */5 * * *'. Set to an empty string to only take snapshots on the schedules given by etcd-snapshot-schedule",
 		Destination: &ServerConfig.EtcdSnapshotCron,
 		Value:       "0 */12 * * *",
 	},
+	&cli.StringSliceFlag{
+		Name:  "etcd-snapshot-schedule",
+		Usage: "(db) Additional snapshot schedule, as a JSON object with name, cron, retention, maxAge, keepHourly, keepDaily, keepWeekly, compress, compression, s3 and mirror fields. The global retention policy is used if none of the retention fields are set. May be given as a list of objects in the config file",
+		Value: &ServerConfig.EtcdSnapshotSchedules,
+	},
+	&cli.BoolFlag{
+		Name:        "etcd-snapshot-coordinated",
+		Usage:       "(db) Coordinate scheduled snapshots between servers, so that each scheduled snapshot is taken by a single healthy voting member. Retention is then applied to the snapshots taken by all servers",
+		Destination: &ServerConfig.EtcdSnapshotCoordinated,
+	},
 	&cli.IntFlag{
 		Name:        "etcd-snapshot-retention",
-		Usage:       "(db) Number of snapshots to retain",
+		Usage:       "(db) Number of snapshots to retain. Only applied by default if no maximum age or retention tier is set",
 		Destination: &ServerConfig.EtcdSnapshotRetention,
 		Value:       defaultSnapshotRentention,
 	},
+	&cli.DurationFlag{
+		Name:        "etcd-snapshot-max-age",
+		Usage:       "(db) Remove snapshots older than this age, eg. 720h. The newest snapshot is always kept",
+		Destination: &ServerConfig.EtcdSnapshotMaxAge,
+	},
+	&cli.IntFlag{
+		Name:        "etcd-snapshot-keep-hourly",
+		Usage:       "(db) Number of hours for which the newest snapshot of each hour is retained",
+		Destination: &ServerConfig.EtcdSnapshotKeepHourly,
+	},
+	&cli.IntFlag{
+		Name:        "etcd-snapshot-keep-daily",
+		Usage:       "(db) Number of days for which the newest snapshot of each day is retained",
+		Destination: &ServerConfig.EtcdSnapshotKeepDaily,
+	},
+	&cli.IntFlag{
+		Name:        "etcd-snapshot-keep-weekly",
+		Usage:       "(db) Number of weeks for which the newest snapshot of each week is retained",
+		Destination: &ServerConfig.EtcdSnapshotKeepWeekly,
+	},
 	&cli.StringFlag{
 		Name:        "etcd-snapshot-dir",
 		Usage:       "(db) Directory to save db snapshots. (Default location: ${data-dir}/db/snapshots)",
@@ -301,6 +451,37 @@ var ServerFlags = []cli.Flag{
 		Usage:       "(db) Compress etcd snapshot",
 		Destination: &ServerConfig.EtcdSnapshotCompress,
 	},
+	&cli.StringFlag{
+		Name:        "etcd-snapshot-compression",
+		Usage:       "(db) Format used to compress etcd snapshots (zip, gzip or zstd). Setting a format enables compression; if only etcd-snapshot-compress is set, zip is used. Compressed snapshots are detected by content on restore",
+		Destination: &ServerConfig.EtcdSnapshotCompression,
+	},
+	&cli.StringFlag{
+		Name:        "etcd-snapshot-mirror-dir",
+		Usage:       "(db) Additional directory, such as an NFS mount, to copy db snapshots to",
+		Destination: &ServerConfig.EtcdSnapshotMirrorDir,
+	},
+	&cli.StringFlag{
+		Name:        "etcd-snapshot-encryption-key-file",
+		Usage:       "(db) File containing the passphrase used to encrypt db snapshots, and to decrypt them on restore",
+		Destination: &ServerConfig.EtcdSnapshotKeyFile,
+	},
+	&cli.StringSliceFlag{
+		Name:  "etcd-snapshot-pre-hook",
+		Usage: "(db) Executable or http(s) URL called with the details of each snapshot before it is taken. A hook that fails prevents the snapshot from being taken",
+		Value: &ServerConfig.EtcdSnapshotPreHooks,
+	},
+	&cli.StringSliceFlag{
+		Name:  "etcd-snapshot-post-hook",
+		Usage: "(db) Executable or http(s) URL called with the results of each snapshot, including failures, vetoes and uploads to S3",
+		Value: &ServerConfig.EtcdSnapshotPostHooks,
+	},
+	&cli.DurationFlag{
+		Name:        "etcd-snapshot-hook-timeout",
+		Usage:       "(db) Timeout for each snapshot hook",
+		Destination: &ServerConfig.EtcdSnapshotHookTimeout,
+		Value:       defaultSnapshotHookTimeout,
+	},
 	&cli.BoolFlag{
 		Name:        "etcd-s3",
 		Usage:       "(db) Enable backup to S3",
@@ -334,6 +515,45 @@ var ServerFlags = []cli.Flag{
 		EnvVar:      "AWS_SECRET_ACCESS_KEY",
 		Destination: &ServerConfig.EtcdS3SecretKey,
 	},
+	&cli.StringFlag{
+		Name:        "etcd-s3-session-token",
+		Usage:       "(db) S3 session token, used with temporary access and secret keys",
+		EnvVar:      "AWS_SESSION_TOKEN",
+		Destination: &ServerConfig.EtcdS3SessionToken,
+	},
+	&cli.StringFlag{
+		Name:        "etcd-s3-credentials-file",
+		Usage:       "(db) AWS shared credentials file to read S3 credentials from. The file is re-read when it changes",
+		EnvVar:      "AWS_SHARED_CREDENTIALS_FILE",
+		Destination: &ServerConfig.EtcdS3CredentialsFile,
+	},
+	&cli.StringFlag{
+		Name:        "etcd-s3-config-file",
+		Usage:       "(db) AWS shared config file to read S3 credentials or a web identity role from",
+		EnvVar:      "AWS_CONFIG_FILE",
+		Destination: &ServerConfig.EtcdS3ConfigFile,
+	},
+	&cli.StringFlag{
+		Name:        "etcd-s3-profile",
+		Usage:       "(db) Profile to use from the AWS shared credentials or config file (default: default)",
+		EnvVar:      "AWS_PROFILE",
+		Destination: &ServerConfig.EtcdS3Profile,
+	},
+	&cli.StringFlag{
+		Name:        "etcd-s3-role-arn",
+		Usage:       "(db) ARN of the role to assume with the S3 web identity token file",
+		Destination: &ServerConfig.EtcdS3RoleARN,
+	},
+	&cli.StringFlag{
+		Name:        "etcd-s3-web-identity-token-file",
+		Usage:       "(db) Web identity token file used to assume the S3 role. The file is re-read when credentials are refreshed",
+		Destination: &ServerConfig.EtcdS3WebIdentityFile,
+	},
+	&cli.StringFlag{
+		Name:        "etcd-s3-sts-endpoint",
+		Usage:       "(db) STS endpoint used to assume the S3 role (default: https://sts.amazonaws.com)",
+		Destination: &ServerConfig.EtcdS3STSEndpoint,
+	},
 	&cli.StringFlag{
 		Name:        "etcd-s3-bucket",
 		Usage:       "(db) S3 bucket name",
@@ -355,12 +575,91 @@ var ServerFlags = []cli.Flag{
 		Usage:       "(db) Disables S3 over HTTPS",
 		Destination: &ServerConfig.EtcdS3Insecure,
 	},
+	&cli.StringFlag{
+		Name:        "etcd-s3-proxy",
+		Usage:       "(db) Proxy URL used for S3 traffic only. If not set, the proxy environment variables are used",
+		Destination: &ServerConfig.EtcdS3Proxy,
+	},
+	&cli.IntFlag{
+		Name:        "etcd-s3-max-connections",
+		Usage:       "(db) Maximum number of connections to the S3 endpoint (default: unlimited)",
+		Destination: &ServerConfig.EtcdS3MaxConns,
+	},
+	&cli.IntFlag{
+		Name:        "etcd-s3-max-idle-connections",
+		Usage:       "(db) Maximum number of idle connections to the S3 endpoint to keep open",
+		Destination: &ServerConfig.EtcdS3MaxIdleConns,
+	},
+	&cli.StringFlag{
+		Name:        "etcd-s3-tls-min-version",
+		Usage:       "(db) Minimum TLS version for connections to the S3 endpoint, eg. VersionTLS12",
+		Destination: &ServerConfig.EtcdS3TLSMinVersion,
+	},
 	&cli.DurationFlag{
 		Name:        "etcd-s3-timeout",
 		Usage:       "(db) S3 timeout",
 		Destination: &ServerConfig.EtcdS3Timeout,
 		Value:       30 * time.Second,
 	},
+	&cli.BoolFlag{
+		Name:        "etcd-s3-stream",
+		Usage:       "(db) Stream snapshots directly to S3 without saving them or their checksum file to the local snapshot directory. Cannot be used with etcd-snapshot-mirror-dir",
+		Destination: &ServerConfig.EtcdS3Stream,
+	},
+	&cli.IntFlag{
+		Name:        "etcd-s3-part-size",
+		Usage:       "(db) Size in MiB of each part of S3 multipart uploads (minimum 5)",
+		Destination: &ServerConfig.EtcdS3PartSize,
+		Value:       defaultS3PartSize,
+	},
+	&cli.IntFlag{
+		Name:        "etcd-s3-concurrency",
+		Usage:       "(db) Number of parts of S3 multipart uploads to upload in parallel",
+		Destination: &ServerConfig.EtcdS3Concurrency,
+		Value:       defaultS3Concurrency,
+	},
+	&cli.DurationFlag{
+		Name:        "etcd-s3-part-timeout",
+		Usage:       "(db) Timeout for each attempt to upload a part of an S3 multipart upload",
+		Destination: &ServerConfig.EtcdS3PartTimeout,
+		Value:       defaultS3PartTimeout,
+	},
+	&cli.IntFlag{
+		Name:        "etcd-s3-part-retries",
+		Usage:       "(db) Number of times to retry the upload of a part of an S3 multipart upload",
+		Destination: &ServerConfig.EtcdS3PartRetries,
+		Value:       defaultS3PartRetries,
+	},
+	&cli.StringFlag{
+		Name:        "etcd-s3-sse",
+		Usage:       "(db) S3 server-side encryption to request for snapshots: AES256 (SSE-S3) or aws:kms (SSE-KMS)",
+		Destination: &ServerConfig.EtcdS3SSE,
+	},
+	&cli.StringFlag{
+		Name:        "etcd-s3-sse-kms-key-id",
+		Usage:       "(db) S3 KMS key ID used to encrypt snapshots with SSE-KMS",
+		Destination: &ServerConfig.EtcdS3SSEKMSKeyID,
+	},
+	&cli.StringFlag{
+		Name:        "etcd-s3-sse-c-key-file",
+		Usage:       "(db) File containing the 32 byte customer key, raw or base64 encoded, used to encrypt snapshots with SSE-C",
+		Destination: &ServerConfig.EtcdS3SSECKeyFile,
+	},
+	&cli.StringFlag{
+		Name:        "etcd-s3-storage-class",
+		Usage:       "(db) S3 storage class of uploaded snapshots, eg. STANDARD_IA",
+		Destination: &ServerConfig.EtcdS3StorageClass,
+	},
+	&cli.StringSliceFlag{
+		Name:  "etcd-s3-tag",
+		Usage: "(db) Tag to add to uploaded snapshots, in the form key=value",
+		Value: &ServerConfig.EtcdS3Tags,
+	},
+	&cli.StringSliceFlag{
+		Name:  "etcd-s3-metadata",
+		Usage: "(db) User metadata to add to uploaded snapshots, in the form key=value",
+		Value: &ServerConfig.EtcdS3Metadata,
+	},
 	cli.StringFlag{
 		Name:        "default-local-storage-path",
 		Usage:       "(storage) Default local storage path for local provisioner storage class",
@@ -470,7 +769,7 @@ var ServerFlags = []cli.Flag{
 	},
 	&cli.StringFlag{
 		Name:        "cluster-reset-restore-path",
-		Usage:       "(db) Path to snapshot file to be restored",
+		Usage:       "(db) Path to snapshot file to be restored, or latest, latest:<node> or latest:<name-prefix> to restore the newest matching snapshot",
 		Destination: &ServerConfig.ClusterResetRestorePath,
 	},
 	cli.BoolFlag{
@@ -0,0 +1,160 @@
+package etcdmember
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/erikdubbelboer/gspt"
+	"github.com/rancher/wrangler/pkg/signals"
+	"github.com/urfave/cli"
+	"github.com/wangxiaochuang/k3s/pkg/cli/cmds"
+	"github.com/wangxiaochuang/k3s/pkg/daemons/config"
+	"github.com/wangxiaochuang/k3s/pkg/etcd"
+	"github.com/wangxiaochuang/k3s/pkg/server"
+)
+
+// commandSetup returns an etcd instance using the client certificates from the data dir,
+// for each etcd-member command.
+func commandSetup(cfg *cmds.Server) (*etcd.ETCD, error) {
+	gspt.SetProcTitle(os.Args[0])
+
+	dataDir, err := server.ResolveDataDir(cfg.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	controlConfig := &config.Control{
+		DataDir:         dataDir,
+		EtcdClientPort:  cfg.EtcdClientPort,
+		EtcdBindAddress: cfg.EtcdBindAddress,
+		Runtime:         &config.ControlRuntime{},
+	}
+	controlConfig.Runtime.ETCDServerCA = filepath.Join(dataDir, "tls", "etcd", "server-ca.crt")
+	controlConfig.Runtime.ClientETCDCert = filepath.Join(dataDir, "tls", "etcd", "client.crt")
+	controlConfig.Runtime.ClientETCDKey = filepath.Join(dataDir, "tls", "etcd", "client.key")
+
+	e := etcd.NewETCD()
+	e.SetControlConfig(controlConfig)
+	return e, nil
+}
+
+// memberArg returns the single member name or ID given as an argument.
+func memberArg(app *cli.Context) (string, error) {
+	if len(app.Args()) != 1 {
+		return "", errors.New("exactly one etcd member name or ID must be given")
+	}
+	return app.Args().First(), nil
+}
+
+// List is an action that prints the members of the etcd cluster.
+func List(app *cli.Context) error {
+	if err := cmds.InitLogging(); err != nil {
+		return err
+	}
+	return list(app, &cmds.ServerConfig)
+}
+
+func list(app *cli.Context, cfg *cmds.Server) error {
+	e, err := commandSetup(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx := signals.SetupSignalContext()
+	members, err := e.ListMembers(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprint(w, "ID\tName\tRole\tPeer URLs\tClient URLs\tVersion\tRaft Term\tRaft Index\tApplied Index\tDB Size\tDB Size In Use\tStatus\n")
+	for _, m := range members {
+		role := "voter"
+		if m.IsLearner {
+			role = "learner"
+		} else if m.IsLeader {
+			role = "leader"
+		}
+		status := "ok"
+		if m.Err != nil {
+			status = m.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			etcd.FormatMemberID(m.ID), m.Name, role, strings.Join(m.PeerURLs, ","), strings.Join(m.ClientURLs, ","),
+			m.Version, m.RaftTerm, m.RaftIndex, m.RaftAppliedIndex, m.DBSize, m.DBSizeInUse, status)
+	}
+
+	return nil
+}
+
+// Remove is an action that removes the given member from the etcd cluster.
+func Remove(app *cli.Context) error {
+	if err := cmds.InitLogging(); err != nil {
+		return err
+	}
+	return remove(app, &cmds.ServerConfig)
+}
+
+func remove(app *cli.Context, cfg *cmds.Server) error {
+	member, err := memberArg(app)
+	if err != nil {
+		return err
+	}
+
+	e, err := commandSetup(cfg)
+	if err != nil {
+		return err
+	}
+
+	return e.RemoveMember(signals.SetupSignalContext(), member)
+}
+
+// Promote is an action that promotes the given learner to a voting member of the etcd cluster.
+func Promote(app *cli.Context) error {
+	if err := cmds.InitLogging(); err != nil {
+		return err
+	}
+	return promote(app, &cmds.ServerConfig)
+}
+
+func promote(app *cli.Context, cfg *cmds.Server) error {
+	member, err := memberArg(app)
+	if err != nil {
+		return err
+	}
+
+	e, err := commandSetup(cfg)
+	if err != nil {
+		return err
+	}
+
+	return e.PromoteMember(signals.SetupSignalContext(), member)
+}
+
+// MoveLeader is an action that transfers leadership of the etcd cluster to the given member.
+func MoveLeader(app *cli.Context) error {
+	if err := cmds.InitLogging(); err != nil {
+		return err
+	}
+	return moveLeader(app, &cmds.ServerConfig)
+}
+
+func moveLeader(app *cli.Context, cfg *cmds.Server) error {
+	member, err := memberArg(app)
+	if err != nil {
+		return err
+	}
+
+	e, err := commandSetup(cfg)
+	if err != nil {
+		return err
+	}
+
+	return e.MoveLeader(signals.SetupSignalContext(), member)
+}
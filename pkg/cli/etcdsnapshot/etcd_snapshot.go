@@ -0,0 +1,549 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/erikdubbelboer/gspt"
+	"github.com/rancher/wrangler/pkg/generated/controllers/core"
+	"github.com/rancher/wrangler/pkg/signals"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"github.com/wangxiaochuang/k3s/pkg/cli/cmds"
+	"github.com/wangxiaochuang/k3s/pkg/daemons/config"
+	"github.com/wangxiaochuang/k3s/pkg/etcd"
+	"github.com/wangxiaochuang/k3s/pkg/server"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// apiServerCheckTimeout is the time allowed for the apiserver to respond before snapshot
+// metadata recording is skipped.
+const apiServerCheckTimeout = 10 * time.Second
+
+// commandSetup setups up common things needed
+// for each etcd command.
+func commandSetup(app *cli.Context, cfg *cmds.Server, sc *server.Config) (string, error) {
+	gspt.SetProcTitle(os.Args[0])
+
+	nodeName := app.String("node-name")
+	if nodeName == "" {
+		h, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		nodeName = h
+	}
+
+	os.Setenv("NODE_NAME", nodeName)
+
+	if cfg.EtcdSnapshotCompression != "" {
+		if err := etcd.ValidateSnapshotCompression(cfg.EtcdSnapshotCompression); err != nil {
+			return "", err
+		}
+	}
+	if cfg.EtcdS3Stream && cfg.EtcdSnapshotMirrorDir != "" {
+		return "", errors.New("invalid flag use; --s3-stream cannot be used with --mirror-dir, as streamed snapshots are not saved locally")
+	}
+
+	sc.ControlConfig.DataDir = cfg.DataDir
+	sc.ControlConfig.EtcdClientPort = cfg.EtcdClientPort
+	sc.ControlConfig.EtcdBindAddress = cfg.EtcdBindAddress
+	sc.ControlConfig.EtcdSnapshotName = cfg.EtcdSnapshotName
+	sc.ControlConfig.EtcdSnapshotDir = cfg.EtcdSnapshotDir
+	sc.ControlConfig.EtcdSnapshotCompress = cfg.EtcdSnapshotCompress
+	sc.ControlConfig.EtcdSnapshotCompression = cfg.EtcdSnapshotCompression
+	sc.ControlConfig.EtcdSnapshotMirrorDir = cfg.EtcdSnapshotMirrorDir
+	sc.ControlConfig.EtcdSnapshotKeyFile = cfg.EtcdSnapshotKeyFile
+	sc.ControlConfig.EtcdSnapshotPreHooks = cfg.EtcdSnapshotPreHooks
+	sc.ControlConfig.EtcdSnapshotPostHooks = cfg.EtcdSnapshotPostHooks
+	sc.ControlConfig.EtcdSnapshotHookTimeout = cfg.EtcdSnapshotHookTimeout
+	sc.ControlConfig.EtcdS3 = cfg.EtcdS3
+	sc.ControlConfig.EtcdS3Endpoint = cfg.EtcdS3Endpoint
+	sc.ControlConfig.EtcdS3EndpointCA = cfg.EtcdS3EndpointCA
+	sc.ControlConfig.EtcdS3SkipSSLVerify = cfg.EtcdS3SkipSSLVerify
+	sc.ControlConfig.EtcdS3AccessKey = cfg.EtcdS3AccessKey
+	sc.ControlConfig.EtcdS3SecretKey = cfg.EtcdS3SecretKey
+	sc.ControlConfig.EtcdS3SessionToken = cfg.EtcdS3SessionToken
+	sc.ControlConfig.EtcdS3CredentialsFile = cfg.EtcdS3CredentialsFile
+	sc.ControlConfig.EtcdS3ConfigFile = cfg.EtcdS3ConfigFile
+	sc.ControlConfig.EtcdS3Profile = cfg.EtcdS3Profile
+	sc.ControlConfig.EtcdS3RoleARN = cfg.EtcdS3RoleARN
+	sc.ControlConfig.EtcdS3WebIdentityFile = cfg.EtcdS3WebIdentityFile
+	sc.ControlConfig.EtcdS3STSEndpoint = cfg.EtcdS3STSEndpoint
+	sc.ControlConfig.EtcdS3BucketName = cfg.EtcdS3BucketName
+	sc.ControlConfig.EtcdS3Region = cfg.EtcdS3Region
+	sc.ControlConfig.EtcdS3Folder = cfg.EtcdS3Folder
+	sc.ControlConfig.EtcdS3Insecure = cfg.EtcdS3Insecure
+	sc.ControlConfig.EtcdS3Proxy = cfg.EtcdS3Proxy
+	sc.ControlConfig.EtcdS3MaxConns = cfg.EtcdS3MaxConns
+	sc.ControlConfig.EtcdS3MaxIdleConns = cfg.EtcdS3MaxIdleConns
+	sc.ControlConfig.EtcdS3TLSMinVersion = cfg.EtcdS3TLSMinVersion
+	sc.ControlConfig.EtcdS3Timeout = cfg.EtcdS3Timeout
+	sc.ControlConfig.EtcdS3Stream = cfg.EtcdS3Stream
+	sc.ControlConfig.EtcdS3PartSize = cfg.EtcdS3PartSize
+	sc.ControlConfig.EtcdS3Concurrency = cfg.EtcdS3Concurrency
+	sc.ControlConfig.EtcdS3PartTimeout = cfg.EtcdS3PartTimeout
+	sc.ControlConfig.EtcdS3PartRetries = cfg.EtcdS3PartRetries
+	sc.ControlConfig.EtcdS3SSE = cfg.EtcdS3SSE
+	sc.ControlConfig.EtcdS3SSEKMSKeyID = cfg.EtcdS3SSEKMSKeyID
+	sc.ControlConfig.EtcdS3SSECKeyFile = cfg.EtcdS3SSECKeyFile
+	sc.ControlConfig.EtcdS3StorageClass = cfg.EtcdS3StorageClass
+	sc.ControlConfig.EtcdS3Tags = cfg.EtcdS3Tags
+	sc.ControlConfig.EtcdS3Metadata = cfg.EtcdS3Metadata
+	sc.ControlConfig.Runtime = &config.ControlRuntime{}
+
+	dataDir, err := server.ResolveDataDir(cfg.DataDir)
+	if err != nil {
+		return "", err
+	}
+
+	sc.ControlConfig.DataDir = dataDir
+	sc.ControlConfig.Runtime.KubeConfigAdmin = filepath.Join(dataDir, "cred", "admin.kubeconfig")
+	sc.ControlConfig.Runtime.ETCDServerCA = filepath.Join(dataDir, "tls", "etcd", "server-ca.crt")
+	sc.ControlConfig.Runtime.ClientETCDCert = filepath.Join(dataDir, "tls", "etcd", "client.crt")
+	sc.ControlConfig.Runtime.ClientETCDKey = filepath.Join(dataDir, "tls", "etcd", "client.key")
+
+	return dataDir, nil
+}
+
+// setupCore sets a core controller factory for the local apiserver on the runtime, used to record snapshot
+// metadata. The runtime's CoreReady channel is only closed if the apiserver can be reached; if it cannot,
+// snapshot metadata is not recorded, and is left for the servers to reconcile once the cluster is running.
+func setupCore(ctx context.Context, runtime *config.ControlRuntime) error {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", runtime.KubeConfigAdmin)
+	if err != nil {
+		return err
+	}
+	sc, err := core.NewFactoryFromConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	runtime.Core = sc
+
+	coreReady := make(chan struct{})
+	runtime.CoreReady = coreReady
+
+	restConfig = rest.CopyConfig(restConfig)
+	restConfig.Timeout = apiServerCheckTimeout
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	if _, err := discoveryClient.ServerVersion(); err != nil {
+		logrus.Warnf("Unable to reach apiserver, etcd snapshot metadata will not be recorded: %v", err)
+		return nil
+	}
+	close(coreReady)
+	return nil
+}
+
+// Run is an action that takes an etcd snapshot on demand.
+func Run(app *cli.Context) error {
+	if err := cmds.InitLogging(); err != nil {
+		return err
+	}
+	return run(app, &cmds.ServerConfig)
+}
+
+func run(app *cli.Context, cfg *cmds.Server) error {
+	var serverConfig server.Config
+
+	dataDir, err := commandSetup(app, cfg, &serverConfig)
+	if err != nil {
+		return err
+	}
+
+	if len(app.Args()) > 0 {
+		return errors.New("this command does not take any arguments")
+	}
+
+	serverConfig.ControlConfig.EtcdSnapshotRetention = 0 // disable retention check
+
+	ctx := signals.SetupSignalContext()
+	e := etcd.NewETCD()
+	e.SetControlConfig(&serverConfig.ControlConfig)
+
+	initialized, err := e.IsInitialized(ctx, &serverConfig.ControlConfig)
+	if err != nil {
+		return err
+	}
+	if !initialized {
+		return fmt.Errorf("etcd database not found in %s", dataDir)
+	}
+
+	if err := setupCore(ctx, serverConfig.ControlConfig.Runtime); err != nil {
+		return err
+	}
+
+	return e.Snapshot(ctx, &serverConfig.ControlConfig)
+}
+
+// Delete is an action that removes the given snapshots.
+func Delete(app *cli.Context) error {
+	if err := cmds.InitLogging(); err != nil {
+		return err
+	}
+	return delete(app, &cmds.ServerConfig)
+}
+
+func delete(app *cli.Context, cfg *cmds.Server) error {
+	var serverConfig server.Config
+
+	if _, err := commandSetup(app, cfg, &serverConfig); err != nil {
+		return err
+	}
+
+	snapshots := app.Args()
+	if len(snapshots) == 0 {
+		return errors.New("no snapshots given for removal")
+	}
+
+	ctx := signals.SetupSignalContext()
+	e := etcd.NewETCD()
+	e.SetControlConfig(&serverConfig.ControlConfig)
+
+	if err := setupCore(ctx, serverConfig.ControlConfig.Runtime); err != nil {
+		return err
+	}
+
+	return e.DeleteSnapshots(ctx, app.Args())
+}
+
+// List is an action that prints the snapshots held in S3 if it is enabled, or otherwise held locally.
+func List(app *cli.Context) error {
+	if err := cmds.InitLogging(); err != nil {
+		return err
+	}
+	return list(app, &cmds.ServerConfig)
+}
+
+func list(app *cli.Context, cfg *cmds.Server) error {
+	var serverConfig server.Config
+
+	if _, err := commandSetup(app, cfg, &serverConfig); err != nil {
+		return err
+	}
+
+	ctx := signals.SetupSignalContext()
+	e := etcd.NewETCD()
+	e.SetControlConfig(&serverConfig.ControlConfig)
+
+	sf, err := e.ListSnapshots(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprint(w, "Name\tLocation\tSize\tCreated\n")
+	for _, s := range sf {
+		location := s.Location
+		if location == "" {
+			location = s.NodeName
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", s.Name, location, s.Size, s.CreatedAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// Prune is an action that applies the retention policy to existing snapshots.
+func Prune(app *cli.Context) error {
+	if err := cmds.InitLogging(); err != nil {
+		return err
+	}
+	return prune(app, &cmds.ServerConfig)
+}
+
+func prune(app *cli.Context, cfg *cmds.Server) error {
+	var serverConfig server.Config
+
+	if _, err := commandSetup(app, cfg, &serverConfig); err != nil {
+		return err
+	}
+
+	serverConfig.ControlConfig.EtcdSnapshotRetention = cmds.SnapshotRetentionCount(app, cfg)
+	serverConfig.ControlConfig.EtcdSnapshotMaxAge = cfg.EtcdSnapshotMaxAge
+	serverConfig.ControlConfig.EtcdSnapshotKeepHourly = cfg.EtcdSnapshotKeepHourly
+	serverConfig.ControlConfig.EtcdSnapshotKeepDaily = cfg.EtcdSnapshotKeepDaily
+	serverConfig.ControlConfig.EtcdSnapshotKeepWeekly = cfg.EtcdSnapshotKeepWeekly
+
+	ctx := signals.SetupSignalContext()
+	e := etcd.NewETCD()
+	e.SetControlConfig(&serverConfig.ControlConfig)
+
+	if err := setupCore(ctx, serverConfig.ControlConfig.Runtime); err != nil {
+		return err
+	}
+
+	return e.PruneSnapshots(ctx)
+}
+
+// Verify is an action that checks the integrity of the given snapshots, or of all snapshots if none are given.
+func Verify(app *cli.Context) error {
+	if err := cmds.InitLogging(); err != nil {
+		return err
+	}
+	return verify(app, &cmds.ServerConfig)
+}
+
+func verify(app *cli.Context, cfg *cmds.Server) error {
+	var serverConfig server.Config
+
+	if _, err := commandSetup(app, cfg, &serverConfig); err != nil {
+		return err
+	}
+
+	ctx := signals.SetupSignalContext()
+	e := etcd.NewETCD()
+	e.SetControlConfig(&serverConfig.ControlConfig)
+
+	results, err := e.VerifySnapshots(ctx, app.Args())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+
+	var failed int
+	fmt.Fprint(w, "Name\tStore\tSize\tRevision\tKeys\tStatus\n")
+	for _, r := range results {
+		status := "ok"
+		if r.Err != nil {
+			status = r.Err.Error()
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\n", r.Name, r.Store, r.Size, r.Revision, r.TotalKey, status)
+	}
+	w.Flush()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d snapshots failed verification", failed, len(results))
+	}
+	return nil
+}
+
+// RestorePlan is an action that prints the snapshot that a cluster reset would restore from the given path.
+func RestorePlan(app *cli.Context) error {
+	if err := cmds.InitLogging(); err != nil {
+		return err
+	}
+	return restorePlan(app, &cmds.ServerConfig)
+}
+
+func restorePlan(app *cli.Context, cfg *cmds.Server) error {
+	var serverConfig server.Config
+
+	if _, err := commandSetup(app, cfg, &serverConfig); err != nil {
+		return err
+	}
+
+	if len(app.Args()) > 1 {
+		return errors.New("only one restore path may be given")
+	}
+	restorePath := app.Args().First()
+	if restorePath == "" {
+		restorePath = "latest"
+	}
+
+	ctx := signals.SetupSignalContext()
+	e := etcd.NewETCD()
+	e.SetControlConfig(&serverConfig.ControlConfig)
+
+	plan, err := e.RestorePlan(ctx, restorePath)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "Restore path:\t%s\n", plan.RestorePath)
+	if plan.Candidates > 0 {
+		fmt.Fprintf(w, "Matching snapshots:\t%d\n", plan.Candidates)
+	}
+	fmt.Fprintf(w, "Snapshot:\t%s\n", plan.Snapshot.Name)
+	fmt.Fprintf(w, "Store:\t%s\n", plan.Store.Name())
+	if plan.Snapshot.Location != "" {
+		fmt.Fprintf(w, "Location:\t%s\n", plan.Snapshot.Location)
+	}
+	if plan.Snapshot.CreatedAt != nil {
+		fmt.Fprintf(w, "Created:\t%s\n", plan.Snapshot.CreatedAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "Size:\t%d\n", plan.Snapshot.Size)
+	if plan.Snapshot.Checksum != "" {
+		fmt.Fprintf(w, "Checksum:\tsha256:%s\n", plan.Snapshot.Checksum)
+	}
+	fmt.Fprintf(w, "Encrypted:\t%t\n", plan.Snapshot.Encrypted)
+
+	return nil
+}
+
+// Inspect is an action that prints the revision, key count and size by resource of the given snapshot.
+func Inspect(app *cli.Context) error {
+	if err := cmds.InitLogging(); err != nil {
+		return err
+	}
+	return inspect(app, &cmds.ServerConfig)
+}
+
+func inspect(app *cli.Context, cfg *cmds.Server) error {
+	var serverConfig server.Config
+
+	if _, err := commandSetup(app, cfg, &serverConfig); err != nil {
+		return err
+	}
+
+	if len(app.Args()) != 1 {
+		return errors.New("exactly one snapshot name or file must be given")
+	}
+
+	ctx := signals.SetupSignalContext()
+	e := etcd.NewETCD()
+	e.SetControlConfig(&serverConfig.ControlConfig)
+
+	inspection, err := e.InspectSnapshot(ctx, app.Args().First())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "Snapshot:\t%s\n", inspection.Name)
+	fmt.Fprintf(w, "Revision:\t%d\n", inspection.Revision)
+	fmt.Fprintf(w, "Keys:\t%d\n", inspection.TotalKey)
+	fmt.Fprintf(w, "Size:\t%d\n\n", inspection.Size)
+
+	fmt.Fprint(w, "Prefix\tKeys\tSize\n")
+	for _, p := range inspection.Prefixes {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", p.Prefix, p.Keys, p.Size)
+	}
+
+	return nil
+}
+
+// Diff is an action that prints the keys added, deleted or modified between two snapshots.
+func Diff(app *cli.Context) error {
+	if err := cmds.InitLogging(); err != nil {
+		return err
+	}
+	return diff(app, &cmds.ServerConfig)
+}
+
+func diff(app *cli.Context, cfg *cmds.Server) error {
+	var serverConfig server.Config
+
+	if _, err := commandSetup(app, cfg, &serverConfig); err != nil {
+		return err
+	}
+
+	if len(app.Args()) != 2 {
+		return errors.New("exactly two snapshot names or files must be given")
+	}
+
+	ctx := signals.SetupSignalContext()
+	e := etcd.NewETCD()
+	e.SetControlConfig(&serverConfig.ControlConfig)
+
+	result, err := e.DiffSnapshots(ctx, app.Args().Get(0), app.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+
+	counts := map[string]int{}
+	fmt.Fprint(w, "Change\tKey\tFrom Revision\tTo Revision\n")
+	for _, c := range result.Changes {
+		counts[c.Change]++
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", c.Change, c.Key, c.FromRevision, c.ToRevision)
+	}
+	fmt.Fprintf(w, "\nRevision %d to %d: %d added, %d deleted, %d modified\n",
+		result.FromRevision, result.ToRevision, counts["added"], counts["deleted"], counts["modified"])
+
+	return nil
+}
+
+// Extract is an action that writes the selected objects from the given snapshot to a file, or restores them to the datastore.
+func Extract(app *cli.Context) error {
+	if err := cmds.InitLogging(); err != nil {
+		return err
+	}
+	return extract(app, &cmds.ServerConfig, &cmds.ExtractConfig)
+}
+
+func extract(app *cli.Context, cfg *cmds.Server, extractCfg *cmds.EtcdSnapshotExtract) error {
+	var serverConfig server.Config
+
+	dataDir, err := commandSetup(app, cfg, &serverConfig)
+	if err != nil {
+		return err
+	}
+
+	if len(app.Args()) != 1 {
+		return errors.New("exactly one snapshot name or file must be given")
+	}
+	if extractCfg.Overwrite && !extractCfg.Restore {
+		return errors.New("--overwrite may only be used with --restore")
+	}
+
+	ctx := signals.SetupSignalContext()
+	e := etcd.NewETCD()
+	e.SetControlConfig(&serverConfig.ControlConfig)
+
+	selector := etcd.ObjectSelector{
+		Resource:  extractCfg.Resource,
+		Namespace: extractCfg.Namespace,
+		Name:      extractCfg.Name,
+	}
+	objects, err := e.ExtractSnapshot(ctx, app.Args().First(), selector)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return errors.New("no objects in the snapshot match the given resource, namespace and name")
+	}
+
+	if !extractCfg.Restore {
+		if extractCfg.Output == "" || extractCfg.Output == "-" {
+			return etcd.EncodeSnapshotObjects(os.Stdout, extractCfg.Format, objects)
+		}
+		// extracted objects may include secrets
+		f, err := os.OpenFile(extractCfg.Output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if err := etcd.EncodeSnapshotObjects(f, extractCfg.Format, objects); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	initialized, err := e.IsInitialized(ctx, &serverConfig.ControlConfig)
+	if err != nil {
+		return err
+	}
+	if !initialized {
+		return fmt.Errorf("etcd database not found in %s", dataDir)
+	}
+
+	restored, skipped, err := e.RestoreSnapshotObjects(ctx, objects, extractCfg.Overwrite)
+	for _, key := range restored {
+		fmt.Printf("restored\t%s\n", key)
+	}
+	for _, key := range skipped {
+		fmt.Printf("exists\t%s\n", key)
+	}
+	return err
+}
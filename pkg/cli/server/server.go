@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"os"
@@ -12,6 +13,7 @@ import (
 	"github.com/erikdubbelboer/gspt"
 	"github.com/pkg/errors"
 	"github.com/rancher/wrangler/pkg/signals"
+	"github.com/robfig/cron/v3"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"github.com/wangxiaochuang/k3s/pkg/agent/loadbalancer"
@@ -132,24 +134,99 @@ func run(app *cli.Context, cfg *cmds.Server, leaderControllers server.CustomCont
 	serverConfig.ControlConfig.ClusterInit = cfg.ClusterInit
 	serverConfig.ControlConfig.EncryptSecrets = cfg.EncryptSecrets
 	serverConfig.ControlConfig.EtcdExposeMetrics = cfg.EtcdExposeMetrics
+	serverConfig.ControlConfig.EtcdSnapshotMetrics = cfg.EtcdSnapshotMetrics
+	if err := validateEtcdPorts(cfg); err != nil {
+		return err
+	}
+	serverConfig.ControlConfig.EtcdClientPort = cfg.EtcdClientPort
+	serverConfig.ControlConfig.EtcdPeerPort = cfg.EtcdPeerPort
+	serverConfig.ControlConfig.EtcdMetricsPort = cfg.EtcdMetricsPort
+	serverConfig.ControlConfig.EtcdBindAddress = cfg.EtcdBindAddress
 	serverConfig.ControlConfig.EtcdDisableSnapshots = cfg.EtcdDisableSnapshots
+	if cfg.EtcdDefragThreshold < 0 || cfg.EtcdDefragThreshold > 1 {
+		return fmt.Errorf("invalid etcd-defrag-threshold %v: must be between 0 and 1", cfg.EtcdDefragThreshold)
+	}
+	if cfg.EtcdDefragCron != "" {
+		if _, err := cron.ParseStandard(cfg.EtcdDefragCron); err != nil {
+			return errors.Wrapf(err, "invalid etcd-defrag-schedule-cron %s", cfg.EtcdDefragCron)
+		}
+	}
+	serverConfig.ControlConfig.EtcdDefragCron = cfg.EtcdDefragCron
+	serverConfig.ControlConfig.EtcdDefragThreshold = cfg.EtcdDefragThreshold
+	serverConfig.ControlConfig.EtcdDefragMinSize = cfg.EtcdDefragMinSize
+	serverConfig.ControlConfig.EtcdNospaceRecovery = cfg.EtcdNospaceRecovery
+	if cfg.EtcdLearnerInterval <= 0 {
+		return fmt.Errorf("invalid etcd-learner-check-interval %v: must be greater than zero", cfg.EtcdLearnerInterval)
+	}
+	if cfg.EtcdLearnerMaxStall <= 0 {
+		return fmt.Errorf("invalid etcd-learner-max-stall-time %v: must be greater than zero", cfg.EtcdLearnerMaxStall)
+	}
+	serverConfig.ControlConfig.EtcdLearnerInterval = cfg.EtcdLearnerInterval
+	serverConfig.ControlConfig.EtcdLearnerMaxStall = cfg.EtcdLearnerMaxStall
+	serverConfig.ControlConfig.EtcdLearnerNoEvict = cfg.EtcdLearnerNoEvict
 
 	if !cfg.EtcdDisableSnapshots {
 		serverConfig.ControlConfig.EtcdSnapshotName = cfg.EtcdSnapshotName
 		serverConfig.ControlConfig.EtcdSnapshotCron = cfg.EtcdSnapshotCron
+		if cfg.EtcdSnapshotCompression != "" {
+			if err := etcd.ValidateSnapshotCompression(cfg.EtcdSnapshotCompression); err != nil {
+				return err
+			}
+		}
+		serverConfig.ControlConfig.EtcdSnapshotCompress = cfg.EtcdSnapshotCompress
+		serverConfig.ControlConfig.EtcdSnapshotCompression = cfg.EtcdSnapshotCompression
+		schedules, err := parseSnapshotSchedules(cfg)
+		if err != nil {
+			return err
+		}
+		serverConfig.ControlConfig.EtcdSnapshotSchedules = schedules
+		serverConfig.ControlConfig.EtcdSnapshotCoordinated = cfg.EtcdSnapshotCoordinated
 		serverConfig.ControlConfig.EtcdSnapshotDir = cfg.EtcdSnapshotDir
-		serverConfig.ControlConfig.EtcdSnapshotRetention = cfg.EtcdSnapshotRetention
+		serverConfig.ControlConfig.EtcdSnapshotRetention = cmds.SnapshotRetentionCount(app, cfg)
+		serverConfig.ControlConfig.EtcdSnapshotMaxAge = cfg.EtcdSnapshotMaxAge
+		serverConfig.ControlConfig.EtcdSnapshotKeepHourly = cfg.EtcdSnapshotKeepHourly
+		serverConfig.ControlConfig.EtcdSnapshotKeepDaily = cfg.EtcdSnapshotKeepDaily
+		serverConfig.ControlConfig.EtcdSnapshotKeepWeekly = cfg.EtcdSnapshotKeepWeekly
+		serverConfig.ControlConfig.EtcdSnapshotMirrorDir = cfg.EtcdSnapshotMirrorDir
+		serverConfig.ControlConfig.EtcdSnapshotPreHooks = cfg.EtcdSnapshotPreHooks
+		serverConfig.ControlConfig.EtcdSnapshotPostHooks = cfg.EtcdSnapshotPostHooks
+		serverConfig.ControlConfig.EtcdSnapshotHookTimeout = cfg.EtcdSnapshotHookTimeout
 		serverConfig.ControlConfig.EtcdS3 = cfg.EtcdS3
 		serverConfig.ControlConfig.EtcdS3Endpoint = cfg.EtcdS3Endpoint
 		serverConfig.ControlConfig.EtcdS3EndpointCA = cfg.EtcdS3EndpointCA
 		serverConfig.ControlConfig.EtcdS3SkipSSLVerify = cfg.EtcdS3SkipSSLVerify
 		serverConfig.ControlConfig.EtcdS3AccessKey = cfg.EtcdS3AccessKey
 		serverConfig.ControlConfig.EtcdS3SecretKey = cfg.EtcdS3SecretKey
+		serverConfig.ControlConfig.EtcdS3SessionToken = cfg.EtcdS3SessionToken
+		serverConfig.ControlConfig.EtcdS3CredentialsFile = cfg.EtcdS3CredentialsFile
+		serverConfig.ControlConfig.EtcdS3ConfigFile = cfg.EtcdS3ConfigFile
+		serverConfig.ControlConfig.EtcdS3Profile = cfg.EtcdS3Profile
+		serverConfig.ControlConfig.EtcdS3RoleARN = cfg.EtcdS3RoleARN
+		serverConfig.ControlConfig.EtcdS3WebIdentityFile = cfg.EtcdS3WebIdentityFile
+		serverConfig.ControlConfig.EtcdS3STSEndpoint = cfg.EtcdS3STSEndpoint
 		serverConfig.ControlConfig.EtcdS3BucketName = cfg.EtcdS3BucketName
 		serverConfig.ControlConfig.EtcdS3Region = cfg.EtcdS3Region
 		serverConfig.ControlConfig.EtcdS3Folder = cfg.EtcdS3Folder
 		serverConfig.ControlConfig.EtcdS3Insecure = cfg.EtcdS3Insecure
+		serverConfig.ControlConfig.EtcdS3Proxy = cfg.EtcdS3Proxy
+		serverConfig.ControlConfig.EtcdS3MaxConns = cfg.EtcdS3MaxConns
+		serverConfig.ControlConfig.EtcdS3MaxIdleConns = cfg.EtcdS3MaxIdleConns
+		serverConfig.ControlConfig.EtcdS3TLSMinVersion = cfg.EtcdS3TLSMinVersion
 		serverConfig.ControlConfig.EtcdS3Timeout = cfg.EtcdS3Timeout
+		if cfg.EtcdS3Stream && cfg.EtcdSnapshotMirrorDir != "" {
+			return errors.New("invalid flag use; --etcd-s3-stream cannot be used with --etcd-snapshot-mirror-dir, as streamed snapshots are not saved locally")
+		}
+		serverConfig.ControlConfig.EtcdS3Stream = cfg.EtcdS3Stream
+		serverConfig.ControlConfig.EtcdS3PartSize = cfg.EtcdS3PartSize
+		serverConfig.ControlConfig.EtcdS3Concurrency = cfg.EtcdS3Concurrency
+		serverConfig.ControlConfig.EtcdS3PartTimeout = cfg.EtcdS3PartTimeout
+		serverConfig.ControlConfig.EtcdS3PartRetries = cfg.EtcdS3PartRetries
+		serverConfig.ControlConfig.EtcdS3SSE = cfg.EtcdS3SSE
+		serverConfig.ControlConfig.EtcdS3SSEKMSKeyID = cfg.EtcdS3SSEKMSKeyID
+		serverConfig.ControlConfig.EtcdS3SSECKeyFile = cfg.EtcdS3SSECKeyFile
+		serverConfig.ControlConfig.EtcdS3StorageClass = cfg.EtcdS3StorageClass
+		serverConfig.ControlConfig.EtcdS3Tags = cfg.EtcdS3Tags
+		serverConfig.ControlConfig.EtcdS3Metadata = cfg.EtcdS3Metadata
 	} else {
 		logrus.Info("ETCD snapshots are disabled")
 	}
@@ -160,6 +237,7 @@ func run(app *cli.Context, cfg *cmds.Server, leaderControllers server.CustomCont
 
 	serverConfig.ControlConfig.ClusterReset = cfg.ClusterReset
 	serverConfig.ControlConfig.ClusterResetRestorePath = cfg.ClusterResetRestorePath
+	serverConfig.ControlConfig.EtcdSnapshotKeyFile = cfg.EtcdSnapshotKeyFile
 	serverConfig.ControlConfig.SystemDefaultRegistry = cfg.SystemDefaultRegistry
 
 	if serverConfig.ControlConfig.SupervisorPort == 0 {
@@ -182,18 +260,19 @@ func run(app *cli.Context, cfg *cmds.Server, leaderControllers server.CustomCont
 	}
 
 	if serverConfig.ControlConfig.PrivateIP == "" && len(cmds.AgentConfig.NodeIP) != 0 {
-		// ignoring the error here is fine since etcd will fall back to the interface's IPv4 address
-		serverConfig.ControlConfig.PrivateIP, _ = util.GetFirst4String(cmds.AgentConfig.NodeIP)
+		// ignoring the error here is fine since etcd will fall back to the interface's address;
+		// the family of the first node-ip determines the address family used by etcd
+		serverConfig.ControlConfig.PrivateIP, _, _ = util.GetFirstString(cmds.AgentConfig.NodeIP)
 	}
 
 	// if not set, try setting advertise-ip from agent node-external-ip
 	if serverConfig.ControlConfig.AdvertiseIP == "" && len(cmds.AgentConfig.NodeExternalIP) != 0 {
-		serverConfig.ControlConfig.AdvertiseIP, _ = util.GetFirst4String(cmds.AgentConfig.NodeExternalIP)
+		serverConfig.ControlConfig.AdvertiseIP, _, _ = util.GetFirstString(cmds.AgentConfig.NodeExternalIP)
 	}
 
 	// if not set, try setting advertise-ip from agent node-ip
 	if serverConfig.ControlConfig.AdvertiseIP == "" && len(cmds.AgentConfig.NodeIP) != 0 {
-		serverConfig.ControlConfig.AdvertiseIP, _ = util.GetFirst4String(cmds.AgentConfig.NodeIP)
+		serverConfig.ControlConfig.AdvertiseIP, _, _ = util.GetFirstString(cmds.AgentConfig.NodeIP)
 	}
 
 	// if we ended up with any advertise-ips, ensure they're added to the SAN list;
@@ -208,7 +287,7 @@ func run(app *cli.Context, cfg *cmds.Server, leaderControllers server.CustomCont
 		return err
 	}
 	serverConfig.ControlConfig.ServerNodeName = nodeName
-	serverConfig.ControlConfig.SANs = append(serverConfig.ControlConfig.SANs, "127.0.0.1", "localhost", nodeName)
+	serverConfig.ControlConfig.SANs = append(serverConfig.ControlConfig.SANs, "127.0.0.1", "::1", "localhost", nodeName)
 	for _, ip := range nodeIPs {
 		serverConfig.ControlConfig.SANs = append(serverConfig.ControlConfig.SANs, ip.String())
 	}
@@ -414,6 +493,8 @@ func run(app *cli.Context, cfg *cmds.Server, leaderControllers server.CustomCont
 	}
 
 	fmt.Println("need start agent")
+
+	<-ctx.Done()
 	return nil
 }
 
@@ -445,6 +526,89 @@ func validateNetworkConfiguration(serverConfig server.Config) error {
 	return nil
 }
 
+// validateEtcdPorts checks that the etcd client, peer and metrics ports are valid port numbers, and that
+// no two of them are the same. A port of 0 selects the default for that listener.
+func validateEtcdPorts(cfg *cmds.Server) error {
+	ports := []struct {
+		flag        string
+		port        int
+		defaultPort int
+	}{
+		{"etcd-client-port", cfg.EtcdClientPort, etcd.DefaultClientPort},
+		{"etcd-peer-port", cfg.EtcdPeerPort, etcd.DefaultPeerPort},
+		{"etcd-metrics-port", cfg.EtcdMetricsPort, etcd.DefaultMetricsPort},
+	}
+	used := map[int]string{}
+	for _, p := range ports {
+		if p.port < 0 || p.port > 65535 {
+			return fmt.Errorf("invalid %s %d: must be between 0 (default) and 65535", p.flag, p.port)
+		}
+		port := p.port
+		if port == 0 {
+			port = p.defaultPort
+		}
+		if flag, ok := used[port]; ok {
+			return fmt.Errorf("invalid %s %d: already used by %s", p.flag, port, flag)
+		}
+		used[port] = p.flag
+	}
+	return nil
+}
+
+// parseSnapshotSchedules parses the additional etcd snapshot schedules, each given as a JSON object.
+// Each schedule must have a valid cron spec and a name prefix that does not overlap with the other
+// schedules, as retention is applied to all snapshots that share a name prefix. Schedules may only
+// copy snapshots to S3 or the mirror directory if these are configured.
+func parseSnapshotSchedules(cfg *cmds.Server) ([]config.EtcdSnapshotSchedule, error) {
+	var schedules []config.EtcdSnapshotSchedule
+	names := map[string]bool{cfg.EtcdSnapshotName: true}
+	for _, value := range cfg.EtcdSnapshotSchedules {
+		var schedule config.EtcdSnapshotSchedule
+		decoder := json.NewDecoder(strings.NewReader(value))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&schedule); err != nil {
+			return nil, errors.Wrapf(err, "invalid etcd-snapshot-schedule %s", value)
+		}
+		if schedule.Name == "" || schedule.Cron == "" {
+			return nil, fmt.Errorf("invalid etcd-snapshot-schedule %s: name and cron must be set", value)
+		}
+		for name := range names {
+			if name == schedule.Name || strings.HasPrefix(name, schedule.Name+"-") || strings.HasPrefix(schedule.Name, name+"-") {
+				return nil, fmt.Errorf("invalid etcd-snapshot-schedule %s: name %s overlaps with snapshot name %s", value, schedule.Name, name)
+			}
+		}
+		if _, err := cron.ParseStandard(schedule.Cron); err != nil {
+			return nil, errors.Wrapf(err, "invalid etcd-snapshot-schedule %s: invalid cron spec", value)
+		}
+		if schedule.Retention < 0 || schedule.KeepHourly < 0 || schedule.KeepDaily < 0 || schedule.KeepWeekly < 0 {
+			return nil, fmt.Errorf("invalid etcd-snapshot-schedule %s: retention and keep counts must not be negative", value)
+		}
+		if schedule.MaxAge != "" {
+			maxAge, err := time.ParseDuration(schedule.MaxAge)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid etcd-snapshot-schedule %s: invalid maxAge", value)
+			}
+			if maxAge < 0 {
+				return nil, fmt.Errorf("invalid etcd-snapshot-schedule %s: maxAge must not be negative", value)
+			}
+		}
+		if schedule.S3 && !cfg.EtcdS3 {
+			return nil, fmt.Errorf("invalid etcd-snapshot-schedule %s: s3 requires etcd-s3 to be enabled", value)
+		}
+		if schedule.Mirror && cfg.EtcdSnapshotMirrorDir == "" {
+			return nil, fmt.Errorf("invalid etcd-snapshot-schedule %s: mirror requires etcd-snapshot-mirror-dir to be set", value)
+		}
+		if schedule.Compression != "" {
+			if err := etcd.ValidateSnapshotCompression(schedule.Compression); err != nil {
+				return nil, errors.Wrapf(err, "invalid etcd-snapshot-schedule %s", value)
+			}
+		}
+		names[schedule.Name] = true
+		schedules = append(schedules, schedule)
+	}
+	return schedules, nil
+}
+
 func getArgValueFromList(searchArg string, argList []string) string {
 	var value string
 	for _, arg := range argList {
@@ -8,11 +8,11 @@ import (
 )
 
 var DefaultParser = &Parser{
-	After:         []string{"server", "agent", "etcd-snapshot:1"},
+	After:         []string{"server", "agent", "etcd-snapshot:1", "etcd-member:1"},
 	FlagNames:     []string{"--config", "-c"},
 	EnvName:       version.ProgramUpper + "_CONFIG_FILE",
 	DefaultConfig: "/etcd/rancher/" + version.Program + "/config.yaml",
-	ValidFlags:    map[string][]cli.Flag{"server": cmds.ServerFlags, "etcd-snapshot": cmds.EtcdSnapshotFlags},
+	ValidFlags:    map[string][]cli.Flag{"server": cmds.ServerFlags, "etcd-snapshot": cmds.EtcdSnapshotFlags, "etcd-member": cmds.EtcdMemberFlags},
 }
 
 func MustParse(args []string) []string {
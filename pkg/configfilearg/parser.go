@@ -1,6 +1,7 @@
 package configfilearg
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -256,10 +257,10 @@ func readConfigFile(file string) (result []string, _ error) {
 
 		if slice, ok := v.([]interface{}); ok {
 			for _, v := range slice {
-				result = append(result, prefix+k+"="+convert.ToString(v))
+				result = append(result, prefix+k+"="+toFlagValue(v))
 			}
 		} else {
-			str := convert.ToString(v)
+			str := toFlagValue(v)
 			result = append(result, prefix+k+"="+str)
 		}
 	}
@@ -273,6 +274,8 @@ func toSlice(v interface{}) []interface{} {
 		return []interface{}{k}
 	case []interface{}:
 		return k
+	case yaml.MapSlice, map[interface{}]interface{}:
+		return []interface{}{k}
 	default:
 		str := strings.TrimSpace(convert.ToString(v))
 		if str == "" {
@@ -282,6 +285,44 @@ func toSlice(v interface{}) []interface{} {
 	}
 }
 
+// toFlagValue returns the flag value for a config file value. Maps, which cannot otherwise be
+// expressed as flag values, are passed as JSON objects.
+func toFlagValue(v interface{}) string {
+	switch v.(type) {
+	case yaml.MapSlice, map[interface{}]interface{}:
+		if b, err := json.Marshal(toJSONValue(v)); err == nil {
+			return string(b)
+		}
+	}
+	return convert.ToString(v)
+}
+
+// toJSONValue converts the maps decoded from YAML, which may have non-string keys, into maps that
+// can be encoded as JSON.
+func toJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		m := make(map[string]interface{}, len(v))
+		for _, item := range v {
+			m[convert.ToString(item.Key)] = toJSONValue(item.Value)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[convert.ToString(key)] = toJSONValue(value)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			s[i] = toJSONValue(value)
+		}
+		return s
+	}
+	return v
+}
+
 func readConfigFileData(file string) ([]byte, error) {
 	u, err := url.Parse(file)
 	if err != nil {
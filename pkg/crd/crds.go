@@ -0,0 +1,33 @@
+package crd
+
+import (
+	"context"
+
+	"github.com/rancher/wrangler/pkg/crd"
+	v1 "github.com/wangxiaochuang/k3s/pkg/apis/k3s.cattle.io/v1"
+	"k8s.io/client-go/rest"
+)
+
+// List returns the custom resource definitions for the k3s.cattle.io API group.
+func List() []crd.CRD {
+	etcdSnapshotFile := v1.ETCDSnapshotFile{}
+	return []crd.CRD{
+		crd.NonNamespacedType(v1.ETCDSnapshotFileKind+"."+v1.GroupName+"/v1").
+			WithSchemaFromStruct(etcdSnapshotFile).
+			WithColumn("SnapshotName", ".spec.snapshotName").
+			WithColumn("Node", ".spec.nodeName").
+			WithColumn("Location", ".spec.location").
+			WithColumn("Size", ".status.size").
+			WithColumn("CreationTime", ".status.creationTime"),
+	}
+}
+
+// Create creates or updates the custom resource definitions returned by List,
+// and waits for them to be established.
+func Create(ctx context.Context, config *rest.Config) error {
+	factory, err := crd.NewFactoryFromClient(config)
+	if err != nil {
+		return err
+	}
+	return factory.BatchCreateCRDs(ctx, List()...).BatchWait()
+}
@@ -122,6 +122,23 @@ type CriticalControlArgs struct {
 	ServiceIPRanges       []*net.IPNet
 }
 
+// EtcdSnapshotSchedule is an additional snapshot schedule, with its own name prefix, destinations
+// and retention. Snapshots are always saved locally, and are also copied to S3 or the mirror
+// directory if requested. MaxAge is a duration string, as accepted by time.ParseDuration.
+type EtcdSnapshotSchedule struct {
+	Name        string `json:"name"`
+	Cron        string `json:"cron"`
+	Retention   int    `json:"retention,omitempty"`
+	MaxAge      string `json:"maxAge,omitempty"`
+	KeepHourly  int    `json:"keepHourly,omitempty"`
+	KeepDaily   int    `json:"keepDaily,omitempty"`
+	KeepWeekly  int    `json:"keepWeekly,omitempty"`
+	Compress    bool   `json:"compress,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	S3          bool   `json:"s3,omitempty"`
+	Mirror      bool   `json:"mirror,omitempty"`
+}
+
 type Control struct {
 	CriticalControlArgs
 	AdvertisePort int
@@ -168,21 +185,67 @@ type Control struct {
 	EtcdSnapshotName         string
 	EtcdDisableSnapshots     bool
 	EtcdExposeMetrics        bool
+	EtcdSnapshotMetrics      bool
+	EtcdClientPort           int
+	EtcdPeerPort             int
+	EtcdMetricsPort          int
+	EtcdBindAddress          string
+	EtcdDefragCron           string
+	EtcdDefragThreshold      float64
+	EtcdDefragMinSize        int
+	EtcdNospaceRecovery      bool
+	EtcdLearnerInterval      time.Duration
+	EtcdLearnerMaxStall      time.Duration
+	EtcdLearnerNoEvict       bool
 	EtcdSnapshotDir          string
 	EtcdSnapshotCron         string
 	EtcdSnapshotRetention    int
+	EtcdSnapshotMaxAge       time.Duration
+	EtcdSnapshotKeepHourly   int
+	EtcdSnapshotKeepDaily    int
+	EtcdSnapshotKeepWeekly   int
 	EtcdSnapshotCompress     bool
+	EtcdSnapshotCompression  string
+	EtcdSnapshotMirrorDir    string
+	EtcdSnapshotKeyFile      string
+	EtcdSnapshotPreHooks     []string
+	EtcdSnapshotPostHooks    []string
+	EtcdSnapshotHookTimeout  time.Duration
+	EtcdSnapshotSchedules    []EtcdSnapshotSchedule
+	EtcdSnapshotCoordinated  bool
 	EtcdS3                   bool
 	EtcdS3Endpoint           string
 	EtcdS3EndpointCA         string
 	EtcdS3SkipSSLVerify      bool
 	EtcdS3AccessKey          string
 	EtcdS3SecretKey          string
+	EtcdS3SessionToken       string
+	EtcdS3CredentialsFile    string
+	EtcdS3ConfigFile         string
+	EtcdS3Profile            string
+	EtcdS3RoleARN            string
+	EtcdS3WebIdentityFile    string
+	EtcdS3STSEndpoint        string
 	EtcdS3BucketName         string
 	EtcdS3Region             string
 	EtcdS3Folder             string
 	EtcdS3Timeout            time.Duration
+	EtcdS3Stream             bool
+	EtcdS3PartSize           int
+	EtcdS3Concurrency        int
+	EtcdS3PartTimeout        time.Duration
+	EtcdS3PartRetries        int
+	EtcdS3SSE                string
+	EtcdS3SSEKMSKeyID        string
+	EtcdS3SSECKeyFile        string
+	EtcdS3StorageClass       string
+	EtcdS3Tags               []string
+	EtcdS3Metadata           []string
 	EtcdS3Insecure           bool
+	EtcdS3Proxy              string
+	EtcdS3MaxConns           int
+	EtcdS3MaxIdleConns       int
+	EtcdS3TLSMinVersion      string
 	ServerNodeName           string
 
 	BindAddress string
@@ -216,6 +279,7 @@ type ControlRuntime struct {
 	APIServerReady                      <-chan struct{}
 	AgentReady                          <-chan struct{}
 	ETCDReady                           <-chan struct{}
+	CoreReady                           <-chan struct{}
 	ClusterControllerStart              func(ctx context.Context) error
 	LeaderElectedClusterControllerStart func(ctx context.Context) error
 
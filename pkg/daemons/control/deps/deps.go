@@ -399,8 +399,14 @@ func genETCDCerts(config *config.Control, runtime *config.ControlRuntime) error
 		return err
 	}
 
+	// etcd may advertise an IPv6 private IP that is not otherwise in the SAN list,
+	// and may be reached over the IPv6 loopback address.
+	sans := append([]string{"::1"}, config.SANs...)
+	if config.PrivateIP != "" {
+		sans = append(sans, config.PrivateIP)
+	}
 	altNames := &certutil.AltNames{}
-	addSANs(altNames, config.SANs)
+	addSANs(altNames, sans)
 
 	if _, err := createClientCertKey(regen, "etcd-server", nil,
 		altNames, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
@@ -0,0 +1,353 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	alarmPollInterval = time.Second * 30
+
+	// defaultQuotaBackendBytes is the etcd backend quota used when quota-backend-bytes is not set.
+	defaultQuotaBackendBytes = 2 * 1024 * 1024 * 1024
+	// nospaceRecoveryMaxUsage is the fraction of the backend quota that every member's database must be
+	// below after compaction and defragmentation, before a NOSPACE alarm is disarmed.
+	nospaceRecoveryMaxUsage = 0.8
+
+	// EtcdAlarmCondition is the node condition set while the etcd member on the node has an active alarm.
+	EtcdAlarmCondition v1.NodeConditionType = "EtcdAlarm"
+)
+
+// alarmStatus records an active alarm raised by an etcd cluster member.
+type alarmStatus struct {
+	MemberID   uint64      `json:"memberID"`
+	MemberName string      `json:"memberName,omitempty"`
+	Alarm      string      `json:"alarm"`
+	Since      metav1.Time `json:"since"`
+}
+
+func (a alarmStatus) key() string {
+	return FormatMemberID(a.MemberID) + "/" + a.Alarm
+}
+
+// manageAlarms polls the etcd cluster for active alarms. Raised and cleared alarms are logged, alarms
+// raised by the local member are reported by the node condition and events of this node, and NOSPACE
+// alarms are recovered from if enabled.
+func (e *ETCD) manageAlarms(ctx context.Context) {
+	t := time.NewTicker(alarmPollInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if e.client == nil {
+			continue
+		}
+		alarms, err := e.pollAlarms(ctx)
+		if err != nil {
+			logrus.Errorf("Failed to check etcd alarms: %v", err)
+			continue
+		}
+		if err := e.syncAlarmNodeCondition(ctx); err != nil {
+			logrus.Errorf("Failed to update etcd alarm node condition: %v", err)
+		}
+		if e.config.EtcdNospaceRecovery {
+			for _, alarm := range alarms {
+				if alarm.Alarm == etcdserverpb.AlarmType_NOSPACE.String() {
+					if err := e.recoverNoSpace(ctx, alarms); err != nil {
+						logrus.Errorf("Failed to recover from etcd NOSPACE alarm: %v", err)
+					}
+					break
+				}
+			}
+		}
+	}
+}
+
+// pollAlarms retrieves the active alarms, logs the alarms that were raised or cleared since the last poll,
+// and stores the active alarms to be returned by the alarm API and reported by the node condition.
+func (e *ETCD) pollAlarms(ctx context.Context) ([]alarmStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, testTimeout)
+	defer cancel()
+
+	resp, err := e.client.AlarmList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[uint64]string{}
+	if len(resp.Alarms) > 0 {
+		if members, err := e.client.MemberList(ctx); err == nil {
+			for _, member := range members.Members {
+				names[member.ID] = member.Name
+			}
+		}
+	}
+
+	e.alarmsLock.Lock()
+	defer e.alarmsLock.Unlock()
+
+	local := e.localMemberID
+	previous := map[string]alarmStatus{}
+	for _, alarm := range e.alarms {
+		previous[alarm.key()] = alarm
+	}
+
+	var alarms []alarmStatus
+	for _, a := range resp.Alarms {
+		alarm := alarmStatus{
+			MemberID:   a.MemberID,
+			MemberName: names[a.MemberID],
+			Alarm:      a.Alarm.String(),
+			Since:      metav1.Now(),
+		}
+		if p, ok := previous[alarm.key()]; ok {
+			alarm.Since = p.Since
+			delete(previous, alarm.key())
+		} else {
+			logrus.Errorf("etcd member %s (%s) raised alarm %s", alarm.MemberName, FormatMemberID(alarm.MemberID), alarm.Alarm)
+			if a.MemberID == local {
+				e.alarmConditionSynced = false
+			}
+		}
+		alarms = append(alarms, alarm)
+	}
+	for _, alarm := range previous {
+		logrus.Infof("etcd member %s (%s) cleared alarm %s", alarm.MemberName, FormatMemberID(alarm.MemberID), alarm.Alarm)
+		if alarm.MemberID == local {
+			e.alarmConditionSynced = false
+		}
+	}
+
+	sort.Slice(alarms, func(i, j int) bool {
+		return alarms[i].key() < alarms[j].key()
+	})
+	e.alarms = alarms
+	return alarms, nil
+}
+
+// activeAlarms returns the alarms found by the most recent poll.
+func (e *ETCD) activeAlarms() []alarmStatus {
+	e.alarmsLock.Lock()
+	defer e.alarmsLock.Unlock()
+	return append([]alarmStatus{}, e.alarms...)
+}
+
+// syncAlarmNodeCondition sets the alarm condition of this node to reflect the alarms raised by the local
+// member, and records an event when alarms are raised or cleared. The node is only updated when the local
+// member's alarms change, or if the previous update failed.
+func (e *ETCD) syncAlarmNodeCondition(ctx context.Context) error {
+	if !e.coreReady() {
+		return nil
+	}
+
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return nil
+	}
+
+	e.alarmsLock.Lock()
+	local := e.localMemberID
+	e.alarmsLock.Unlock()
+	if local == 0 {
+		statusCtx, cancel := context.WithTimeout(ctx, testTimeout)
+		defer cancel()
+		status, err := e.client.Status(statusCtx, localEndpoint(e.config))
+		if err != nil {
+			return err
+		}
+		local = status.Header.MemberId
+	}
+
+	e.alarmsLock.Lock()
+	e.localMemberID = local
+	synced := e.alarmConditionSynced
+	var raised []string
+	for _, alarm := range e.alarms {
+		if alarm.MemberID == local {
+			raised = append(raised, alarm.Alarm)
+		}
+	}
+	e.alarmsLock.Unlock()
+	if synced {
+		return nil
+	}
+
+	condition := v1.NodeCondition{
+		Type:               EtcdAlarmCondition,
+		Status:             v1.ConditionFalse,
+		Reason:             "NoAlarm",
+		Message:            "etcd member has no active alarms",
+		LastHeartbeatTime:  metav1.Now(),
+		LastTransitionTime: metav1.Now(),
+	}
+	eventType, reason := v1.EventTypeNormal, "EtcdAlarmCleared"
+	if len(raised) > 0 {
+		condition.Status = v1.ConditionTrue
+		condition.Reason = strings.Join(raised, ",")
+		condition.Message = fmt.Sprintf("etcd member has active alarms: %s", strings.Join(raised, ", "))
+		eventType, reason = v1.EventTypeWarning, "EtcdAlarm"
+	}
+
+	nodes := e.config.Runtime.Core.Core().V1().Node()
+	node, err := nodes.Get(nodeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	var existing *v1.NodeCondition
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == EtcdAlarmCondition {
+			existing = &node.Status.Conditions[i]
+		}
+	}
+	if existing != nil && existing.Status == condition.Status && existing.Reason == condition.Reason {
+		e.setAlarmConditionSynced()
+		return nil
+	}
+	if existing == nil && len(raised) == 0 {
+		// do not record that alarms were cleared on nodes that have never had one
+		e.setAlarmConditionSynced()
+		return nil
+	}
+
+	node = node.DeepCopy()
+	if existing != nil {
+		for i := range node.Status.Conditions {
+			if node.Status.Conditions[i].Type == EtcdAlarmCondition {
+				node.Status.Conditions[i] = condition
+			}
+		}
+	} else {
+		node.Status.Conditions = append(node.Status.Conditions, condition)
+	}
+	if _, err := nodes.UpdateStatus(node); err != nil {
+		return err
+	}
+
+	if err := e.recordNodeEvent(nodeName, eventType, reason, condition.Message); err != nil {
+		logrus.Warnf("Failed to record etcd alarm event: %v", err)
+	}
+
+	e.setAlarmConditionSynced()
+	return nil
+}
+
+func (e *ETCD) setAlarmConditionSynced() {
+	e.alarmsLock.Lock()
+	defer e.alarmsLock.Unlock()
+	e.alarmConditionSynced = true
+}
+
+// quotaBackendBytes returns the backend quota configured through the etcd arguments, or the etcd default.
+func (e *ETCD) quotaBackendBytes() int64 {
+	for _, arg := range e.config.ExtraEtcdArgs {
+		kv := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)
+		if len(kv) == 2 && kv[0] == "quota-backend-bytes" {
+			if quota, err := strconv.ParseInt(kv[1], 10, 64); err == nil && quota > 0 {
+				return quota
+			}
+		}
+	}
+	return defaultQuotaBackendBytes
+}
+
+// recoverNoSpace recovers from NOSPACE alarms by compacting the keyspace to the current revision and
+// defragmenting every member, one at a time. The NOSPACE alarms are only disarmed once the database of every
+// member is well below the backend quota, so that the cluster does not immediately run out of space again.
+// Only the leader runs recovery, and recovery is skipped while scheduled defragmentation is running.
+func (e *ETCD) recoverNoSpace(ctx context.Context, alarms []alarmStatus) error {
+	if !atomic.CompareAndSwapInt32(&e.defragRunning, 0, 1) {
+		logrus.Info("Deferring etcd NOSPACE recovery, defragmentation is already running")
+		return nil
+	}
+	defer atomic.StoreInt32(&e.defragRunning, 0)
+
+	listCtx, cancel := context.WithTimeout(ctx, testTimeout)
+	defer cancel()
+
+	status, err := e.client.Status(listCtx, localEndpoint(e.config))
+	if err != nil {
+		return err
+	}
+	if status.Header.MemberId != status.Leader {
+		return nil
+	}
+	leader := status.Leader
+
+	logrus.Warnf("Recovering from etcd NOSPACE alarm: compacting to revision %d", status.Header.Revision)
+	if _, err := e.client.Compact(listCtx, status.Header.Revision, clientv3.WithCompactPhysical()); err != nil && !strings.Contains(err.Error(), "required revision has been compacted") {
+		return errors.Wrap(err, "failed to compact etcd")
+	}
+
+	members, err := e.client.MemberList(listCtx)
+	if err != nil {
+		return err
+	}
+	// etcd rejects writes while the NOSPACE alarm is raised, so the defragmentation status can only be
+	// recorded once the alarms have been disarmed.
+	result, err := e.defragmentMembers(ctx, leader, members.Members, true)
+	if err != nil {
+		return err
+	}
+
+	maxSize := int64(float64(e.quotaBackendBytes()) * nospaceRecoveryMaxUsage)
+	for _, member := range members.Members {
+		_, status, err := e.memberEndpointStatus(ctx, member)
+		if err != nil {
+			return errors.Wrapf(err, "failed to check size of etcd member %s", member.Name)
+		}
+		if status.DbSize > maxSize {
+			return errors.Errorf("etcd member %s database size %d is still above %d after compaction and defragmentation; "+
+				"remove data or increase quota-backend-bytes, and disarm the alarm manually", member.Name, status.DbSize, maxSize)
+		}
+	}
+
+	disarmCtx, cancel := context.WithTimeout(ctx, testTimeout)
+	defer cancel()
+	for _, alarm := range alarms {
+		if alarm.Alarm != etcdserverpb.AlarmType_NOSPACE.String() {
+			continue
+		}
+		if _, err := e.client.AlarmDisarm(disarmCtx, &clientv3.AlarmMember{MemberID: alarm.MemberID, Alarm: etcdserverpb.AlarmType_NOSPACE}); err != nil {
+			return errors.Wrapf(err, "failed to disarm NOSPACE alarm for etcd member %s", alarm.MemberName)
+		}
+		logrus.Infof("Disarmed NOSPACE alarm for etcd member %s (%s)", alarm.MemberName, FormatMemberID(alarm.MemberID))
+	}
+
+	if err := e.setDefragStatus(ctx, result); err != nil {
+		logrus.Warnf("Failed to record etcd defragmentation status after NOSPACE recovery: %v", err)
+	}
+	return nil
+}
+
+// alarmHandlers registers the alarm API on the supervisor router. The active alarms are returned as a JSON
+// list, to clients authenticated as for the snapshot API.
+func (e *ETCD) alarmHandlers(router *mux.Router) {
+	router.Path("/db/alarms").Methods(http.MethodGet).Handler(e.snapshotAuthMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(e.activeAlarms()); err != nil {
+			logrus.Errorf("Failed to write etcd alarm response: %v", err)
+		}
+	})))
+}
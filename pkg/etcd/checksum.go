@@ -0,0 +1,200 @@
+package etcd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/etcdutl/v3/snapshot"
+)
+
+const (
+	// checksumExtension is the suffix of the sidecar file holding the SHA-256 digest of a snapshot.
+	checksumExtension = ".sha256"
+	// checksumMetadataKey is the S3 user metadata key holding the SHA-256 digest of a snapshot.
+	checksumMetadataKey = "Snapshot-Sha256"
+)
+
+// snapshotChecksum returns the hex-encoded SHA-256 digest of the given file.
+func snapshotChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeChecksumFile writes the sidecar checksum file for the given snapshot.
+// The file uses the same format as sha256sum, so that it can also be checked by hand.
+func writeChecksumFile(snapshotPath, checksum string) error {
+	data := fmt.Sprintf("%s  %s\n", checksum, filepath.Base(snapshotPath))
+	return ioutil.WriteFile(snapshotPath+checksumExtension, []byte(data), 0600)
+}
+
+// readChecksumFile returns the digest recorded in the sidecar checksum file for the given snapshot.
+func readChecksumFile(snapshotPath string) (string, error) {
+	data, err := ioutil.ReadFile(snapshotPath + checksumExtension)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("checksum file for %s is empty", snapshotPath)
+	}
+	return fields[0], nil
+}
+
+// isChecksumFile returns true if the given file name is a sidecar checksum file.
+func isChecksumFile(name string) bool {
+	return strings.HasSuffix(name, checksumExtension)
+}
+
+// verifySnapshotChecksum compares the digest of the given snapshot against its sidecar checksum file.
+// Snapshots taken before checksums were recorded have no sidecar file; these are accepted with a warning.
+func verifySnapshotChecksum(snapshotPath string) (string, error) {
+	expected, err := readChecksumFile(snapshotPath)
+	if os.IsNotExist(err) {
+		logrus.Warnf("No checksum recorded for etcd snapshot %s, skipping integrity check", snapshotPath)
+		return snapshotChecksum(snapshotPath)
+	} else if err != nil {
+		return "", err
+	}
+	return compareSnapshotChecksum(snapshotPath, expected)
+}
+
+// compareSnapshotChecksum compares the digest of the given snapshot against the expected digest.
+func compareSnapshotChecksum(snapshotPath, expected string) (string, error) {
+	actual, err := snapshotChecksum(snapshotPath)
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(actual, expected) {
+		return actual, fmt.Errorf("checksum mismatch for etcd snapshot %s: expected sha256 %s, got %s", snapshotPath, expected, actual)
+	}
+	return actual, nil
+}
+
+// SnapshotVerification records the result of verifying a single snapshot.
+type SnapshotVerification struct {
+	Name     string
+	Store    string
+	Size     int64
+	Checksum string
+	Revision int64
+	TotalKey int
+	Err      error
+}
+
+// VerifySnapshots checks the integrity of the named snapshots, or of all snapshots if no names are given,
+// held in the local snapshot directory and in every enabled remote store. Each snapshot is retrieved and
+// checked against its recorded checksum, decompressed if necessary, and then opened to confirm that it
+// is a valid etcd snapshot.
+func (e *ETCD) VerifySnapshots(ctx context.Context, names []string) ([]SnapshotVerification, error) {
+	stores, storeErrs := e.snapshotStores(ctx)
+	for name, err := range storeErrs {
+		return nil, errors.Wrapf(err, "failed to initialize %s snapshot store", name)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "etcd-snapshot-verify-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[filepath.Base(name)] = true
+	}
+
+	var results []SnapshotVerification
+	for _, store := range stores {
+		snapshots, err := store.List(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list %s snapshots", store.Name())
+		}
+		for _, sf := range snapshots {
+			if len(wanted) > 0 && !wanted[sf.Name] {
+				continue
+			}
+			results = append(results, e.verifySnapshot(ctx, store, sf, tmpDir))
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Store != results[j].Store {
+			return results[i].Store < results[j].Store
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+// verifySnapshot retrieves a single snapshot from the given store into a scratch directory and verifies it.
+func (e *ETCD) verifySnapshot(ctx context.Context, store SnapshotStore, sf snapshotFile, tmpDir string) SnapshotVerification {
+	result := SnapshotVerification{
+		Name:  sf.Name,
+		Store: store.Name(),
+		Size:  sf.Size,
+	}
+
+	workDir, err := ioutil.TempDir(tmpDir, "")
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer os.RemoveAll(workDir)
+
+	// Snapshots in the local snapshot directory are checked in place rather than copied.
+	downloadDir := workDir
+	if _, ok := store.(*localStore); ok {
+		if downloadDir, err = snapshotDir(e.config, false); err != nil {
+			result.Err = err
+			return result
+		}
+	}
+
+	snapshotPath, err := store.Download(ctx, sf.Name, downloadDir)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	// Download has already checked the snapshot against its recorded checksum, and left the digest
+	// in the sidecar file, so the snapshot does not need to be hashed again here. Snapshots taken
+	// before checksums were recorded have no digest.
+	if checksum, err := readChecksumFile(snapshotPath); err == nil {
+		result.Checksum = checksum
+	} else if !os.IsNotExist(err) {
+		result.Err = err
+		return result
+	}
+
+	if snapshotPath, err = e.prepareSnapshot(workDir, snapshotPath); err != nil {
+		result.Err = err
+		return result
+	}
+
+	status, err := snapshot.NewV3(nil).Status(snapshotPath)
+	if err != nil {
+		result.Err = errors.Wrap(err, "failed to read snapshot status")
+		return result
+	}
+	result.Revision = status.Revision
+	result.TotalKey = status.TotalKey
+	return result
+}
@@ -0,0 +1,272 @@
+package etcd
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	zipCompression  = "zip"
+	gzipCompression = "gzip"
+	zstdCompression = "zstd"
+)
+
+// compressedExtensions holds the extension appended to the names of snapshots compressed with each
+// supported format. Zip is the default, for compatibility with snapshots taken by older releases.
+var compressedExtensions = map[string]string{
+	zipCompression:  ".zip",
+	gzipCompression: ".gz",
+	zstdCompression: ".zst",
+}
+
+// compressionMagic holds the bytes found at the start of snapshots compressed with each supported
+// format, so that compressed snapshots can be detected regardless of their file name.
+var compressionMagic = map[string][]byte{
+	zipCompression:  {'P', 'K', 0x03, 0x04},
+	gzipCompression: {0x1f, 0x8b},
+	zstdCompression: {0x28, 0xb5, 0x2f, 0xfd},
+}
+
+// ValidateSnapshotCompression returns an error if the given snapshot compression format is not supported.
+func ValidateSnapshotCompression(format string) error {
+	if _, ok := compressedExtensions[format]; !ok {
+		return fmt.Errorf("unsupported etcd snapshot compression format %q: must be one of zip, gzip or zstd", format)
+	}
+	return nil
+}
+
+// trimCompressedExtension returns the given snapshot name without any compressed extension.
+func trimCompressedExtension(name string) string {
+	for _, ext := range compressedExtensions {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// isCompressedName returns true if the given snapshot name ends with a compressed extension.
+func isCompressedName(name string) bool {
+	return trimCompressedExtension(name) != name
+}
+
+// countingReader counts the bytes read through it, so that the size of a snapshot can be
+// compared with its compressed size once it has been streamed.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// zipEntryWriter writes a single entry into a zip archive, and completes the archive when closed.
+type zipEntryWriter struct {
+	io.Writer
+	archive *zip.Writer
+}
+
+func (z *zipEntryWriter) Close() error {
+	return z.archive.Close()
+}
+
+// newCompressWriter returns a writer that compresses the snapshot with the given name into the given
+// writer, using the given format. The compressed output is only complete once the writer is closed.
+func newCompressWriter(w io.Writer, format, snapshotName string) (io.WriteCloser, error) {
+	switch format {
+	case zipCompression:
+		archive := zip.NewWriter(w)
+		entry, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     snapshotName,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &zipEntryWriter{Writer: entry, archive: archive}, nil
+	case gzipCompression:
+		gw := gzip.NewWriter(w)
+		gw.Name = snapshotName
+		gw.ModTime = time.Now()
+		return gw, nil
+	case zstdCompression:
+		return zstd.NewWriter(w)
+	}
+	return nil, ValidateSnapshotCompression(format)
+}
+
+// compressStream returns a reader that yields the snapshot read from the given reader, compressed
+// with the given format under the given name. The input is closed once it has been consumed, or
+// once the returned reader is closed.
+func compressStream(in io.ReadCloser, format, snapshotName string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer in.Close()
+		writer, err := newCompressWriter(pw, format, snapshotName)
+		if err == nil {
+			_, err = io.Copy(writer, in)
+			if cerr := writer.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// saveCompressedSnapshot streams a snapshot from etcd into the given path, compressing it with the
+// given format as it is received, so that the uncompressed snapshot is never written to disk. The
+// snapshot is written to a temporary file that is renamed once complete, and the sizes of the
+// uncompressed and compressed snapshot are returned.
+func saveCompressedSnapshot(ctx context.Context, cfg *clientv3.Config, format, snapshotName, compressedPath string) (int64, int64, error) {
+	logrus.Infof("Compressing etcd snapshot %s with %s", snapshotName, format)
+
+	client, err := clientv3.New(*cfg)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to create etcd client for snapshot")
+	}
+	defer client.Close()
+
+	rc, err := client.Snapshot(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	in := &countingReader{ReadCloser: rc}
+	r := compressStream(in, format, snapshotName)
+	defer r.Close()
+
+	partPath := compressedPath + compressTempExtension
+	out, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, 0, err
+	}
+	compressedSize, err := io.Copy(out, r)
+	if err != nil {
+		out.Close()
+		os.Remove(partPath)
+		return 0, 0, err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(partPath)
+		return 0, 0, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(partPath)
+		return 0, 0, err
+	}
+	if err := os.Rename(partPath, compressedPath); err != nil {
+		os.Remove(partPath)
+		return 0, 0, err
+	}
+	return in.n, compressedSize, nil
+}
+
+// snapshotCompression returns the format that the given snapshot is compressed with, detected from
+// the start of the file, or an empty string if it is not compressed.
+func snapshotCompression(snapshotPath string) (string, error) {
+	f, err := os.Open(snapshotPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, 4)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	for format, magic := range compressionMagic {
+		if bytes.HasPrefix(header[:n], magic) {
+			return format, nil
+		}
+	}
+	return "", nil
+}
+
+// decompressSnapshot decompresses the given snapshot into the given directory, and provides the
+// caller with the full path to the uncompressed snapshot. The snapshot is decompressed as it is read,
+// and the uncompressed snapshot is removed again if it cannot be decompressed.
+func decompressSnapshot(snapshotDir, snapshotPath, format string) (string, error) {
+	logrus.Infof("Decompressing etcd snapshot file %s with %s", snapshotPath, format)
+
+	name := trimCompressedExtension(filepath.Base(snapshotPath))
+	var r io.Reader
+	switch format {
+	case zipCompression:
+		archive, err := zip.OpenReader(snapshotPath)
+		if err != nil {
+			return "", err
+		}
+		defer archive.Close()
+		if len(archive.File) != 1 {
+			return "", fmt.Errorf("compressed etcd snapshot %s contains %d files, expected 1", snapshotPath, len(archive.File))
+		}
+		entry, err := archive.File[0].Open()
+		if err != nil {
+			return "", err
+		}
+		defer entry.Close()
+		name = filepath.Base(archive.File[0].Name)
+		r = entry
+	case gzipCompression, zstdCompression:
+		f, err := os.Open(snapshotPath)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		if format == gzipCompression {
+			gr, err := gzip.NewReader(f)
+			if err != nil {
+				return "", err
+			}
+			defer gr.Close()
+			r = gr
+		} else {
+			zr, err := zstd.NewReader(f)
+			if err != nil {
+				return "", err
+			}
+			defer zr.Close()
+			r = zr
+		}
+	default:
+		return "", ValidateSnapshotCompression(format)
+	}
+
+	decompressedPath := filepath.Join(snapshotDir, name)
+	if decompressedPath == snapshotPath {
+		decompressedPath += ".decompressed"
+	}
+	out, err := os.OpenFile(decompressedPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(decompressedPath)
+		return "", errors.Wrapf(err, "failed to decompress etcd snapshot %s", snapshotPath)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(decompressedPath)
+		return "", err
+	}
+	return decompressedPath, nil
+}
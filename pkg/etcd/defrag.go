@@ -0,0 +1,260 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/wangxiaochuang/k3s/pkg/version"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// defragTimeout is the time allowed for a single member to be defragmented. The member
+	// cannot serve requests while its backend is being rewritten.
+	defragTimeout = 10 * time.Minute
+	// defragHealthTimeout is the time allowed for a member to report its status again once it
+	// has been defragmented, before the next member is defragmented.
+	defragHealthTimeout = time.Minute
+)
+
+// defragStatusKey holds the outcome of the most recent defragmentation run.
+var defragStatusKey = version.Program + "/etcd/defragStatus"
+
+// defragResult records the outcome of defragmentation for a single member.
+type defragResult struct {
+	ID              uint64 `json:"id"`
+	Name            string `json:"name"`
+	DBSizeBefore    int64  `json:"dbSizeBefore,omitempty"`
+	DBInUseBefore   int64  `json:"dbSizeInUseBefore,omitempty"`
+	DBSizeAfter     int64  `json:"dbSizeAfter,omitempty"`
+	Defragmented    bool   `json:"defragmented"`
+	Reason          string `json:"reason,omitempty"`
+	DurationSeconds int64  `json:"durationSeconds,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// defragStatus records the outcome of a defragmentation run.
+type defragStatus struct {
+	StartTime metav1.Time    `json:"startTime"`
+	EndTime   metav1.Time    `json:"endTime"`
+	Members   []defragResult `json:"members"`
+}
+
+// setDefragFunction schedules defragmentation of the cluster members at the configured interval.
+func (e *ETCD) setDefragFunction(ctx context.Context) {
+	if e.config.EtcdDefragCron == "" {
+		return
+	}
+	if _, err := e.cron.AddFunc(e.config.EtcdDefragCron, func() {
+		if err := e.defragment(ctx); err != nil {
+			logrus.Errorf("Failed to defragment etcd: %v", err)
+		}
+	}); err != nil {
+		logrus.Errorf("Failed to add etcd defragmentation schedule: %v", err)
+	}
+}
+
+// defragment defragments the backend of each cluster member whose database exceeds the configured
+// minimum size and unused space threshold. Only the leader runs defragmentation. Members are defragmented
+// one at a time, waiting for each to become healthy before moving on to the next, and the leader is only
+// defragmented once all other members are done. If another voting member is healthy, leadership is
+// transferred to it before the former leader is defragmented.
+func (e *ETCD) defragment(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&e.defragRunning, 0, 1) {
+		logrus.Warn("Skipping etcd defragmentation, the previous run has not completed")
+		return nil
+	}
+	defer atomic.StoreInt32(&e.defragRunning, 0)
+
+	if e.client == nil {
+		return errors.New("etcd client was nil")
+	}
+
+	listCtx, cancel := context.WithTimeout(ctx, testTimeout)
+	defer cancel()
+
+	status, err := e.client.Status(listCtx, localEndpoint(e.config))
+	if err != nil {
+		return errors.Wrap(err, "failed to check local etcd status for defragmentation")
+	}
+	if status.Header.MemberId != status.Leader {
+		logrus.Debug("Skipping etcd defragmentation, this member is not the leader")
+		return nil
+	}
+	leader := status.Leader
+
+	members, err := e.client.MemberList(listCtx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get etcd members for defragmentation")
+	}
+
+	result, defragErr := e.defragmentMembers(ctx, leader, members.Members, false)
+	if result != nil {
+		if err := e.setDefragStatus(ctx, result); err != nil {
+			return errors.Wrap(err, "failed to record etcd defragmentation status")
+		}
+	}
+	return defragErr
+}
+
+// defragmentMembers defragments the given members one at a time, followers first and the leader last,
+// and returns the outcome for the caller to record. If force is set, members are defragmented regardless
+// of their size and fragmentation. An error is returned if any member failed, or if the context was
+// cancelled, in which case no outcome is returned. The caller must hold the defragmentation flag.
+func (e *ETCD) defragmentMembers(ctx context.Context, leader uint64, members []*etcdserverpb.Member, force bool) (*defragStatus, error) {
+	sort.SliceStable(members, func(i, j int) bool {
+		return members[j].ID == leader && members[i].ID != leader
+	})
+
+	result := &defragStatus{StartTime: metav1.Now()}
+	logrus.Info("Starting etcd defragmentation")
+
+	var healthyVoter *etcdserverpb.Member
+	for _, member := range members {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if member.ID == leader && healthyVoter != nil {
+			moveCtx, cancel := context.WithTimeout(ctx, testTimeout)
+			_, err := e.client.MoveLeader(moveCtx, healthyVoter.ID)
+			cancel()
+			if err != nil {
+				logrus.Warnf("Failed to move etcd leadership to %s before defragmentation: %v", healthyVoter.Name, err)
+			} else {
+				logrus.Infof("Moved etcd leadership to %s before defragmentation", healthyVoter.Name)
+			}
+		}
+		r := e.defragmentMember(ctx, member, force)
+		if r.Error == "" && !member.IsLearner && member.ID != leader {
+			healthyVoter = member
+		}
+		result.Members = append(result.Members, r)
+	}
+
+	result.EndTime = metav1.Now()
+	var defragmented, failed, skipped int
+	for _, r := range result.Members {
+		switch {
+		case r.Error != "":
+			failed++
+		case r.Defragmented:
+			defragmented++
+		default:
+			skipped++
+		}
+	}
+	logrus.Infof("Completed etcd defragmentation: %d defragmented, %d failed, %d skipped", defragmented, failed, skipped)
+
+	if failed > 0 {
+		return result, errors.Errorf("%d of %d etcd members failed defragmentation", failed, len(result.Members))
+	}
+	return result, nil
+}
+
+// defragmentMember defragments a single member if its database is fragmented beyond the configured
+// threshold, or if force is set, and waits for it to report its status again.
+func (e *ETCD) defragmentMember(ctx context.Context, member *etcdserverpb.Member, force bool) defragResult {
+	r := defragResult{ID: member.ID, Name: member.Name}
+
+	ep, status, err := e.memberEndpointStatus(ctx, member)
+	if err != nil {
+		r.Error = err.Error()
+		logrus.Warnf("Skipping defragmentation of etcd member %s: %v", member.Name, err)
+		return r
+	}
+	r.DBSizeBefore = status.DbSize
+	r.DBInUseBefore = status.DbSizeInUse
+
+	minSize := int64(e.config.EtcdDefragMinSize) * 1024 * 1024
+	fragmented := float64(status.DbSize-status.DbSizeInUse) / float64(status.DbSize)
+	switch {
+	case force:
+	case status.DbSize == 0 || status.DbSize < minSize:
+		r.Reason = "database is smaller than the minimum size"
+	case fragmented < e.config.EtcdDefragThreshold:
+		r.Reason = "database is not fragmented beyond the threshold"
+	}
+	if r.Reason != "" {
+		logrus.Debugf("Skipping defragmentation of etcd member %s: %s (size %d, in use %d)", member.Name, r.Reason, status.DbSize, status.DbSizeInUse)
+		return r
+	}
+
+	logrus.Infof("Defragmenting etcd member %s: size %d, in use %d", member.Name, status.DbSize, status.DbSizeInUse)
+	start := time.Now()
+	defragCtx, cancel := context.WithTimeout(ctx, defragTimeout)
+	defer cancel()
+	if _, err := e.client.Defragment(defragCtx, ep); err != nil {
+		r.Error = err.Error()
+		logrus.Errorf("Failed to defragment etcd member %s: %v", member.Name, err)
+		return r
+	}
+	r.Defragmented = true
+	r.DurationSeconds = int64(time.Since(start).Seconds())
+
+	if err := e.waitForMemberStatus(ctx, member, &r); err != nil {
+		r.Error = err.Error()
+		logrus.Errorf("etcd member %s did not report its status after defragmentation: %v", member.Name, err)
+		return r
+	}
+	logrus.Infof("Defragmented etcd member %s in %s: size %d to %d", member.Name, time.Since(start).Round(time.Second), r.DBSizeBefore, r.DBSizeAfter)
+	return r
+}
+
+// memberEndpointStatus returns the status of the member from its first reachable client URL.
+func (e *ETCD) memberEndpointStatus(ctx context.Context, member *etcdserverpb.Member) (string, *clientv3.StatusResponse, error) {
+	if len(member.ClientURLs) == 0 {
+		return "", nil, errors.New("member has not started")
+	}
+	var lastErr error
+	for _, ep := range member.ClientURLs {
+		ctx, cancel := context.WithTimeout(ctx, defaultDialTimeout)
+		status, err := e.client.Status(ctx, ep)
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return ep, status, nil
+	}
+	return "", nil, lastErr
+}
+
+// waitForMemberStatus waits for the member to report its status after defragmentation, and records its new size.
+func (e *ETCD) waitForMemberStatus(ctx context.Context, member *etcdserverpb.Member, r *defragResult) error {
+	ctx, cancel := context.WithTimeout(ctx, defragHealthTimeout)
+	defer cancel()
+	for {
+		_, status, err := e.memberEndpointStatus(ctx, member)
+		if err == nil {
+			r.DBSizeAfter = status.DbSize
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(defaultDialTimeout):
+		}
+	}
+}
+
+// setDefragStatus stores the defragStatus struct to etcd
+func (e *ETCD) setDefragStatus(ctx context.Context, status *defragStatus) error {
+	w := &bytes.Buffer{}
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, testTimeout)
+	defer cancel()
+	_, err := e.client.Put(ctx, defragStatusKey, w.String())
+	return err
+}
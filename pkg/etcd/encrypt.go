@@ -0,0 +1,286 @@
+package etcd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	encryptedExtension = ".enc"
+
+	// encryptionChunkSize is the size of each plaintext chunk sealed by encryptSnapshot.
+	// Snapshots are encrypted in chunks so that they do not need to be held in memory.
+	encryptionChunkSize = 1024 * 1024
+	encryptionSaltSize  = 16
+)
+
+// encryptionMagic is written at the start of every encrypted snapshot, so that encrypted
+// snapshots can be detected regardless of their file name.
+var encryptionMagic = []byte("K3SENC01")
+
+// snapshotEncryptionKey returns the passphrase held in the configured key file.
+func snapshotEncryptionKey(keyFile string) (string, error) {
+	if keyFile == "" {
+		return "", errors.New("no etcd snapshot encryption key file was specified")
+	}
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read etcd snapshot encryption key file")
+	}
+	passphrase := strings.TrimSpace(string(data))
+	if passphrase == "" {
+		return "", fmt.Errorf("etcd snapshot encryption key file %s is empty", keyFile)
+	}
+	return passphrase, nil
+}
+
+// newSnapshotGCM returns an aes+gcm cipher using a pbkdf2 key derived from the passphrase and salt.
+func newSnapshotGCM(passphrase string, salt []byte) (cipher.AEAD, error) {
+	clearKey := pbkdf2.Key([]byte(passphrase), salt, 4096, 32, sha1.New)
+	key, err := aes.NewCipher(clearKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(key)
+}
+
+// chunkNonce returns the nonce for the given chunk, built from the random prefix and the chunk counter.
+func chunkNonce(prefix []byte, counter uint64, size int) []byte {
+	nonce := make([]byte, size)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[size-8:], counter)
+	return nonce
+}
+
+// encryptSnapshot encrypts the given snapshot file using aes+gcm, writing the result alongside it
+// with the encrypted extension, and returns the path to the encrypted file. The output consists of
+// a header containing the salt and nonce prefix, followed by length-prefixed sealed chunks. The last
+// chunk is authenticated as final, so that a truncated file fails to decrypt.
+func encryptSnapshot(passphrase, snapshotPath string) (string, error) {
+	logrus.Info("Encrypting etcd snapshot file: " + snapshotPath)
+
+	in, err := os.Open(snapshotPath)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	gcm, salt, prefix, err := newSnapshotEncrypter(passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	encryptedPath := snapshotPath + encryptedExtension
+	out, err := os.OpenFile(encryptedPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeEncryptedChunks(out, in, gcm, salt, prefix); err != nil {
+		out.Close()
+		os.Remove(encryptedPath)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(encryptedPath)
+		return "", err
+	}
+	return encryptedPath, nil
+}
+
+// encryptStream returns a reader that yields the encrypted form of the snapshot read from the given
+// reader, in the same format as encryptSnapshot. The input is closed once it has been consumed, or
+// once the returned reader is closed.
+func encryptStream(passphrase string, in io.ReadCloser) (io.ReadCloser, error) {
+	gcm, salt, prefix, err := newSnapshotEncrypter(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer in.Close()
+		pw.CloseWithError(writeEncryptedChunks(pw, in, gcm, salt, prefix))
+	}()
+	return pr, nil
+}
+
+// newSnapshotEncrypter returns a cipher keyed with a new random salt, along with the salt
+// and a random nonce prefix.
+func newSnapshotEncrypter(passphrase string) (cipher.AEAD, []byte, []byte, error) {
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, nil, nil, err
+	}
+
+	gcm, err := newSnapshotGCM(passphrase, salt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	prefix := make([]byte, gcm.NonceSize()-8)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, nil, nil, err
+	}
+	return gcm, salt, prefix, nil
+}
+
+func writeEncryptedChunks(out io.Writer, in io.Reader, gcm cipher.AEAD, salt, prefix []byte) error {
+	w := bufio.NewWriter(out)
+	for _, b := range [][]byte{encryptionMagic, salt, prefix} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	r := bufio.NewReaderSize(in, encryptionChunkSize)
+	buf := make([]byte, encryptionChunkSize)
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// The chunk is final if the reader has no more data
+		final := []byte{0}
+		if _, peekErr := r.Peek(1); peekErr == io.EOF {
+			final[0] = 1
+		}
+
+		sealed := gcm.Seal(nil, chunkNonce(prefix, counter, gcm.NonceSize()), buf[:n], final)
+		if err := binary.Write(w, binary.BigEndian, uint32(len(sealed))); err != nil {
+			return err
+		}
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if final[0] == 1 {
+			return w.Flush()
+		}
+	}
+}
+
+// isEncryptedSnapshot returns true if the given file starts with the encrypted snapshot header.
+func isEncryptedSnapshot(snapshotPath string) (bool, error) {
+	f, err := os.Open(snapshotPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(f, magic); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(magic, encryptionMagic), nil
+}
+
+// decryptSnapshot decrypts the given encrypted snapshot into the destination path, which
+// is removed again if the snapshot cannot be decrypted.
+func decryptSnapshot(passphrase, snapshotPath, destPath string) error {
+	logrus.Info("Decrypting etcd snapshot file: " + snapshotPath)
+
+	in, err := os.Open(snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := readEncryptedChunks(out, in, passphrase); err != nil {
+		out.Close()
+		os.Remove(destPath)
+		return errors.Wrapf(err, "failed to decrypt etcd snapshot %s", snapshotPath)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(destPath)
+		return err
+	}
+	return nil
+}
+
+func readEncryptedChunks(out io.Writer, in io.Reader, passphrase string) error {
+	r := bufio.NewReader(in)
+
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if !bytes.Equal(magic, encryptionMagic) {
+		return errors.New("not an encrypted etcd snapshot")
+	}
+
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return err
+	}
+
+	gcm, err := newSnapshotGCM(passphrase, salt)
+	if err != nil {
+		return err
+	}
+
+	prefix := make([]byte, gcm.NonceSize()-8)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(out)
+	for counter := uint64(0); ; counter++ {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			if err == io.EOF {
+				return errors.New("encrypted snapshot is truncated")
+			}
+			return err
+		}
+		if size > encryptionChunkSize+uint32(gcm.Overhead()) {
+			return fmt.Errorf("invalid encrypted chunk size %d", size)
+		}
+
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(r, sealed); err != nil {
+			return err
+		}
+
+		nonce := chunkNonce(prefix, counter, gcm.NonceSize())
+		final := true
+		plaintext, err := gcm.Open(nil, nonce, sealed, []byte{1})
+		if err != nil {
+			final = false
+			if plaintext, err = gcm.Open(nil, nonce, sealed, []byte{0}); err != nil {
+				return err
+			}
+		}
+
+		if _, err := w.Write(plaintext); err != nil {
+			return err
+		}
+		if final {
+			if _, err := r.Peek(1); err != io.EOF {
+				return errors.New("unexpected data after final encrypted chunk")
+			}
+			return w.Flush()
+		}
+	}
+}
@@ -1,15 +1,14 @@
 package etcd
 
 import (
-	"archive/zip"
 	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -18,13 +17,13 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/k3s-io/kine/pkg/client"
 	endpoint2 "github.com/k3s-io/kine/pkg/endpoint"
-	"github.com/minio/minio-go/v7"
 	"github.com/pkg/errors"
 	certutil "github.com/rancher/dynamiclistener/cert"
 	controllerv1 "github.com/rancher/wrangler/pkg/generated/controllers/core/v1"
@@ -40,19 +39,21 @@ import (
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/etcdutl/v3/snapshot"
 	v1 "k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilnet "k8s.io/apimachinery/pkg/util/net"
-	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/component-base/metrics/legacyregistry"
 )
 
 const (
-	endpoint             = "https://127.0.0.1:2379"
 	testTimeout          = time.Second * 10
-	manageTickerTime     = time.Second * 15
-	learnerMaxStallTime  = time.Minute * 5
 	memberRemovalTimeout = time.Minute * 1
 
+	// defaultManageTickerTime and defaultLearnerMaxStallTime are used if the learner check interval
+	// and maximum stall time are not configured.
+	defaultManageTickerTime    = time.Second * 15
+	defaultLearnerMaxStallTime = time.Minute * 5
+
 	// defaultDialTimeout is intentionally short so that connections timeout within the testTimeout defined above
 	defaultDialTimeout = 2 * time.Second
 	// other defaults from k8s.io/apiserver/pkg/storage/storagebackend/factory/etcd3.go
@@ -61,6 +62,11 @@ const (
 
 	maxBackupRetention = 5
 
+	// DefaultClientPort, DefaultPeerPort and DefaultMetricsPort are the ports used by etcd unless configured otherwise.
+	DefaultClientPort  = 2379
+	DefaultPeerPort    = 2380
+	DefaultMetricsPort = 2381
+
 	MasterLabel       = "node-role.kubernetes.io/master"
 	ControlPlaneLabel = "node-role.kubernetes.io/control-plane"
 	EtcdRoleLabel     = "node-role.kubernetes.io/etcd"
@@ -88,6 +94,21 @@ type ETCD struct {
 	address string
 	cron    *cron.Cron
 	s3      *S3
+
+	snapshotFilesLock sync.Mutex
+	snapshotFiles     dynamic.Interface
+
+	snapshotQueueLock      sync.Mutex
+	snapshotQueue          map[string]snapshotFile
+	snapshotQueueReconcile bool
+	snapshotQueueWaiting   bool
+
+	defragRunning int32
+
+	alarmsLock           sync.Mutex
+	alarms               []alarmStatus
+	alarmConditionSynced bool
+	localMemberID        uint64
 }
 
 type learnerProgress struct {
@@ -95,6 +116,7 @@ type learnerProgress struct {
 	Name             string      `json:"name,omitempty"`
 	RaftAppliedIndex uint64      `json:"raftAppliedIndex,omitempty"`
 	LastProgress     metav1.Time `json:"lastProgress,omitempty"`
+	State            string      `json:"state,omitempty"`
 }
 
 type Members struct {
@@ -119,7 +141,7 @@ func (e *ETCD) Test(ctx context.Context) error {
 	ctx, cancel := context.WithTimeout(ctx, testTimeout)
 	defer cancel()
 
-	status, err := e.client.Status(ctx, endpoint)
+	status, err := e.client.Status(ctx, localEndpoint(e.config))
 	if err != nil {
 		return err
 	}
@@ -230,15 +252,17 @@ func (e *ETCD) Reset(ctx context.Context, rebootstrap func() error) error {
 	}()
 	// If asked to restore from a snapshot, do so
 	if e.config.ClusterResetRestorePath != "" {
-		if e.config.EtcdS3 {
-			if err := e.initS3IfNil(ctx); err != nil {
+		if e.config.EtcdS3 || isLatestSelector(e.config.ClusterResetRestorePath) {
+			plan, err := e.RestorePlan(ctx, e.config.ClusterResetRestorePath)
+			if err != nil {
 				return err
 			}
-			logrus.Infof("Retrieving etcd snapshot %s from S3", e.config.ClusterResetRestorePath)
-			if err := e.s3.Download(ctx); err != nil {
+			logrus.Infof("Restoring etcd snapshot %s from %s", plan.Snapshot.Name, plan.Store.Name())
+			snapshotPath, err := e.fetchRestoreSnapshot(ctx, plan)
+			if err != nil {
 				return err
 			}
-			logrus.Infof("S3 download complete for %s", e.config.ClusterResetRestorePath)
+			e.config.ClusterResetRestorePath = snapshotPath
 		}
 
 		info, err := os.Stat(e.config.ClusterResetRestorePath)
@@ -272,10 +296,12 @@ func (e *ETCD) Start(ctx context.Context, clientAccessInfo *clientaccess.Info) e
 
 	if !e.config.EtcdDisableSnapshots {
 		e.setSnapshotFunction(ctx)
-		e.cron.Start()
 	}
+	e.setDefragFunction(ctx)
+	e.cron.Start()
 
 	go e.manageLearners(ctx)
+	go e.manageAlarms(ctx)
 
 	if existingCluster {
 		//check etcd dir permission
@@ -320,7 +346,7 @@ func (e *ETCD) join(ctx context.Context, clientAccessInfo *clientaccess.Info) er
 		add     = true
 	)
 
-	clientURLs, memberList, err := ClientURLs(clientCtx, clientAccessInfo, e.config.PrivateIP)
+	clientURLs, memberList, err := ClientURLs(clientCtx, clientAccessInfo, e.address, clientPort(e.config), preferIPv6(e.config))
 	if err != nil {
 		return err
 	}
@@ -403,18 +429,18 @@ func (e *ETCD) Register(ctx context.Context, config *config.Control, handler htt
 	e.config = config
 	e.runtime = config.Runtime
 
-	client, err := GetClient(ctx, e.runtime, endpoint)
+	client, err := GetClient(ctx, e.runtime, localEndpoint(e.config))
 	if err != nil {
 		return nil, err
 	}
 	e.client = client
 
-	address, err := GetAdvertiseAddress(config.PrivateIP)
+	address, err := GetAdvertiseAddress(config.PrivateIP, preferIPv6(config))
 	if err != nil {
 		return nil, err
 	}
 	e.address = address
-	e.config.Datastore.Endpoint = endpoint
+	e.config.Datastore.Endpoint = localEndpoint(e.config)
 	e.config.Datastore.BackendTLSConfig.CAFile = e.runtime.ETCDServerCA
 	e.config.Datastore.BackendTLSConfig.CertFile = e.runtime.ClientETCDCert
 	e.config.Datastore.BackendTLSConfig.KeyFile = e.runtime.ClientETCDKey
@@ -432,11 +458,14 @@ func (e *ETCD) Register(ctx context.Context, config *config.Control, handler htt
 	}
 	e.config.Runtime.ClusterControllerStart = func(ctx context.Context) error {
 		RegisterMetadataHandlers(ctx, e, e.config.Runtime.Core.Core().V1().Node())
-		return nil
+		return e.registerSnapshotHandlers(ctx)
 	}
 
 	e.config.Runtime.LeaderElectedClusterControllerStart = func(ctx context.Context) error {
 		RegisterMemberHandlers(ctx, e, e.config.Runtime.Core.Core().V1().Node())
+		if err := e.migrateSnapshotConfigMap(ctx); err != nil {
+			logrus.Errorf("Failed to migrate etcd snapshot records to ETCDSnapshotFile resources: %v", err)
+		}
 		return nil
 	}
 
@@ -462,6 +491,12 @@ func (e *ETCD) setName(force bool) error {
 func (e *ETCD) handler(next http.Handler) http.Handler {
 	mux := mux.NewRouter()
 	mux.Handle("/db/info", e.infoHandler())
+	e.snapshotHandlers(mux)
+	e.alarmHandlers(mux)
+	e.learnerHandlers(mux)
+	if e.config.EtcdSnapshotMetrics {
+		mux.Path("/db/metrics").Methods(http.MethodGet).Handler(e.snapshotAuthMiddleware(legacyregistry.Handler()))
+	}
 	mux.NotFoundHandler = next
 	return mux
 }
@@ -542,11 +577,17 @@ func toTLSConfig(runtime *config.ControlRuntime) (*tls.Config, error) {
 	}, nil
 }
 
-// getAdvertiseAddress returns the IP address best suited for advertising to clients
-func GetAdvertiseAddress(advertiseIP string) (string, error) {
+// GetAdvertiseAddress returns the IP address best suited for advertising to clients. If no address is
+// given, the address of the host interface with a default route is used, preferring IPv6 addresses if
+// preferIPv6 is set.
+func GetAdvertiseAddress(advertiseIP string, preferIPv6 bool) (string, error) {
 	ip := advertiseIP
 	if ip == "" {
-		ipAddr, err := utilnet.ChooseHostInterface()
+		bindAddress := net.IPv4zero
+		if preferIPv6 {
+			bindAddress = net.IPv6unspecified
+		}
+		ipAddr, err := utilnet.ResolveBindAddress(bindAddress)
 		if err != nil {
 			return "", err
 		}
@@ -556,6 +597,27 @@ func GetAdvertiseAddress(advertiseIP string) (string, error) {
 	return ip, nil
 }
 
+// preferIPv6 returns true if etcd should prefer IPv6 addresses when choosing its advertise address; that is,
+// if it is configured to bind to an IPv6 address, or if the first, primary, cluster CIDR is an IPv6 CIDR.
+func preferIPv6(config *config.Control) bool {
+	if ip := net.ParseIP(config.EtcdBindAddress); ip != nil {
+		return ip.To4() == nil
+	}
+	if len(config.ClusterIPRanges) > 0 && config.ClusterIPRanges[0] != nil {
+		return config.ClusterIPRanges[0].IP.To4() == nil
+	}
+	return false
+}
+
+// sameIP returns true if both strings are the same IP address, regardless of how the addresses are formatted.
+func sameIP(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a == b
+	}
+	return ipA.Equal(ipB)
+}
+
 // newCluster returns options to set up etcd for a new cluster
 func (e *ETCD) newCluster(ctx context.Context, reset bool) error {
 	err := e.cluster(ctx, reset, executor.InitialOptions{
@@ -600,7 +662,7 @@ func (e *ETCD) migrateFromSQLite(ctx context.Context) error {
 	}
 	defer sqliteClient.Close()
 
-	etcdClient, err := GetClient(ctx, e.runtime, "https://localhost:2379")
+	etcdClient, err := GetClient(ctx, e.runtime, localEndpoint(e.config))
 	if err != nil {
 		return err
 	}
@@ -622,21 +684,91 @@ func (e *ETCD) migrateFromSQLite(ctx context.Context) error {
 	return os.Rename(sqliteFile(e.config), sqliteFile(e.config)+".migrated")
 }
 
+// clientPort returns the configured etcd client port, or the default client port if not set.
+func clientPort(config *config.Control) int {
+	if config.EtcdClientPort == 0 {
+		return DefaultClientPort
+	}
+	return config.EtcdClientPort
+}
+
+// peerPort returns the configured etcd peer port, or the default peer port if not set.
+func peerPort(config *config.Control) int {
+	if config.EtcdPeerPort == 0 {
+		return DefaultPeerPort
+	}
+	return config.EtcdPeerPort
+}
+
+// metricsPort returns the configured etcd metrics port, or the default metrics port if not set.
+func metricsPort(config *config.Control) int {
+	if config.EtcdMetricsPort == 0 {
+		return DefaultMetricsPort
+	}
+	return config.EtcdMetricsPort
+}
+
+// localEndpoint returns the loopback client address of the local etcd member, used by internal clients.
+func localEndpoint(config *config.Control) string {
+	return "https://" + net.JoinHostPort(loopbackAddress(config), strconv.Itoa(clientPort(config)))
+}
+
+// loopbackAddress returns the loopback address that internal clients connect to etcd on. This is the
+// bind address if it is a loopback address, or otherwise the loopback address of the same family,
+// so that it is covered by an unspecified bind address.
+func loopbackAddress(config *config.Control) string {
+	ip := net.ParseIP(config.EtcdBindAddress)
+	switch {
+	case ip == nil:
+		return "127.0.0.1"
+	case ip.IsLoopback():
+		return ip.String()
+	case ip.To4() == nil:
+		return "::1"
+	default:
+		return "127.0.0.1"
+	}
+}
+
 // peerURL returns the peer access address for the local node
 func (e *ETCD) peerURL() string {
-	return fmt.Sprintf("https://%s:2380", e.address)
+	return "https://" + net.JoinHostPort(e.address, strconv.Itoa(peerPort(e.config)))
 }
 
 // clientURL returns the client access address for the local node
 func (e *ETCD) clientURL() string {
-	return fmt.Sprintf("https://%s:2379", e.address)
+	return "https://" + net.JoinHostPort(e.address, strconv.Itoa(clientPort(e.config)))
+}
+
+// listenClientURLs returns the addresses that etcd listens on for clients. These are the bind address,
+// or the client access address if none is configured, and the loopback address used by internal clients,
+// unless it is already covered by a loopback or unspecified bind address.
+func (e *ETCD) listenClientURLs() string {
+	bindAddress := e.config.EtcdBindAddress
+	if bindAddress == "" {
+		bindAddress = e.address
+	}
+	listen := "https://" + net.JoinHostPort(bindAddress, strconv.Itoa(clientPort(e.config)))
+	if ip := net.ParseIP(bindAddress); ip != nil && (ip.IsUnspecified() || ip.IsLoopback()) {
+		return listen
+	}
+	return listen + "," + localEndpoint(e.config)
+}
+
+// listenPeerURLs returns the address that etcd listens on for peers.
+func (e *ETCD) listenPeerURLs() string {
+	if e.config.EtcdBindAddress == "" {
+		return e.peerURL()
+	}
+	return "https://" + net.JoinHostPort(e.config.EtcdBindAddress, strconv.Itoa(peerPort(e.config)))
 }
 
 // metricsURL returns the metrics access address
 func (e *ETCD) metricsURL(expose bool) string {
-	address := "http://127.0.0.1:2381"
+	port := strconv.Itoa(metricsPort(e.config))
+	address := "http://" + net.JoinHostPort(loopbackAddress(e.config), port)
 	if expose {
-		address = fmt.Sprintf("http://%s:2381,%s", e.address, address)
+		address = "http://" + net.JoinHostPort(e.address, port) + "," + address
 	}
 	return address
 }
@@ -647,9 +779,9 @@ func (e *ETCD) cluster(ctx context.Context, forceNew bool, options executor.Init
 		Name:                e.name,
 		InitialOptions:      options,
 		ForceNewCluster:     forceNew,
-		ListenClientURLs:    e.clientURL() + ",https://127.0.0.1:2379",
+		ListenClientURLs:    e.listenClientURLs(),
 		ListenMetricsURLs:   e.metricsURL(e.config.EtcdExposeMetrics),
-		ListenPeerURLs:      e.peerURL(),
+		ListenPeerURLs:      e.listenPeerURLs(),
 		AdvertiseClientURLs: e.clientURL(),
 		DataDir:             DBDir(e.config),
 		ServerTrust: executor.ServerTrust{
@@ -689,8 +821,8 @@ func (e *ETCD) RemovePeer(ctx context.Context, name, address string, allowSelfRe
 			if err != nil {
 				return err
 			}
-			if u.Hostname() == address {
-				if e.address == address && !allowSelfRemoval {
+			if sameIP(u.Hostname(), address) {
+				if sameIP(e.address, address) && !allowSelfRemoval {
 					return errors.New("not removing self from etcd cluster")
 				}
 				logrus.Infof("Removing name=%s id=%d address=%s from etcd", member.Name, member.ID, address)
@@ -711,7 +843,7 @@ func (e *ETCD) RemovePeer(ctx context.Context, name, address string, allowSelfRe
 // the etcd leader.
 func (e *ETCD) manageLearners(ctx context.Context) error {
 	<-e.runtime.AgentReady
-	t := time.NewTicker(manageTickerTime)
+	t := time.NewTicker(e.manageTickerTime())
 	defer t.Stop()
 
 	for range t.C {
@@ -723,7 +855,7 @@ func (e *ETCD) manageLearners(ctx context.Context) error {
 			logrus.Error("Etcd client was nil")
 			continue
 		}
-		if status, err := e.client.Status(ctx, endpoint); err != nil {
+		if status, err := e.client.Status(ctx, localEndpoint(e.config)); err != nil {
 			logrus.Errorf("Failed to check local etcd status for learner management: %v", err)
 			continue
 		} else if status.Header.MemberId != status.Leader {
@@ -755,16 +887,9 @@ func (e *ETCD) manageLearners(ctx context.Context) error {
 }
 
 // trackLearnerProcess attempts to promote a learner. If it cannot be promoted, progress through the raft index is tracked.
-// If the learner does not make any progress in a reasonable amount of time, it is evicted from the cluster.
+// If the learner does not make any progress in a reasonable amount of time, it is evicted from the cluster, unless
+// eviction is disabled. Changes in the learner's state are recorded as events on the learner's node.
 func (e *ETCD) trackLearnerProgress(ctx context.Context, progress *learnerProgress, member *etcdserverpb.Member) error {
-	// Try to promote it. If it can be promoted, no further tracking is necessary
-	if _, err := e.client.MemberPromote(ctx, member.ID); err != nil {
-		logrus.Debugf("Unable to promote learner %s: %v", member.Name, err)
-	} else {
-		logrus.Infof("Promoted learner %s", member.Name)
-		return nil
-	}
-
 	now := time.Now()
 
 	// If this is the first time we've tracked this member's progress, reset stats
@@ -773,6 +898,18 @@ func (e *ETCD) trackLearnerProgress(ctx context.Context, progress *learnerProgre
 		progress.Name = member.Name
 		progress.RaftAppliedIndex = 0
 		progress.LastProgress.Time = now
+		progress.State = learnerStateCatchingUp
+		e.recordLearnerEvent(progress, v1.EventTypeNormal, "EtcdLearnerJoining", "etcd learner %s is catching up with the leader", member.Name)
+	}
+
+	// Try to promote it. If it can be promoted, no further tracking is necessary
+	if _, err := e.client.MemberPromote(ctx, member.ID); err != nil {
+		logrus.Debugf("Unable to promote learner %s: %v", member.Name, err)
+	} else {
+		logrus.Infof("Promoted learner %s", member.Name)
+		progress.State = learnerStatePromoted
+		e.recordLearnerEvent(progress, v1.EventTypeNormal, "EtcdLearnerPromoted", "etcd learner %s was promoted to a voting member", member.Name)
+		return e.setLearnerProgress(ctx, progress)
 	}
 
 	// Update progress by retrieving status from the member's first reachable client URL
@@ -789,22 +926,37 @@ func (e *ETCD) trackLearnerProgress(ctx context.Context, progress *learnerProgre
 			logrus.Debugf("Learner %s has progressed from RaftAppliedIndex %d to %d", progress.Name, progress.RaftAppliedIndex, status.RaftAppliedIndex)
 			progress.RaftAppliedIndex = status.RaftAppliedIndex
 			progress.LastProgress.Time = now
+			if progress.State == learnerStateStalled {
+				progress.State = learnerStateCatchingUp
+				e.recordLearnerEvent(progress, v1.EventTypeNormal, "EtcdLearnerProgressing", "etcd learner %s is making progress again at RaftAppliedIndex=%d", member.Name, progress.RaftAppliedIndex)
+			}
 		}
 		break
 	}
 
 	// Warn if the learner hasn't made any progress
+	stalled := now.Sub(progress.LastProgress.Time)
 	if !progress.LastProgress.Time.Equal(now) {
-		logrus.Warnf("Learner %s stalled at RaftAppliedIndex=%d for %s", progress.Name, progress.RaftAppliedIndex, now.Sub(progress.LastProgress.Time).String())
+		logrus.Warnf("Learner %s stalled at RaftAppliedIndex=%d for %s", progress.Name, progress.RaftAppliedIndex, stalled.String())
 	}
 
 	// See if it's time to evict yet
-	if now.Sub(progress.LastProgress.Time) > learnerMaxStallTime {
+	if stalled > e.learnerMaxStallTime() {
+		if e.config.EtcdLearnerNoEvict {
+			if progress.State != learnerStateStalled {
+				logrus.Errorf("Learner %s has not made progress for %s; not removing it as learner eviction is disabled", member.Name, stalled.String())
+				progress.State = learnerStateStalled
+				e.recordLearnerEvent(progress, v1.EventTypeWarning, "EtcdLearnerStalled", "etcd learner %s has been stalled at RaftAppliedIndex=%d for %s", member.Name, progress.RaftAppliedIndex, stalled.Round(time.Second))
+			}
+			return e.setLearnerProgress(ctx, progress)
+		}
 		if _, err := e.client.MemberRemove(ctx, member.ID); err != nil {
 			return err
 		}
 		logrus.Warnf("Removed learner %s from etcd cluster", member.Name)
-		return nil
+		progress.State = learnerStateEvicted
+		e.recordLearnerEvent(progress, v1.EventTypeWarning, "EtcdLearnerEvicted", "etcd learner %s was removed from the cluster after being stalled at RaftAppliedIndex=%d for %s", member.Name, progress.RaftAppliedIndex, stalled.Round(time.Second))
+		return e.setLearnerProgress(ctx, progress)
 	}
 
 	return e.setLearnerProgress(ctx, progress)
@@ -841,8 +993,10 @@ func (e *ETCD) setLearnerProgress(ctx context.Context, status *learnerProgress)
 	return err
 }
 
-// clientURLs returns a list of all non-learner etcd cluster member client access URLs
-func ClientURLs(ctx context.Context, clientAccessInfo *clientaccess.Info, selfIP string) ([]string, Members, error) {
+// ClientURLs returns a list of all non-learner etcd cluster member client access URLs, excluding
+// the member using the given address and client port. If no address is given, the address of this
+// node is chosen as for GetAdvertiseAddress, preferring IPv6 addresses if preferIPv6 is set.
+func ClientURLs(ctx context.Context, clientAccessInfo *clientaccess.Info, selfIP string, selfPort int, preferIPv6 bool) ([]string, Members, error) {
 	var memberList Members
 	resp, err := clientAccessInfo.Get("/db/info")
 	if err != nil {
@@ -852,7 +1006,7 @@ func ClientURLs(ctx context.Context, clientAccessInfo *clientaccess.Info, selfIP
 	if err := json.Unmarshal(resp, &memberList); err != nil {
 		return nil, memberList, err
 	}
-	ip, err := GetAdvertiseAddress(selfIP)
+	ip, err := GetAdvertiseAddress(selfIP, preferIPv6)
 	if err != nil {
 		return nil, memberList, err
 	}
@@ -868,7 +1022,7 @@ members:
 			if err != nil {
 				continue
 			}
-			if u.Hostname() == ip {
+			if sameIP(u.Hostname(), ip) && u.Port() == strconv.Itoa(selfPort) {
 				continue members
 			}
 		}
@@ -905,7 +1059,7 @@ func (e *ETCD) preSnapshotSetup(ctx context.Context, config *config.Control) err
 		if e.config == nil {
 			e.config = config
 		}
-		client, err := GetClient(ctx, e.config.Runtime, endpoint)
+		client, err := GetClient(ctx, e.config.Runtime, localEndpoint(e.config))
 		if err != nil {
 			return err
 		}
@@ -917,104 +1071,61 @@ func (e *ETCD) preSnapshotSetup(ctx context.Context, config *config.Control) err
 	return nil
 }
 
-const compressedExtension = ".zip"
-
-// compressSnapshot compresses the given snapshot and provides the
-// caller with the path to the file.
-func (e *ETCD) compressSnapshot(snapshotDir, snapshotName, snapshotPath string) (string, error) {
-	logrus.Info("Compressing etcd snapshot file: " + snapshotName)
-
-	zippedSnapshotName := snapshotName + compressedExtension
-	zipPath := filepath.Join(snapshotDir, zippedSnapshotName)
-
-	zf, err := os.Create(zipPath)
-	if err != nil {
-		return "", err
-	}
-	defer zf.Close()
-
-	zipWriter := zip.NewWriter(zf)
-	defer zipWriter.Close()
-
-	uncompressedPath := filepath.Join(snapshotDir, snapshotName)
-	fileToZip, err := os.Open(uncompressedPath)
-	if err != nil {
-		os.Remove(zipPath)
-		return "", err
-	}
-	defer fileToZip.Close()
-
-	info, err := fileToZip.Stat()
+// prepareSnapshot decrypts and decompresses the given snapshot into the given directory as
+// necessary, and returns the path to a snapshot file that can be read directly by etcd.
+func (e *ETCD) prepareSnapshot(dir, snapshotPath string) (string, error) {
+	encrypted, err := isEncryptedSnapshot(snapshotPath)
 	if err != nil {
-		os.Remove(zipPath)
 		return "", err
 	}
-
-	header, err := zip.FileInfoHeader(info)
-	if err != nil {
-		os.Remove(zipPath)
-		return "", err
-	}
-
-	header.Name = snapshotName
-	header.Method = zip.Deflate
-	header.Modified = time.Now()
-
-	writer, err := zipWriter.CreateHeader(header)
-	if err != nil {
-		os.Remove(zipPath)
-		return "", err
-	}
-	_, err = io.Copy(writer, fileToZip)
-
-	return zipPath, err
-}
-
-// decompressSnapshot decompresses the given snapshot and provides the caller
-// with the full path to the uncompressed snapshot.
-func (e *ETCD) decompressSnapshot(snapshotDir, snapshotFile string) (string, error) {
-	logrus.Info("Decompressing etcd snapshot file: " + snapshotFile)
-
-	r, err := zip.OpenReader(snapshotFile)
-	if err != nil {
-		return "", err
-	}
-	defer r.Close()
-
-	var decompressed *os.File
-	for _, sf := range r.File {
-		decompressed, err = os.OpenFile(strings.Replace(sf.Name, compressedExtension, "", -1), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, sf.Mode())
+	if encrypted {
+		passphrase, err := snapshotEncryptionKey(e.config.EtcdSnapshotKeyFile)
 		if err != nil {
-			return "", err
+			return "", errors.Wrap(err, "snapshot is encrypted")
 		}
-		defer decompressed.Close()
-
-		ss, err := sf.Open()
-		if err != nil {
+		decryptedPath := filepath.Join(dir, strings.TrimSuffix(filepath.Base(snapshotPath), encryptedExtension))
+		if err := decryptSnapshot(passphrase, snapshotPath, decryptedPath); err != nil {
 			return "", err
 		}
-		defer ss.Close()
+		snapshotPath = decryptedPath
+	}
 
-		if _, err := io.Copy(decompressed, ss); err != nil {
-			os.Remove("")
-			return "", err
+	compression, err := snapshotCompression(snapshotPath)
+	if err != nil {
+		return "", err
+	}
+	if compression != "" {
+		decompressedPath, err := decompressSnapshot(dir, snapshotPath, compression)
+		if encrypted {
+			// don't leave the decrypted archive lying around
+			os.Remove(snapshotPath)
 		}
+		return decompressedPath, err
 	}
-
-	return decompressed.Name(), nil
+	return snapshotPath, nil
 }
 
 // Snapshot attempts to save a new snapshot to the configured directory, and then clean up any old and failed
 // snapshots in excess of the retention limits. This method is used in the internal cron snapshot
-// system as well as used to do on-demand snapshots.
+// system as well as used to do on-demand snapshots. Pre-snapshot hooks are called before the snapshot is
+// taken and may prevent it; post-snapshot hooks are called with the results once it has been saved, or
+// with the error if it was prevented.
 func (e *ETCD) Snapshot(ctx context.Context, config *config.Control) error {
 	if err := e.preSnapshotSetup(ctx, config); err != nil {
 		return err
 	}
+	_, err := e.snapshot(ctx, defaultSnapshotSchedule(e.config))
+	return err
+}
+
+// snapshot takes a snapshot using the name, compression, stores and retention policy of the given schedule,
+// and returns the snapshot records saved for each store.
+func (e *ETCD) snapshot(ctx context.Context, schedule snapshotSchedule) (results []snapshotFile, err error) {
 
-	logrus.Debugf("Attempting to retrieve extra metadata from %s ConfigMap", snapshotExtraMetadataConfigMapName)
 	var extraMetadata string
-	if snapshotExtraMetadataConfigMap, err := e.config.Runtime.Core.Core().V1().ConfigMap().Get(metav1.NamespaceSystem, snapshotExtraMetadataConfigMapName, metav1.GetOptions{}); err != nil {
+	if !e.coreReady() {
+		logrus.Debugf("Core controllers are not ready; not retrieving extra metadata from %s ConfigMap", snapshotExtraMetadataConfigMapName)
+	} else if snapshotExtraMetadataConfigMap, err := e.config.Runtime.Core.Core().V1().ConfigMap().Get(metav1.NamespaceSystem, snapshotExtraMetadataConfigMapName, metav1.GetOptions{}); err != nil {
 		logrus.Debugf("Error encountered attempting to retrieve extra metadata from %s ConfigMap, error: %v", snapshotExtraMetadataConfigMapName, err)
 		extraMetadata = ""
 	} else {
@@ -1028,36 +1139,84 @@ func (e *ETCD) Snapshot(ctx context.Context, config *config.Control) error {
 		}
 	}
 
-	status, err := e.client.Status(ctx, endpoint)
+	status, err := e.client.Status(ctx, localEndpoint(e.config))
 	if err != nil {
-		return errors.Wrap(err, "failed to check etcd status for snapshot")
+		return nil, errors.Wrap(err, "failed to check etcd status for snapshot")
 	}
 
 	if status.IsLearner {
 		logrus.Warnf("Unable to take snapshot: not supported for learner")
-		return nil
+		return nil, nil
 	}
 
 	snapshotDir, err := snapshotDir(e.config, true)
 	if err != nil {
-		return errors.Wrap(err, "failed to get the snapshot dir")
+		return nil, errors.Wrap(err, "failed to get the snapshot dir")
 	}
 
-	cfg, err := getClientConfig(ctx, e.runtime, endpoint)
+	cfg, err := getClientConfig(ctx, e.runtime, localEndpoint(e.config))
 	if err != nil {
-		return errors.Wrap(err, "failed to get config for etcd snapshot")
+		return nil, errors.Wrap(err, "failed to get config for etcd snapshot")
 	}
 
 	nodeName := os.Getenv("NODE_NAME")
 	now := time.Now()
-	snapshotName := fmt.Sprintf("%s-%s-%d", e.config.EtcdSnapshotName, nodeName, now.Unix())
+	snapshotName := fmt.Sprintf("%s-%s-%d", schedule.Name, nodeName, now.Unix())
 	snapshotPath := filepath.Join(snapshotDir, snapshotName)
 
+	// Every snapshot record saved by this attempt is passed to the post-snapshot hooks, which are also
+	// notified if a pre-snapshot hook prevents the snapshot from being taken.
+	record := func(sf snapshotFile) error {
+		results = append(results, sf)
+		recordSnapshotMetrics(sf)
+		return e.addSnapshotData(ctx, sf)
+	}
+	defer func() {
+		e.postSnapshotHooks(ctx, results, err)
+	}()
+
+	if err := e.preSnapshotHooks(ctx, snapshotFile{
+		Name:     snapshotName,
+		Metadata: extraMetadata,
+		NodeName: nodeName,
+		CreatedAt: &metav1.Time{
+			Time: now,
+		},
+		Compressed: schedule.Compression != "",
+		Encrypted:  e.config.EtcdSnapshotKeyFile != "",
+	}); err != nil {
+		return nil, err
+	}
+
+	if schedule.S3 && e.config.EtcdS3Stream {
+		if err := e.streamSnapshot(ctx, cfg, schedule, snapshotName, extraMetadata, status.Header.Revision, now, record); err != nil {
+			return results, err
+		}
+		return results, e.ReconcileSnapshotData(ctx)
+	}
+
 	logrus.Infof("Saving etcd snapshot to %s", snapshotPath)
 
 	var sf *snapshotFile
 
-	if err := snapshot.NewV3(nil).Save(ctx, *cfg, snapshotPath); err != nil {
+	// Compressed snapshots are compressed as they are received, rather than saved and then compressed.
+	saveStart := time.Now()
+	saveErr := func() error {
+		if schedule.Compression == "" {
+			return snapshot.NewV3(nil).Save(ctx, *cfg, snapshotPath)
+		}
+		compressedPath := snapshotPath + compressedExtensions[schedule.Compression]
+		size, compressedSize, err := saveCompressedSnapshot(ctx, cfg, schedule.Compression, snapshotName, compressedPath)
+		if err != nil {
+			return err
+		}
+		recordCompressionRatio(size, compressedSize)
+		snapshotPath = compressedPath
+		logrus.Info("Compressed snapshot: " + snapshotPath)
+		return nil
+	}()
+	if saveErr != nil {
+		observeSnapshotDuration(snapshotSaveDuration, saveStart, string(failedSnapshotStatus))
 		sf = &snapshotFile{
 			Name:     snapshotName,
 			Location: "",
@@ -1067,100 +1226,176 @@ func (e *ETCD) Snapshot(ctx context.Context, config *config.Control) error {
 				Time: now,
 			},
 			Status:     failedSnapshotStatus,
-			Message:    base64.StdEncoding.EncodeToString([]byte(err.Error())),
+			Message:    base64.StdEncoding.EncodeToString([]byte(saveErr.Error())),
 			Size:       0,
-			Compressed: e.config.EtcdSnapshotCompress,
+			Compressed: schedule.Compression != "",
 		}
-		logrus.Errorf("Failed to take etcd snapshot: %v", err)
-		if err := e.addSnapshotData(*sf); err != nil {
-			return errors.Wrap(err, "failed to save local snapshot failure data to configmap")
+		logrus.Errorf("Failed to take etcd snapshot: %v", saveErr)
+		if err := record(*sf); err != nil {
+			return results, errors.Wrap(err, "failed to record local snapshot failure")
 		}
+	} else {
+		observeSnapshotDuration(snapshotSaveDuration, saveStart, string(successfulSnapshotStatus))
 	}
 
-	if e.config.EtcdSnapshotCompress {
-		zipPath, err := e.compressSnapshot(snapshotDir, snapshotName, snapshotPath)
+	if sf == nil && e.config.EtcdSnapshotKeyFile != "" {
+		passphrase, err := snapshotEncryptionKey(e.config.EtcdSnapshotKeyFile)
 		if err != nil {
-			return err
+			return results, err
+		}
+		encryptedPath, err := encryptSnapshot(passphrase, snapshotPath)
+		if err != nil {
+			return results, err
 		}
 		if err := os.Remove(snapshotPath); err != nil {
-			return err
+			return results, err
 		}
-		snapshotPath = zipPath
-		logrus.Info("Compressed snapshot: " + snapshotPath)
+		snapshotPath = encryptedPath
+		logrus.Info("Encrypted snapshot: " + snapshotPath)
 	}
 
 	// If the snapshot attempt was successful, sf will be nil as we did not set it.
 	if sf == nil {
-		f, err := os.Stat(snapshotPath)
+		checksum, err := snapshotChecksum(snapshotPath)
 		if err != nil {
-			return errors.Wrap(err, "unable to retrieve snapshot information from local snapshot")
+			return results, errors.Wrap(err, "failed to calculate snapshot checksum")
 		}
-		sf = &snapshotFile{
-			Name:     f.Name(),
-			Metadata: extraMetadata,
-			Location: "file://" + snapshotPath,
-			NodeName: nodeName,
-			CreatedAt: &metav1.Time{
-				Time: f.ModTime(),
-			},
-			Status:     successfulSnapshotStatus,
-			Size:       f.Size(),
-			Compressed: e.config.EtcdSnapshotCompress,
+		if err := writeChecksumFile(snapshotPath, checksum); err != nil {
+			return results, errors.Wrap(err, "failed to write snapshot checksum file")
 		}
 
-		if err := e.addSnapshotData(*sf); err != nil {
-			return errors.Wrap(err, "failed to save local snapshot data to configmap")
-		}
+		stores, storeErrs := e.scheduleStores(ctx, schedule)
 
-		if err := snapshotRetention(e.config.EtcdSnapshotRetention, e.config.EtcdSnapshotName, snapshotDir); err != nil {
-			return errors.Wrap(err, "failed to apply local snapshot retention policy")
+		// Record a failure for any remote store that could not be initialized.
+		for name, err := range storeErrs {
+			logrus.Warnf("Unable to initialize %s snapshot store: %v", name, err)
+			sf := &snapshotFile{
+				Name:     filepath.Base(snapshotPath),
+				Metadata: extraMetadata,
+				NodeName: name,
+				CreatedAt: &metav1.Time{
+					Time: now,
+				},
+				Message: base64.StdEncoding.EncodeToString([]byte(err.Error())),
+				Size:    0,
+				Status:  failedSnapshotStatus,
+			}
+			if name == s3StoreName {
+				sf.S3 = newS3Config(e.config)
+			}
+			if err := record(*sf); err != nil {
+				return results, errors.Wrap(err, "failed to record snapshot failure")
+			}
 		}
 
-		if e.config.EtcdS3 {
-			logrus.Infof("Saving etcd snapshot %s to S3", snapshotName)
-			// Set sf to nil so that we can attempt to now upload the snapshot to S3 if needed
-			sf = nil
-			if err := e.initS3IfNil(ctx); err != nil {
-				logrus.Warnf("Unable to initialize S3 client: %v", err)
-				sf = &snapshotFile{
-					Name:     filepath.Base(snapshotPath),
-					Metadata: extraMetadata,
-					NodeName: "s3",
-					CreatedAt: &metav1.Time{
-						Time: now,
-					},
-					Message: base64.StdEncoding.EncodeToString([]byte(err.Error())),
-					Size:    0,
-					Status:  failedSnapshotStatus,
-					S3: &s3Config{
-						Endpoint:      e.config.EtcdS3Endpoint,
-						EndpointCA:    e.config.EtcdS3EndpointCA,
-						SkipSSLVerify: e.config.EtcdS3SkipSSLVerify,
-						Bucket:        e.config.EtcdS3BucketName,
-						Region:        e.config.EtcdS3Region,
-						Folder:        e.config.EtcdS3Folder,
-						Insecure:      e.config.EtcdS3Insecure,
-					},
-				}
+		// The local store is always first, and is the source for all other stores.
+		for _, store := range stores {
+			if store.Name() != nodeName {
+				logrus.Infof("Saving etcd snapshot %s to %s", snapshotName, store.Name())
 			}
-			// sf should be nil if we were able to successfully initialize the S3 client.
-			if sf == nil {
-				sf, err = e.s3.upload(ctx, snapshotPath, extraMetadata, now)
-				if err != nil {
-					return err
-				}
-				logrus.Infof("S3 upload complete for %s", snapshotName)
-				if err := e.s3.snapshotRetention(ctx); err != nil {
-					return errors.Wrap(err, "failed to apply s3 snapshot retention policy")
-				}
+			uploadStart := time.Now()
+			sf, err := store.Upload(ctx, snapshotPath, extraMetadata, status.Header.Revision, now)
+			if err != nil {
+				observeSnapshotDuration(snapshotUploadDuration, uploadStart, snapshotDestination(store.Name()), string(failedSnapshotStatus))
+				return results, err
+			}
+			observeSnapshotDuration(snapshotUploadDuration, uploadStart, snapshotDestination(store.Name()), string(sf.Status))
+			if err := record(*sf); err != nil {
+				return results, errors.Wrapf(err, "failed to record %s snapshot", store.Name())
 			}
-			if err := e.addSnapshotData(*sf); err != nil {
-				return errors.Wrap(err, "failed to save snapshot data to configmap")
+			if err := store.Retention(ctx, schedule.Policy, schedule.Name); err != nil {
+				return results, errors.Wrapf(err, "failed to apply %s snapshot retention policy", store.Name())
 			}
 		}
 	}
 
-	return e.ReconcileSnapshotData(ctx)
+	return results, e.ReconcileSnapshotData(ctx)
+}
+
+// streamSnapshot takes a snapshot and streams it through compression and encryption, as configured,
+// directly into S3 without saving it to the local snapshot directory. Streaming cannot be combined with
+// the mirror directory, as there is no local file to copy into it. A failure to take or upload
+// the snapshot is recorded as an ETCDSnapshotFile using the given record function.
+func (e *ETCD) streamSnapshot(ctx context.Context, cfg *clientv3.Config, schedule snapshotSchedule, snapshotName, extraMetadata string, revision int64, now time.Time, record func(snapshotFile) error) error {
+	var passphrase string
+	if e.config.EtcdSnapshotKeyFile != "" {
+		var err error
+		if passphrase, err = snapshotEncryptionKey(e.config.EtcdSnapshotKeyFile); err != nil {
+			return err
+		}
+	}
+
+	addFailure := func(err error) error {
+		sf := &snapshotFile{
+			Name:     snapshotName,
+			Metadata: extraMetadata,
+			NodeName: s3StoreName,
+			CreatedAt: &metav1.Time{
+				Time: now,
+			},
+			Message: base64.StdEncoding.EncodeToString([]byte(err.Error())),
+			Size:    0,
+			Status:  failedSnapshotStatus,
+			S3:      newS3Config(e.config),
+		}
+		if err := record(*sf); err != nil {
+			return errors.Wrap(err, "failed to record snapshot failure")
+		}
+		return nil
+	}
+
+	if err := e.initS3IfNil(ctx); err != nil {
+		logrus.Warnf("Unable to initialize S3 client: %v", err)
+		return addFailure(err)
+	}
+
+	client, err := clientv3.New(*cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to create etcd client for snapshot")
+	}
+	defer client.Close()
+
+	logrus.Infof("Streaming etcd snapshot %s to S3", snapshotName)
+	r, err := client.Snapshot(ctx)
+	if err != nil {
+		logrus.Errorf("Failed to take etcd snapshot: %v", err)
+		return addFailure(err)
+	}
+	// closing the final reader stops any stages that have not yet finished
+	defer func() { r.Close() }()
+
+	var in *countingReader
+	if schedule.Compression != "" {
+		in = &countingReader{ReadCloser: r}
+		r = compressStream(in, schedule.Compression, snapshotName)
+		snapshotName += compressedExtensions[schedule.Compression]
+	}
+	if passphrase != "" {
+		er, err := encryptStream(passphrase, r)
+		if err != nil {
+			return err
+		}
+		r = er
+		snapshotName += encryptedExtension
+	}
+
+	uploadStart := time.Now()
+	sf, err := e.s3.UploadStream(ctx, snapshotName, r, extraMetadata, revision, now)
+	if err != nil {
+		observeSnapshotDuration(snapshotUploadDuration, uploadStart, s3StoreName, string(failedSnapshotStatus))
+		return err
+	}
+	observeSnapshotDuration(snapshotUploadDuration, uploadStart, s3StoreName, string(sf.Status))
+	if in != nil && passphrase == "" {
+		recordCompressionRatio(in.n, sf.Size)
+	}
+	if err := record(*sf); err != nil {
+		return errors.Wrap(err, "failed to record s3 snapshot")
+	}
+	if err := e.s3.Retention(ctx, schedule.Policy, schedule.Name); err != nil {
+		return errors.Wrap(err, "failed to apply s3 snapshot retention policy")
+	}
+	return nil
 }
 
 type s3Config struct {
@@ -1195,103 +1430,9 @@ type snapshotFile struct {
 	Status     snapshotStatus `json:"status,omitempty"`
 	S3         *s3Config      `json:"s3Config,omitempty"`
 	Compressed bool           `json:"compressed"`
-}
-
-// listLocalSnapshots provides a list of the currently stored
-// snapshots on disk along with their relevant
-// metadata.
-func (e *ETCD) listLocalSnapshots() (map[string]snapshotFile, error) {
-	snapshots := make(map[string]snapshotFile)
-	snapshotDir, err := snapshotDir(e.config, true)
-	if err != nil {
-		return snapshots, errors.Wrap(err, "failed to get the snapshot dir")
-	}
-
-	files, err := ioutil.ReadDir(snapshotDir)
-	if err != nil {
-		return nil, err
-	}
-
-	nodeName := os.Getenv("NODE_NAME")
-
-	for _, f := range files {
-		sf := snapshotFile{
-			Name:     f.Name(),
-			Location: "file://" + filepath.Join(snapshotDir, f.Name()),
-			NodeName: nodeName,
-			CreatedAt: &metav1.Time{
-				Time: f.ModTime(),
-			},
-			Size:   f.Size(),
-			Status: successfulSnapshotStatus,
-		}
-		sfKey := generateSnapshotConfigMapKey(sf)
-		snapshots[sfKey] = sf
-	}
-
-	return snapshots, nil
-}
-
-// listS3Snapshots provides a list of currently stored
-// snapshots in S3 along with their relevant
-// metadata.
-func (e *ETCD) listS3Snapshots(ctx context.Context) (map[string]snapshotFile, error) {
-	snapshots := make(map[string]snapshotFile)
-
-	if e.config.EtcdS3 {
-		ctx, cancel := context.WithCancel(ctx)
-		defer cancel()
-
-		if err := e.initS3IfNil(ctx); err != nil {
-			return nil, err
-		}
-
-		var loo minio.ListObjectsOptions
-		if e.config.EtcdS3Folder != "" {
-			loo = minio.ListObjectsOptions{
-				Prefix:    e.config.EtcdS3Folder,
-				Recursive: true,
-			}
-		}
-
-		objects := e.s3.client.ListObjects(ctx, e.config.EtcdS3BucketName, loo)
-
-		for obj := range objects {
-			if obj.Err != nil {
-				return nil, obj.Err
-			}
-			if obj.Size == 0 {
-				continue
-			}
-
-			ca, err := time.Parse(time.RFC3339, obj.LastModified.Format(time.RFC3339))
-			if err != nil {
-				return nil, err
-			}
-
-			sf := snapshotFile{
-				Name:     filepath.Base(obj.Key),
-				NodeName: "s3",
-				CreatedAt: &metav1.Time{
-					Time: ca,
-				},
-				Size: obj.Size,
-				S3: &s3Config{
-					Endpoint:      e.config.EtcdS3Endpoint,
-					EndpointCA:    e.config.EtcdS3EndpointCA,
-					SkipSSLVerify: e.config.EtcdS3SkipSSLVerify,
-					Bucket:        e.config.EtcdS3BucketName,
-					Region:        e.config.EtcdS3Region,
-					Folder:        e.config.EtcdS3Folder,
-					Insecure:      e.config.EtcdS3Insecure,
-				},
-				Status: successfulSnapshotStatus,
-			}
-			sfKey := generateSnapshotConfigMapKey(sf)
-			snapshots[sfKey] = sf
-		}
-	}
-	return snapshots, nil
+	// Checksum contains the hex-encoded SHA-256 digest of the snapshot file.
+	Checksum  string `json:"checksum,omitempty"`
+	Encrypted bool   `json:"encrypted,omitempty"`
 }
 
 // initS3IfNil initializes the S3 client
@@ -1311,337 +1452,84 @@ func (e *ETCD) initS3IfNil(ctx context.Context) error {
 // PruneSnapshots performs a retention run with the given
 // retention duration and removes expired snapshots.
 func (e *ETCD) PruneSnapshots(ctx context.Context) error {
-	snapshotDir, err := snapshotDir(e.config, false)
-	if err != nil {
-		return errors.Wrap(err, "failed to get the snapshot dir")
-	}
-	if err := snapshotRetention(e.config.EtcdSnapshotRetention, e.config.EtcdSnapshotName, snapshotDir); err != nil {
-		logrus.Errorf("Error applying snapshot retention policy: %v", err)
+	stores, storeErrs := e.snapshotStores(ctx)
+	for name, err := range storeErrs {
+		logrus.Warnf("Unable to initialize %s snapshot store during prune: %v", name, err)
 	}
 
-	if e.config.EtcdS3 {
-		if err := e.initS3IfNil(ctx); err != nil {
-			logrus.Warnf("Unable to initialize S3 client during prune: %v", err)
-		} else {
-			if err := e.s3.snapshotRetention(ctx); err != nil {
-				logrus.Errorf("Error applying S3 snapshot retention policy: %v", err)
-			}
+	for _, store := range stores {
+		if err := store.Retention(ctx, newRetentionPolicy(e.config), e.config.EtcdSnapshotName); err != nil {
+			logrus.Errorf("Error applying %s snapshot retention policy: %v", store.Name(), err)
 		}
 	}
 
 	return e.ReconcileSnapshotData(ctx)
 }
 
-// ListSnapshots is an exported wrapper method that wraps an
-// unexported method of the same name.
+// ListSnapshots returns the snapshots held by S3 if it is enabled, or otherwise
+// by the local snapshot directory and the mirror directory.
 func (e *ETCD) ListSnapshots(ctx context.Context) (map[string]snapshotFile, error) {
-	if e.config.EtcdS3 {
-		return e.listS3Snapshots(ctx)
-	}
-	return e.listLocalSnapshots()
-}
+	snapshots := make(map[string]snapshotFile)
 
-// deleteSnapshots removes the given snapshots from
-// either local storage or S3.
-func (e *ETCD) DeleteSnapshots(ctx context.Context, snapshots []string) error {
-	snapshotDir, err := snapshotDir(e.config, false)
+	stores, err := e.primaryStores(ctx)
 	if err != nil {
-		return errors.Wrap(err, "failed to get the snapshot dir")
+		return nil, err
 	}
 
-	if e.config.EtcdS3 {
-		logrus.Info("Removing the given etcd snapshot(s) from S3")
-		logrus.Debugf("Removing the given etcd snapshot(s) from S3: %v", snapshots)
-
-		if e.initS3IfNil(ctx); err != nil {
-			return err
+	for _, store := range stores {
+		storeSnapshots, err := store.List(ctx)
+		if err != nil {
+			return nil, err
 		}
-
-		objectsCh := make(chan minio.ObjectInfo)
-
-		ctx, cancel := context.WithTimeout(ctx, e.config.EtcdS3Timeout)
-		defer cancel()
-
-		go func() {
-			defer close(objectsCh)
-
-			opts := minio.ListObjectsOptions{
-				Recursive: true,
-			}
-
-			for obj := range e.s3.client.ListObjects(ctx, e.config.EtcdS3BucketName, opts) {
-				if obj.Err != nil {
-					logrus.Error(obj.Err)
-					return
-				}
-
-				// iterate through the given snapshots and only
-				// add them to the channel for remove if they're
-				// actually found from the bucket listing.
-				for _, snapshot := range snapshots {
-					if snapshot == obj.Key {
-						objectsCh <- obj
-					}
-				}
-			}
-		}()
-
-		for {
-			select {
-			case <-ctx.Done():
-				logrus.Errorf("Unable to delete snapshot: %v", ctx.Err())
-				return e.ReconcileSnapshotData(ctx)
-			case <-time.After(time.Millisecond * 100):
-				continue
-			case err, ok := <-e.s3.client.RemoveObjects(ctx, e.config.EtcdS3BucketName, objectsCh, minio.RemoveObjectsOptions{}):
-				if err.Err != nil {
-					logrus.Errorf("Unable to delete snapshot: %v", err.Err)
-				}
-				if !ok {
-					return e.ReconcileSnapshotData(ctx)
-				}
-			}
+		for k, v := range storeSnapshots {
+			snapshots[k] = v
 		}
 	}
+	return snapshots, nil
+}
 
-	logrus.Info("Removing the given locally stored etcd snapshot(s)")
-	logrus.Debugf("Attempting to remove the given locally stored etcd snapshot(s): %v", snapshots)
+// DeleteSnapshots removes the given snapshots from S3 if it is enabled, or
+// otherwise from the local snapshot directory and the mirror directory.
+func (e *ETCD) DeleteSnapshots(ctx context.Context, snapshots []string) error {
+	stores, err := e.primaryStores(ctx)
+	if err != nil {
+		return err
+	}
 
-	for _, s := range snapshots {
-		// check if the given snapshot exists. If it does,
-		// remove it, otherwise continue.
-		sf := filepath.Join(snapshotDir, s)
-		if _, err := os.Stat(sf); os.IsNotExist(err) {
-			logrus.Infof("Snapshot %s, does not exist", s)
-			continue
-		}
-		if err := os.Remove(sf); err != nil {
+	for _, store := range stores {
+		if err := store.Delete(ctx, snapshots); err != nil {
 			return err
 		}
-		logrus.Debug("Removed snapshot ", s)
 	}
 
 	return e.ReconcileSnapshotData(ctx)
 }
 
-// AddSnapshotData adds the given snapshot file information to the snapshot configmap, using the existing extra metadata
-// available at the time.
-func (e *ETCD) addSnapshotData(sf snapshotFile) error {
-	return retry.OnError(retry.DefaultBackoff, func(err error) bool {
-		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
-	}, func() error {
-		// make sure the core.Factory is initialized. There can
-		// be a race between this core code startup.
-		for e.config.Runtime.Core == nil {
-			runtime.Gosched()
-		}
-		snapshotConfigMap, getErr := e.config.Runtime.Core.Core().V1().ConfigMap().Get(metav1.NamespaceSystem, snapshotConfigMapName, metav1.GetOptions{})
-
-		marshalledSnapshotFile, err := json.Marshal(sf)
-		if err != nil {
-			return err
-		}
-		if apierrors.IsNotFound(getErr) {
-			cm := v1.ConfigMap{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      snapshotConfigMapName,
-					Namespace: metav1.NamespaceSystem,
-				},
-				Data: map[string]string{sf.Name: string(marshalledSnapshotFile)},
-			}
-			_, err := e.config.Runtime.Core.Core().V1().ConfigMap().Create(&cm)
-			return err
-		}
-
-		if snapshotConfigMap.Data == nil {
-			snapshotConfigMap.Data = make(map[string]string)
-		}
-
-		sfKey := generateSnapshotConfigMapKey(sf)
-		snapshotConfigMap.Data[sfKey] = string(marshalledSnapshotFile)
-
-		_, err = e.config.Runtime.Core.Core().V1().ConfigMap().Update(snapshotConfigMap)
-		return err
-	})
-}
-
 func generateSnapshotConfigMapKey(sf snapshotFile) string {
 	var sfKey string
-	if sf.NodeName == "s3" {
-		sfKey = "s3-" + sf.Name
-	} else {
+	switch sf.NodeName {
+	case s3StoreName, mirrorStoreName:
+		sfKey = sf.NodeName + "-" + sf.Name
+	default:
 		sfKey = "local-" + sf.Name
 	}
 	return sfKey
 }
 
-// ReconcileSnapshotData reconciles snapshot data in the snapshot ConfigMap.
-// It will reconcile snapshot data from disk locally always, and if S3 is enabled, will attempt to list S3 snapshots
-// and reconcile snapshots from S3. Notably,
-func (e *ETCD) ReconcileSnapshotData(ctx context.Context) error {
-	logrus.Infof("Reconciling etcd snapshot data in %s ConfigMap", snapshotConfigMapName)
-	defer logrus.Infof("Reconciliation of snapshot data in %s ConfigMap complete", snapshotConfigMapName)
-	return retry.OnError(retry.DefaultBackoff, func(err error) bool {
-		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
-	}, func() error {
-		// make sure the core.Factory is initialize. There can
-		// be a race between this core code startup.
-		for e.config.Runtime.Core == nil {
-			runtime.Gosched()
-		}
-
-		logrus.Debug("core.Factory is initialized")
-
-		snapshotConfigMap, getErr := e.config.Runtime.Core.Core().V1().ConfigMap().Get(metav1.NamespaceSystem, snapshotConfigMapName, metav1.GetOptions{})
-		if apierrors.IsNotFound(getErr) {
-			// Can't reconcile what doesn't exist.
-			return errors.New("No snapshot configmap found")
-		}
-
-		logrus.Debugf("Attempting to reconcile etcd snapshot data for configmap generation %d", snapshotConfigMap.Generation)
-
-		// if the snapshot config map data is nil, no need to reconcile.
-		if snapshotConfigMap.Data == nil {
-			return nil
-		}
-
-		snapshotFiles, err := e.listLocalSnapshots()
-		if err != nil {
-			return err
-		}
-
-		// s3ListSuccessful is set to true if we are successful at listing snapshots from S3 to eliminate accidental
-		// clobbering of S3 snapshots in the configmap due to misconfigured S3 credentials/details
-		s3ListSuccessful := false
-
-		if e.config.EtcdS3 {
-			if s3Snapshots, err := e.listS3Snapshots(ctx); err != nil {
-				logrus.Errorf("error retrieving S3 snapshots for reconciliation: %v", err)
-			} else {
-				for k, v := range s3Snapshots {
-					snapshotFiles[k] = v
-				}
-				s3ListSuccessful = true
-			}
-		}
-
-		nodeName := os.Getenv("NODE_NAME")
-
-		// deletedSnapshots is a map[string]string where key is the configmap key and the value is the marshalled snapshot file
-		// it will be populated below with snapshots that are either from S3 or on the local node. Notably, deletedSnapshots will
-		// not contain snapshots that are in the "failed" status
-		deletedSnapshots := make(map[string]string)
-		// failedSnapshots is a slice of unmarshaled snapshot files sourced from the configmap
-		// These are stored unmarshaled so we can sort based on name.
-		var failedSnapshots []snapshotFile
-		var failedS3Snapshots []snapshotFile
-
-		// remove entries for this node and s3 (if S3 is enabled) only
-		for k, v := range snapshotConfigMap.Data {
-			var sf snapshotFile
-			if err := json.Unmarshal([]byte(v), &sf); err != nil {
-				return err
-			}
-			if (sf.NodeName == nodeName || (sf.NodeName == "s3" && s3ListSuccessful)) && sf.Status != failedSnapshotStatus {
-				// Only delete the snapshot if the snapshot was not failed
-				// sf.Status != FailedSnapshotStatus is intentional, as it is possible we are reconciling snapshots stored from older versions that did not set status
-				deletedSnapshots[generateSnapshotConfigMapKey(sf)] = v // store a copy of the snapshot
-				delete(snapshotConfigMap.Data, k)
-			} else if sf.Status == failedSnapshotStatus && sf.NodeName == nodeName && e.config.EtcdSnapshotRetention >= 1 {
-				// Handle locally failed snapshots.
-				failedSnapshots = append(failedSnapshots, sf)
-				delete(snapshotConfigMap.Data, k)
-			} else if sf.Status == failedSnapshotStatus && e.config.EtcdS3 && sf.NodeName == "s3" && strings.HasPrefix(sf.Name, e.config.EtcdSnapshotName+"-"+nodeName) && e.config.EtcdSnapshotRetention >= 1 {
-				// If we're operating against S3, we can clean up failed S3 snapshots that failed on this node.
-				failedS3Snapshots = append(failedS3Snapshots, sf)
-				delete(snapshotConfigMap.Data, k)
-			}
-		}
-
-		// Apply the failed snapshot retention policy to locally failed snapshots
-		if len(failedSnapshots) > 0 && e.config.EtcdSnapshotRetention >= 1 {
-			sort.Slice(failedSnapshots, func(i, j int) bool {
-				return failedSnapshots[i].Name > failedSnapshots[j].Name
-			})
-
-			var keepCount int
-			if e.config.EtcdSnapshotRetention >= len(failedSnapshots) {
-				keepCount = len(failedSnapshots)
-			} else {
-				keepCount = e.config.EtcdSnapshotRetention
-			}
-			for _, dfs := range failedSnapshots[:keepCount] {
-				sfKey := generateSnapshotConfigMapKey(dfs)
-				marshalledSnapshot, err := json.Marshal(dfs)
-				if err != nil {
-					logrus.Errorf("unable to marshal snapshot to store in configmap %v", err)
-				} else {
-					snapshotConfigMap.Data[sfKey] = string(marshalledSnapshot)
-				}
-			}
-		}
-
-		// Apply the failed snapshot retention policy to the S3 snapshots
-		if len(failedS3Snapshots) > 0 && e.config.EtcdSnapshotRetention >= 1 {
-			sort.Slice(failedS3Snapshots, func(i, j int) bool {
-				return failedS3Snapshots[i].Name > failedS3Snapshots[j].Name
-			})
-
-			var keepCount int
-			if e.config.EtcdSnapshotRetention >= len(failedS3Snapshots) {
-				keepCount = len(failedS3Snapshots)
-			} else {
-				keepCount = e.config.EtcdSnapshotRetention
-			}
-			for _, dfs := range failedS3Snapshots[:keepCount] {
-				sfKey := generateSnapshotConfigMapKey(dfs)
-				marshalledSnapshot, err := json.Marshal(dfs)
-				if err != nil {
-					logrus.Errorf("unable to marshal snapshot to store in configmap %v", err)
-				} else {
-					snapshotConfigMap.Data[sfKey] = string(marshalledSnapshot)
-				}
-			}
-		}
-
-		// save the local entries to the ConfigMap if they are still on disk or in S3.
-		for _, snapshot := range snapshotFiles {
-			var sf snapshotFile
-			sfKey := generateSnapshotConfigMapKey(snapshot)
-			if v, ok := deletedSnapshots[sfKey]; ok {
-				// use the snapshot file we have from the existing configmap, and unmarshal it so we can manipulate it
-				if err := json.Unmarshal([]byte(v), &sf); err != nil {
-					logrus.Errorf("error unmarshaling snapshot file: %v", err)
-					// use the snapshot with info we sourced from disk/S3 (will be missing metadata, but something is better than nothing)
-					sf = snapshot
-				}
-			} else {
-				sf = snapshot
-			}
-
-			sf.Status = successfulSnapshotStatus // if the snapshot is on disk or in S3, it was successful.
-
-			marshalledSnapshot, err := json.Marshal(sf)
-			if err != nil {
-				logrus.Warnf("unable to marshal snapshot metadata %s to store in configmap, received error: %v", sf.Name, err)
-			} else {
-				snapshotConfigMap.Data[sfKey] = string(marshalledSnapshot)
-			}
+// setSnapshotFunction schedules snapshots at the configured interval, and at the interval of
+// each additional snapshot schedule.
+func (e *ETCD) setSnapshotFunction(ctx context.Context) {
+	if e.config.EtcdSnapshotCron != "" {
+		if err := e.addScheduledSnapshot(ctx, e.config.EtcdSnapshotCron, defaultSnapshotSchedule(e.config)); err != nil {
+			logrus.Errorf("Failed to add snapshot schedule: %v", err)
 		}
+	}
 
-		logrus.Debugf("Updating snapshot ConfigMap (%s) with %d entries", snapshotConfigMapName, len(snapshotConfigMap.Data))
-		_, err = e.config.Runtime.Core.Core().V1().ConfigMap().Update(snapshotConfigMap)
-		return err
-	})
-}
-
-// setSnapshotFunction schedules snapshots at the configured interval.
-func (e *ETCD) setSnapshotFunction(ctx context.Context) {
-	e.cron.AddFunc(e.config.EtcdSnapshotCron, func() {
-		if err := e.Snapshot(ctx, e.config); err != nil {
-			logrus.Error(err)
+	for _, s := range e.config.EtcdSnapshotSchedules {
+		if err := e.addScheduledSnapshot(ctx, s.Cron, newSnapshotSchedule(e.config, s)); err != nil {
+			logrus.Errorf("Failed to add snapshot schedule %s: %v", s.Name, err)
 		}
-	})
+	}
 }
 
 // Restore performs a restore of the ETCD datastore from
@@ -1653,26 +1541,25 @@ func (e *ETCD) Restore(ctx context.Context) error {
 	if e.config.ClusterResetRestorePath == "" {
 		return errors.New("no etcd restore path was specified")
 	}
-	// make sure snapshot exists before restoration
+	// make sure snapshot exists and is intact before restoration
 	if _, err := os.Stat(e.config.ClusterResetRestorePath); err != nil {
 		return err
 	}
+	if _, err := verifySnapshotChecksum(e.config.ClusterResetRestorePath); err != nil {
+		return err
+	}
 
-	var restorePath string
-	if strings.HasSuffix(e.config.ClusterResetRestorePath, compressedExtension) {
-		snapshotDir, err := snapshotDir(e.config, true)
-		if err != nil {
-			return errors.Wrap(err, "failed to get the snapshot dir")
-		}
-
-		decompressSnapshot, err := e.decompressSnapshot(snapshotDir, e.config.ClusterResetRestorePath)
-		if err != nil {
-			return err
-		}
+	snapshotDir, err := snapshotDir(e.config, true)
+	if err != nil {
+		return errors.Wrap(err, "failed to get the snapshot dir")
+	}
 
-		restorePath = decompressSnapshot
-	} else {
-		restorePath = e.config.ClusterResetRestorePath
+	restorePath, err := e.prepareSnapshot(snapshotDir, e.config.ClusterResetRestorePath)
+	if err != nil {
+		return err
+	}
+	if restorePath != e.config.ClusterResetRestorePath {
+		defer os.Remove(restorePath)
 	}
 
 	// move the data directory to a temp path
@@ -1692,42 +1579,42 @@ func (e *ETCD) Restore(ctx context.Context) error {
 	})
 }
 
-// snapshotRetention iterates through the snapshots and removes the oldest
-// leaving the desired number of snapshots.
-func snapshotRetention(retention int, snapshotPrefix string, snapshotDir string) error {
-	if retention < 1 {
+// snapshotRetention iterates through the snapshots taken by the given node, or by all nodes
+// if no node name is given, and removes those that are not kept by the retention policy. Removed
+// snapshots are counted against the given destination.
+func snapshotRetention(policy retentionPolicy, destination, snapshotPrefix, nodeName, snapshotDir string) error {
+	if !policy.enabled() {
 		return nil
 	}
 
-	nodeName := os.Getenv("NODE_NAME")
-	logrus.Infof("Applying local snapshot retention policy: retention: %d, snapshotPrefix: %s, directory: %s", retention, snapshotPrefix+"-"+nodeName, snapshotDir)
+	logrus.Infof("Applying local snapshot retention policy: %s, snapshotPrefix: %s, directory: %s", policy, snapshotPrefix+"-"+nodeName, snapshotDir)
 
-	var snapshotFiles []os.FileInfo
+	var candidates []retentionCandidate
 	if err := filepath.Walk(snapshotDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if strings.HasPrefix(info.Name(), snapshotPrefix+"-"+nodeName) {
-			snapshotFiles = append(snapshotFiles, info)
+		if strings.HasPrefix(info.Name(), snapshotPrefix+"-"+nodeName) && isSnapshotFile(info.Name()) {
+			candidates = append(candidates, retentionCandidate{
+				Name: info.Name(),
+				Time: snapshotTime(info.Name(), info.ModTime()),
+			})
 		}
 		return nil
 	}); err != nil {
 		return err
 	}
-	if len(snapshotFiles) <= retention {
-		return nil
-	}
-	sort.Slice(snapshotFiles, func(i, j int) bool {
-		return snapshotFiles[i].Name() < snapshotFiles[j].Name()
-	})
 
-	delCount := len(snapshotFiles) - retention
-	for _, df := range snapshotFiles[:delCount] {
-		snapshotPath := filepath.Join(snapshotDir, df.Name())
+	for _, name := range policy.expired(candidates, time.Now()) {
+		snapshotPath := filepath.Join(snapshotDir, name)
 		logrus.Infof("Removing local snapshot %s", snapshotPath)
 		if err := os.Remove(snapshotPath); err != nil {
 			return err
 		}
+		if err := os.Remove(snapshotPath + checksumExtension); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		snapshotRetentionDeletions.WithLabelValues(destination).Inc()
 	}
 
 	return nil
@@ -1768,7 +1655,7 @@ func backupDirWithRetention(dir string, maxBackupRetention int) (string, error)
 // GetAPIServerURLFromETCD will try to fetch the version.Program/apiaddresses key from etcd
 // when it succeed it will parse the first address in the list and return back an address
 func GetAPIServerURLFromETCD(ctx context.Context, cfg *config.Control) (string, error) {
-	cl, err := GetClient(ctx, cfg.Runtime, endpoint)
+	cl, err := GetClient(ctx, cfg.Runtime, localEndpoint(cfg))
 	if err != nil {
 		return "", err
 	}
@@ -3,6 +3,7 @@ package etcd
 import (
 	"context"
 	"net/url"
+	"strconv"
 
 	"github.com/pkg/errors"
 	"github.com/wangxiaochuang/k3s/pkg/agent/loadbalancer"
@@ -21,6 +22,13 @@ func NewETCDProxy(ctx context.Context, enabled bool, dataDir, etcdURL string) (P
 		return nil, errors.Wrap(err, "failed to parse etcd client URL")
 	}
 
+	port := DefaultClientPort
+	if u.Port() != "" {
+		if port, err = strconv.Atoi(u.Port()); err != nil {
+			return nil, errors.Wrap(err, "failed to parse etcd client URL port")
+		}
+	}
+
 	e := &etcdproxy{
 		dataDir:        dataDir,
 		initialETCDURL: etcdURL,
@@ -28,7 +36,7 @@ func NewETCDProxy(ctx context.Context, enabled bool, dataDir, etcdURL string) (P
 	}
 
 	if enabled {
-		lb, err := loadbalancer.New(ctx, dataDir, loadbalancer.ETCDServerServiceName, etcdURL, 2379)
+		lb, err := loadbalancer.New(ctx, dataDir, loadbalancer.ETCDServerServiceName, etcdURL, port)
 		if err != nil {
 			return nil, err
 		}
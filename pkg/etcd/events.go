@@ -0,0 +1,35 @@
+package etcd
+
+import (
+	"fmt"
+
+	"github.com/wangxiaochuang/k3s/pkg/version"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// recordNodeEvent records an event about etcd against the given node. The core controllers must be ready.
+func (e *ETCD) recordNodeEvent(nodeName, eventType, reason, message string) error {
+	now := metav1.Now()
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", nodeName, now.UnixNano()),
+			Namespace: metav1.NamespaceDefault,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind: "Node",
+			Name: nodeName,
+			UID:  types.UID(nodeName),
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         v1.EventSource{Component: version.Program + "-etcd", Host: e.config.ServerNodeName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err := e.config.Runtime.Core.Core().V1().Event().Create(event)
+	return err
+}
@@ -0,0 +1,196 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	jsonserializer "k8s.io/apimachinery/pkg/runtime/serializer/json"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+const (
+	// encryptedValuePrefix marks values encrypted by the apiserver, which cannot be decoded here.
+	encryptedValuePrefix = "k8s:enc:"
+
+	ExtractFormatYAML = "yaml"
+	ExtractFormatJSON = "json"
+)
+
+// ObjectSelector selects the Kubernetes objects to extract from a snapshot. The resource is given as
+// it appears in the datastore key, such as configmaps, services/specs or example.com/widgets. If no
+// namespace is given, objects in all namespaces and cluster-scoped objects are selected.
+type ObjectSelector struct {
+	Resource  string
+	Namespace string
+	Name      string
+}
+
+// matches returns true if the given key holds an object selected by the selector.
+func (s ObjectSelector) matches(key string) bool {
+	prefix := registryPrefix + strings.Trim(s.Resource, "/") + "/"
+	if !strings.HasPrefix(key, prefix) {
+		return false
+	}
+	// Keys are of the form <prefix>/<namespace>/<name> for namespaced objects,
+	// and <prefix>/<name> for cluster-scoped objects.
+	parts := strings.Split(strings.TrimPrefix(key, prefix), "/")
+	switch len(parts) {
+	case 1:
+		if s.Namespace != "" {
+			return false
+		}
+	case 2:
+		if s.Namespace != "" && parts[0] != s.Namespace {
+			return false
+		}
+	default:
+		return false
+	}
+	return s.Name == "" || parts[len(parts)-1] == s.Name
+}
+
+// SnapshotObject is a single key and its value, as held in a snapshot.
+type SnapshotObject struct {
+	Key         string
+	ModRevision int64
+	Value       []byte
+}
+
+// ExtractSnapshot returns the objects selected from the given snapshot, ordered by key. The snapshot
+// may be given as a path to a snapshot file, or by the name of a snapshot held in any enabled snapshot store.
+func (e *ETCD) ExtractSnapshot(ctx context.Context, name string, selector ObjectSelector) ([]SnapshotObject, error) {
+	if strings.Trim(selector.Resource, "/") == "" {
+		return nil, errors.New("a resource must be given to select the objects to extract")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "etcd-snapshot-extract-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	snapshotPath, err := e.retrieveSnapshot(ctx, name, tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := readSnapshotContents(snapshotPath, selector.matches, true)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]SnapshotObject, 0, len(contents.Keys))
+	for key, sk := range contents.Keys {
+		objects = append(objects, SnapshotObject{Key: key, ModRevision: sk.ModRevision, Value: sk.Value})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+// EncodeSnapshotObjects writes the given objects to the writer in the given format. YAML is written as
+// one document per object, and JSON as a single List. Objects that were encrypted by the apiserver
+// cannot be decoded, and are skipped with a warning.
+func EncodeSnapshotObjects(w io.Writer, format string, objects []SnapshotObject) error {
+	if format != ExtractFormatYAML && format != ExtractFormatJSON {
+		return fmt.Errorf("invalid output format %q: must be %s or %s", format, ExtractFormatYAML, ExtractFormatJSON)
+	}
+	yaml := format == ExtractFormatYAML
+	serializer := jsonserializer.NewSerializerWithOptions(jsonserializer.DefaultMetaFactory, scheme.Scheme, scheme.Scheme,
+		jsonserializer.SerializerOptions{Yaml: yaml, Pretty: !yaml})
+
+	list := &metav1.List{TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "List"}}
+	for _, o := range objects {
+		obj, err := decodeSnapshotObject(o.Value)
+		if err != nil {
+			logrus.Warnf("Skipping %s: %v", o.Key, err)
+			continue
+		}
+		if !yaml {
+			var buf bytes.Buffer
+			if err := serializer.Encode(obj, &buf); err != nil {
+				return errors.Wrapf(err, "failed to encode %s", o.Key)
+			}
+			list.Items = append(list.Items, runtime.RawExtension{Raw: buf.Bytes()})
+			continue
+		}
+		if _, err := io.WriteString(w, "---\n"); err != nil {
+			return err
+		}
+		if err := serializer.Encode(obj, w); err != nil {
+			return errors.Wrapf(err, "failed to encode %s", o.Key)
+		}
+	}
+
+	if !yaml {
+		return serializer.Encode(list, w)
+	}
+	return nil
+}
+
+// decodeSnapshotObject decodes an object as stored by the apiserver. Built-in types are stored as
+// protobuf, and custom resources as JSON.
+func decodeSnapshotObject(data []byte) (runtime.Object, error) {
+	if bytes.HasPrefix(data, []byte(encryptedValuePrefix)) {
+		return nil, errors.New("object is encrypted at rest")
+	}
+	obj, gvk, err := scheme.Codecs.UniversalDeserializer().Decode(data, nil, nil)
+	if err == nil {
+		obj.GetObjectKind().SetGroupVersionKind(*gvk)
+		return obj, nil
+	}
+	if u, _, uErr := unstructured.UnstructuredJSONScheme.Decode(data, nil, nil); uErr == nil {
+		return u, nil
+	}
+	return nil, err
+}
+
+// RestoreSnapshotObjects writes the given objects back into the live datastore, returning the keys that
+// were written and those that were skipped. Objects that still exist are skipped unless overwrite is
+// set, so that only deleted objects are restored by default. Values are written exactly as they were
+// stored, so objects encrypted at rest are restored with the keys that were used to encrypt them.
+func (e *ETCD) RestoreSnapshotObjects(ctx context.Context, objects []SnapshotObject, overwrite bool) ([]string, []string, error) {
+	client, err := GetClient(ctx, e.config.Runtime, localEndpoint(e.config))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer client.Close()
+
+	var restored, skipped []string
+	for _, o := range objects {
+		put := clientv3.OpPut(o.Key, string(o.Value))
+		if overwrite {
+			if _, err := client.Do(ctx, put); err != nil {
+				return restored, skipped, errors.Wrapf(err, "failed to restore %s", o.Key)
+			}
+			restored = append(restored, o.Key)
+			continue
+		}
+
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(o.Key), "=", 0)).
+			Then(put).
+			Commit()
+		if err != nil {
+			return restored, skipped, errors.Wrapf(err, "failed to restore %s", o.Key)
+		}
+		if resp.Succeeded {
+			restored = append(restored, o.Key)
+		} else {
+			skipped = append(skipped, o.Key)
+		}
+	}
+	return restored, skipped, nil
+}
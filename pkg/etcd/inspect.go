@@ -0,0 +1,281 @@
+package etcd
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+const (
+	// registryPrefix is the prefix under which Kubernetes stores its resources.
+	registryPrefix = "/registry/"
+	// otherPrefix groups keys that are not stored under the registry prefix.
+	otherPrefix = "(other)"
+
+	// revisionBytesLen is the length of the keys in the etcd key bucket, which hold the
+	// main and sub revision separated by an underscore. Tombstones are marked by an extra byte.
+	revisionBytesLen = 8 + 1 + 8
+	tombstoneMark    = 't'
+)
+
+// keyBucketName is the bolt bucket holding the revision history of every key.
+var keyBucketName = []byte("key")
+
+// snapshotKey records the state of a single key in a snapshot.
+type snapshotKey struct {
+	CreateRevision int64
+	ModRevision    int64
+	Version        int64
+	Size           int64
+	// Value is only recorded if requested when reading the snapshot.
+	Value []byte
+}
+
+// snapshotContents holds the keys present in a snapshot at its latest revision.
+type snapshotContents struct {
+	Revision int64
+	Keys     map[string]snapshotKey
+}
+
+// prefixUsage records the number and total size of the keys under a single resource prefix.
+type prefixUsage struct {
+	Prefix string
+	Keys   int
+	Size   int64
+}
+
+// snapshotInspection records the contents of a single snapshot.
+type snapshotInspection struct {
+	Name     string
+	Revision int64
+	TotalKey int
+	Size     int64
+	Prefixes []prefixUsage
+}
+
+// snapshotChange records a key that differs between two snapshots.
+type snapshotChange struct {
+	Key string
+	// Change is one of added, deleted or modified.
+	Change       string
+	FromRevision int64
+	ToRevision   int64
+}
+
+// snapshotDiff records the differences between two snapshots.
+type snapshotDiff struct {
+	FromRevision int64
+	ToRevision   int64
+	Changes      []snapshotChange
+}
+
+// InspectSnapshot opens the given snapshot read-only and reports its revision, the number of keys it
+// holds, and the number and size of the keys under each Kubernetes resource prefix. The snapshot may be
+// given as a path to a snapshot file, or by the name of a snapshot held in any enabled snapshot store.
+func (e *ETCD) InspectSnapshot(ctx context.Context, name string) (*snapshotInspection, error) {
+	tmpDir, err := ioutil.TempDir("", "etcd-snapshot-inspect-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	snapshotPath, err := e.retrieveSnapshot(ctx, name, tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := readSnapshotContents(snapshotPath, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	inspection := &snapshotInspection{
+		Name:     filepath.Base(name),
+		Revision: contents.Revision,
+		TotalKey: len(contents.Keys),
+	}
+	prefixes := map[string]*prefixUsage{}
+	for key, sk := range contents.Keys {
+		prefix := resourcePrefix(key)
+		usage, ok := prefixes[prefix]
+		if !ok {
+			usage = &prefixUsage{Prefix: prefix}
+			prefixes[prefix] = usage
+		}
+		usage.Keys++
+		usage.Size += sk.Size
+		inspection.Size += sk.Size
+	}
+	for _, usage := range prefixes {
+		inspection.Prefixes = append(inspection.Prefixes, *usage)
+	}
+	sort.Slice(inspection.Prefixes, func(i, j int) bool {
+		if inspection.Prefixes[i].Size != inspection.Prefixes[j].Size {
+			return inspection.Prefixes[i].Size > inspection.Prefixes[j].Size
+		}
+		return inspection.Prefixes[i].Prefix < inspection.Prefixes[j].Prefix
+	})
+	return inspection, nil
+}
+
+// DiffSnapshots compares the keys held by two snapshots, reporting the keys that were added or deleted,
+// and those whose modification revision differs. Snapshots are given as for InspectSnapshot.
+func (e *ETCD) DiffSnapshots(ctx context.Context, from, to string) (*snapshotDiff, error) {
+	tmpDir, err := ioutil.TempDir("", "etcd-snapshot-diff-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var contents []*snapshotContents
+	for i, name := range []string{from, to} {
+		workDir := filepath.Join(tmpDir, fmt.Sprint(i))
+		if err := os.Mkdir(workDir, 0700); err != nil {
+			return nil, err
+		}
+		snapshotPath, err := e.retrieveSnapshot(ctx, name, workDir)
+		if err != nil {
+			return nil, err
+		}
+		c, err := readSnapshotContents(snapshotPath, nil, false)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, c)
+	}
+
+	diff := &snapshotDiff{
+		FromRevision: contents[0].Revision,
+		ToRevision:   contents[1].Revision,
+	}
+	for key, before := range contents[0].Keys {
+		after, ok := contents[1].Keys[key]
+		switch {
+		case !ok:
+			diff.Changes = append(diff.Changes, snapshotChange{Key: key, Change: "deleted", FromRevision: before.ModRevision})
+		case after.ModRevision != before.ModRevision:
+			diff.Changes = append(diff.Changes, snapshotChange{Key: key, Change: "modified", FromRevision: before.ModRevision, ToRevision: after.ModRevision})
+		}
+	}
+	for key, after := range contents[1].Keys {
+		if _, ok := contents[0].Keys[key]; !ok {
+			diff.Changes = append(diff.Changes, snapshotChange{Key: key, Change: "added", ToRevision: after.ModRevision})
+		}
+	}
+	sort.Slice(diff.Changes, func(i, j int) bool {
+		return diff.Changes[i].Key < diff.Changes[j].Key
+	})
+	return diff, nil
+}
+
+// retrieveSnapshot returns the path to a plain copy of the given snapshot that can be opened directly.
+// If no file exists at the given path, the snapshot is looked up by name in every enabled snapshot store
+// and retrieved into the work directory. The snapshot is verified against its recorded checksum, and
+// decrypted and decompressed into the work directory if necessary.
+func (e *ETCD) retrieveSnapshot(ctx context.Context, name, workDir string) (string, error) {
+	if _, err := os.Stat(name); err == nil {
+		if _, err := verifySnapshotChecksum(name); err != nil {
+			return "", err
+		}
+		return e.prepareSnapshot(workDir, name)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	stores, storeErrs := e.snapshotStores(ctx)
+	for storeName, err := range storeErrs {
+		return "", errors.Wrapf(err, "failed to initialize %s snapshot store", storeName)
+	}
+
+	for _, store := range stores {
+		snapshots, err := store.List(ctx)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to list %s snapshots", store.Name())
+		}
+		for _, sf := range snapshots {
+			if sf.Name != filepath.Base(name) {
+				continue
+			}
+			snapshotPath, err := store.Download(ctx, sf.Name, workDir)
+			if err != nil {
+				return "", err
+			}
+			return e.prepareSnapshot(workDir, snapshotPath)
+		}
+	}
+	return "", fmt.Errorf("etcd snapshot %s not found", name)
+}
+
+// readSnapshotContents opens the given snapshot read-only, and replays the revision history held in it
+// to find the keys present at its latest revision. If a match function is given, only the keys that it
+// matches are recorded. Values are only recorded if requested, as they may not all fit in memory.
+func readSnapshotContents(snapshotPath string, match func(key string) bool, values bool) (*snapshotContents, error) {
+	db, err := bolt.Open(snapshotPath, 0400, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open etcd snapshot %s", snapshotPath)
+	}
+	defer db.Close()
+
+	contents := &snapshotContents{Keys: map[string]snapshotKey{}}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keyBucketName)
+		if b == nil {
+			return errors.New("snapshot does not contain an etcd key bucket")
+		}
+		// Keys are ordered by revision, so later revisions of each key replace earlier ones.
+		return b.ForEach(func(k, v []byte) error {
+			if len(k) < revisionBytesLen {
+				return fmt.Errorf("invalid revision key of length %d", len(k))
+			}
+			if rev := int64(binary.BigEndian.Uint64(k[0:8])); rev > contents.Revision {
+				contents.Revision = rev
+			}
+
+			var kv mvccpb.KeyValue
+			if err := kv.Unmarshal(v); err != nil {
+				return err
+			}
+			if match != nil && !match(string(kv.Key)) {
+				return nil
+			}
+			if len(k) > revisionBytesLen && k[revisionBytesLen] == tombstoneMark {
+				delete(contents.Keys, string(kv.Key))
+				return nil
+			}
+			sk := snapshotKey{
+				CreateRevision: kv.CreateRevision,
+				ModRevision:    kv.ModRevision,
+				Version:        kv.Version,
+				Size:           int64(len(kv.Key) + len(kv.Value)),
+			}
+			if values {
+				sk.Value = kv.Value
+			}
+			contents.Keys[string(kv.Key)] = sk
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read etcd snapshot %s", snapshotPath)
+	}
+	return contents, nil
+}
+
+// resourcePrefix returns the Kubernetes resource prefix that the given key is stored under,
+// such as /registry/pods.
+func resourcePrefix(key string) string {
+	if !strings.HasPrefix(key, registryPrefix) {
+		return otherPrefix
+	}
+	resource := strings.SplitN(strings.TrimPrefix(key, registryPrefix), "/", 2)[0]
+	return registryPrefix + resource
+}
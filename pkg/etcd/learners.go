@@ -0,0 +1,85 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// States of the learner recorded in the learnerProgress record.
+const (
+	learnerStateCatchingUp = "CatchingUp"
+	learnerStateStalled    = "Stalled"
+	learnerStatePromoted   = "Promoted"
+	learnerStateEvicted    = "Evicted"
+)
+
+// manageTickerTime returns the interval at which learners are checked for promotion.
+// The default is only used if no interval is set; the CLI rejects values that are not positive.
+func (e *ETCD) manageTickerTime() time.Duration {
+	if e.config.EtcdLearnerInterval == 0 {
+		return defaultManageTickerTime
+	}
+	return e.config.EtcdLearnerInterval
+}
+
+// learnerMaxStallTime returns the time for which a learner may make no progress before it is evicted.
+// The default is only used if no time is set; the CLI rejects values that are not positive.
+func (e *ETCD) learnerMaxStallTime() time.Duration {
+	if e.config.EtcdLearnerMaxStall == 0 {
+		return defaultLearnerMaxStallTime
+	}
+	return e.config.EtcdLearnerMaxStall
+}
+
+// learnerNodeName returns the name of the node that the learner is running on. Member names are the
+// node name followed by a random suffix; see setName.
+func learnerNodeName(memberName string) string {
+	if i := strings.LastIndex(memberName, "-"); i > 0 {
+		return memberName[:i]
+	}
+	return memberName
+}
+
+// recordLearnerEvent records an event about the learner against its node. Events are not recorded
+// until the core controllers are ready, and failures are only logged.
+func (e *ETCD) recordLearnerEvent(progress *learnerProgress, eventType, reason, format string, args ...interface{}) {
+	if !e.coreReady() {
+		return
+	}
+	if err := e.recordNodeEvent(learnerNodeName(progress.Name), eventType, reason, fmt.Sprintf(format, args...)); err != nil {
+		logrus.Warnf("Failed to record etcd learner event: %v", err)
+	}
+}
+
+// learnerHandlers registers the learner API on the supervisor router. The learnerProgress record of the
+// most recently tracked learner is returned as JSON, to clients authenticated as for the snapshot API.
+func (e *ETCD) learnerHandlers(router *mux.Router) {
+	router.Path("/db/learners").Methods(http.MethodGet).Handler(e.snapshotAuthMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if e.client == nil {
+			http.Error(rw, "etcd client was nil", http.StatusServiceUnavailable)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), testTimeout)
+		defer cancel()
+
+		progress, err := e.getLearnerProgress(ctx)
+		if err != nil {
+			logrus.Errorf("Failed to get recorded learner progress from etcd: %v", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(progress); err != nil {
+			logrus.Errorf("Failed to write etcd learner response: %v", err)
+		}
+	})))
+}
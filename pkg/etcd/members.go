@@ -0,0 +1,266 @@
+package etcd
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// memberStatus records the membership and status of a single etcd cluster member.
+type memberStatus struct {
+	ID         uint64
+	Name       string
+	PeerURLs   []string
+	ClientURLs []string
+	IsLearner  bool
+	IsLeader   bool
+	// The following are only set if the status of the member could be retrieved.
+	Version          string
+	RaftTerm         uint64
+	RaftIndex        uint64
+	RaftAppliedIndex uint64
+	DBSize           int64
+	DBSizeInUse      int64
+	Err              error
+}
+
+// FormatMemberID returns the member ID in the hexadecimal form used by etcd and etcdctl.
+func FormatMemberID(id uint64) string {
+	return strconv.FormatUint(id, 16)
+}
+
+// memberClient returns the etcd client, creating one connected to the local etcd endpoint if
+// the ETCD has not been registered with a running server. The returned function must be called
+// once the client is no longer needed, and closes the client if it was created here.
+func (e *ETCD) memberClient(ctx context.Context) (*clientv3.Client, func(), error) {
+	if e.client != nil {
+		return e.client, func() {}, nil
+	}
+	client, err := GetClient(ctx, e.config.Runtime, localEndpoint(e.config))
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, func() {
+		if err := client.Close(); err != nil {
+			logrus.Debugf("Failed to close etcd client: %v", err)
+		}
+	}, nil
+}
+
+// ListMembers returns the members of the etcd cluster, along with the status reported by each member
+// that can be reached. Members are sorted by name. Each member is given its own timeout to report its
+// status, so that unreachable members do not prevent the status of the others from being retrieved.
+func (e *ETCD) ListMembers(ctx context.Context) ([]memberStatus, error) {
+	client, release, err := e.memberClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	listCtx, cancel := context.WithTimeout(ctx, testTimeout)
+	defer cancel()
+
+	members, err := client.MemberList(listCtx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list etcd members")
+	}
+
+	var leader uint64
+	if status, err := client.Status(listCtx, localEndpoint(e.config)); err != nil {
+		logrus.Warnf("Failed to get local etcd status to determine the leader: %v", err)
+	} else {
+		leader = status.Leader
+	}
+
+	results := make([]memberStatus, 0, len(members.Members))
+	for _, member := range members.Members {
+		ms := memberStatus{
+			ID:         member.ID,
+			Name:       member.Name,
+			PeerURLs:   member.PeerURLs,
+			ClientURLs: member.ClientURLs,
+			IsLearner:  member.IsLearner,
+			IsLeader:   member.ID == leader,
+		}
+		if len(member.ClientURLs) == 0 {
+			// members that have been added but have not yet started do not have client URLs
+			ms.Err = errors.New("member has not started")
+		}
+		for _, ep := range member.ClientURLs {
+			statusCtx, cancel := context.WithTimeout(ctx, defaultDialTimeout)
+			status, err := client.Status(statusCtx, ep)
+			cancel()
+			if err != nil {
+				ms.Err = err
+				continue
+			}
+			ms.Err = nil
+			ms.Version = status.Version
+			ms.RaftTerm = status.RaftTerm
+			ms.RaftIndex = status.RaftIndex
+			ms.RaftAppliedIndex = status.RaftAppliedIndex
+			ms.DBSize = status.DbSize
+			ms.DBSizeInUse = status.DbSizeInUse
+			if leader == 0 {
+				ms.IsLeader = status.Leader == member.ID
+			}
+			break
+		}
+		results = append(results, ms)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+// findMember returns the member with the given name or hexadecimal ID.
+func findMember(members []*etcdserverpb.Member, nameOrID string) (*etcdserverpb.Member, error) {
+	var found *etcdserverpb.Member
+	for _, member := range members {
+		if member.Name == nameOrID || FormatMemberID(member.ID) == nameOrID {
+			if found != nil {
+				return nil, errors.Errorf("more than one etcd member matches %s; select the member by ID", nameOrID)
+			}
+			found = member
+		}
+	}
+	if found == nil {
+		return nil, errors.Errorf("etcd member %s not found", nameOrID)
+	}
+	return found, nil
+}
+
+// RemoveMember removes the member with the given name or hexadecimal ID from the etcd cluster.
+// The last voting member cannot be removed.
+func (e *ETCD) RemoveMember(ctx context.Context, nameOrID string) error {
+	client, release, err := e.memberClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(ctx, memberRemovalTimeout)
+	defer cancel()
+
+	members, err := client.MemberList(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list etcd members")
+	}
+	member, err := findMember(members.Members, nameOrID)
+	if err != nil {
+		return err
+	}
+
+	if !member.IsLearner {
+		var voters int
+		for _, m := range members.Members {
+			if !m.IsLearner {
+				voters++
+			}
+		}
+		if voters < 2 {
+			return errors.Errorf("not removing %s, the last voting member of the etcd cluster", member.Name)
+		}
+	}
+
+	logrus.Infof("Removing name=%s id=%s from etcd", member.Name, FormatMemberID(member.ID))
+	if _, err := client.MemberRemove(ctx, member.ID); err != nil {
+		return errors.Wrapf(err, "failed to remove etcd member %s", member.Name)
+	}
+	return nil
+}
+
+// PromoteMember promotes the learner with the given name or hexadecimal ID to a voting member, without
+// waiting for the leader to promote it. etcd will still refuse to promote a learner that has not caught
+// up with the leader.
+func (e *ETCD) PromoteMember(ctx context.Context, nameOrID string) error {
+	client, release, err := e.memberClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(ctx, testTimeout)
+	defer cancel()
+
+	members, err := client.MemberList(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list etcd members")
+	}
+	member, err := findMember(members.Members, nameOrID)
+	if err != nil {
+		return err
+	}
+	if !member.IsLearner {
+		return errors.Errorf("etcd member %s is not a learner", member.Name)
+	}
+
+	if _, err := client.MemberPromote(ctx, member.ID); err != nil {
+		return errors.Wrapf(err, "failed to promote etcd learner %s", member.Name)
+	}
+	logrus.Infof("Promoted learner %s", member.Name)
+	return nil
+}
+
+// MoveLeader transfers leadership of the etcd cluster to the voting member with the given name or
+// hexadecimal ID. The request is sent to the current leader, which must be reachable.
+func (e *ETCD) MoveLeader(ctx context.Context, nameOrID string) error {
+	client, release, err := e.memberClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(ctx, testTimeout)
+	defer cancel()
+
+	members, err := client.MemberList(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list etcd members")
+	}
+	member, err := findMember(members.Members, nameOrID)
+	if err != nil {
+		return err
+	}
+	if member.IsLearner {
+		return errors.Errorf("etcd member %s is a learner, and cannot become leader", member.Name)
+	}
+
+	status, err := client.Status(ctx, localEndpoint(e.config))
+	if err != nil {
+		return errors.Wrap(err, "failed to get local etcd status")
+	}
+	if status.Leader == member.ID {
+		logrus.Infof("etcd member %s is already the leader", member.Name)
+		return nil
+	}
+
+	var leaderURLs []string
+	for _, m := range members.Members {
+		if m.ID == status.Leader {
+			leaderURLs = m.ClientURLs
+		}
+	}
+	if len(leaderURLs) == 0 {
+		return errors.New("failed to find the client URLs of the current etcd leader")
+	}
+
+	leaderClient, err := GetClient(ctx, e.config.Runtime, leaderURLs...)
+	if err != nil {
+		return err
+	}
+	defer leaderClient.Close()
+
+	if _, err := leaderClient.MoveLeader(ctx, member.ID); err != nil {
+		return errors.Wrapf(err, "failed to move etcd leadership to %s", member.Name)
+	}
+	logrus.Infof("Moved etcd leadership to %s", member.Name)
+	return nil
+}
@@ -0,0 +1,165 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// latestSnapshot is the restore path that selects the newest available snapshot. It may be
+// followed by a colon and a node name or snapshot name prefix, to select the newest snapshot
+// taken by that node or with that prefix.
+const latestSnapshot = "latest"
+
+// restorePlan describes the snapshot that a restore from the given restore path would use.
+type restorePlan struct {
+	RestorePath string
+	Store       SnapshotStore
+	Snapshot    snapshotFile
+	// Candidates is the number of snapshots that matched a latest selector.
+	Candidates int
+}
+
+// isLatestSelector returns true if the restore path selects the newest matching snapshot,
+// rather than naming a snapshot.
+func isLatestSelector(restorePath string) bool {
+	return restorePath == latestSnapshot || strings.HasPrefix(restorePath, latestSnapshot+":")
+}
+
+// RestorePlan resolves the given restore path to the snapshot that would be restored, without
+// retrieving it. If S3 is enabled, the snapshot is found in S3; otherwise it is found in the
+// local snapshot directory or the mirror directory.
+func (e *ETCD) RestorePlan(ctx context.Context, restorePath string) (*restorePlan, error) {
+	if isLatestSelector(restorePath) {
+		return e.latestRestorePlan(ctx, restorePath)
+	}
+
+	if e.config.EtcdS3 {
+		if err := e.initS3IfNil(ctx); err != nil {
+			return nil, err
+		}
+		sf, err := e.s3.snapshotInfo(ctx, restorePath)
+		if err != nil {
+			return nil, err
+		}
+		return &restorePlan{RestorePath: restorePath, Store: e.s3, Snapshot: *sf}, nil
+	}
+
+	info, err := os.Stat(restorePath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("etcd: snapshot path does not exist: %s", restorePath)
+	} else if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("etcd: snapshot path must be a file, not a directory: %s", restorePath)
+	}
+	return &restorePlan{
+		RestorePath: restorePath,
+		Store:       &localStore{config: e.config},
+		Snapshot: snapshotFile{
+			Name:      info.Name(),
+			Location:  "file://" + restorePath,
+			NodeName:  os.Getenv("NODE_NAME"),
+			CreatedAt: &metav1.Time{Time: info.ModTime()},
+			Size:      info.Size(),
+			Status:    successfulSnapshotStatus,
+		},
+	}, nil
+}
+
+// latestRestorePlan finds the newest snapshot matching the given latest selector.
+func (e *ETCD) latestRestorePlan(ctx context.Context, restorePath string) (*restorePlan, error) {
+	selector := strings.TrimPrefix(strings.TrimPrefix(restorePath, latestSnapshot), ":")
+
+	var stores []SnapshotStore
+	if e.config.EtcdS3 {
+		if err := e.initS3IfNil(ctx); err != nil {
+			return nil, err
+		}
+		stores = []SnapshotStore{e.s3}
+	} else {
+		allStores, storeErrs := e.snapshotStores(ctx)
+		for name, err := range storeErrs {
+			return nil, errors.Wrapf(err, "failed to initialize %s snapshot store", name)
+		}
+		stores = allStores
+	}
+
+	plan := &restorePlan{RestorePath: restorePath}
+	var newest time.Time
+	for _, store := range stores {
+		snapshots, err := store.List(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list %s snapshots", store.Name())
+		}
+		for _, sf := range snapshots {
+			if !snapshotMatches(sf.Name, selector) {
+				continue
+			}
+			plan.Candidates++
+
+			var createdAt time.Time
+			if sf.CreatedAt != nil {
+				createdAt = sf.CreatedAt.Time
+			}
+			taken := snapshotTime(sf.Name, createdAt)
+			if plan.Store == nil || taken.After(newest) || (taken.Equal(newest) && sf.Name > plan.Snapshot.Name) {
+				plan.Store = store
+				plan.Snapshot = sf
+				newest = taken
+			}
+		}
+	}
+
+	if plan.Store == nil {
+		if selector == "" {
+			return nil, errors.New("no etcd snapshots found to restore")
+		}
+		return nil, fmt.Errorf("no etcd snapshots found to restore matching node or name prefix %q", selector)
+	}
+	return plan, nil
+}
+
+// snapshotMatches returns true if the named snapshot was taken by the node with the given name,
+// or if its name starts with the given prefix. An empty selector matches all snapshots.
+func snapshotMatches(name, selector string) bool {
+	if selector == "" || strings.HasPrefix(name, selector) {
+		return true
+	}
+	// Snapshot names are made up of the snapshot name, the node name, and the unix timestamp,
+	// followed by any compression or encryption extensions.
+	name = trimCompressedExtension(strings.TrimSuffix(name, encryptedExtension))
+	if i := strings.LastIndex(name, "-"); i >= 0 {
+		name = name[:i]
+	}
+	return strings.HasSuffix(name, "-"+selector)
+}
+
+// fetchRestoreSnapshot retrieves the planned snapshot into the local snapshot directory if it is held
+// by a remote store, and returns the path to the local snapshot file.
+func (e *ETCD) fetchRestoreSnapshot(ctx context.Context, plan *restorePlan) (string, error) {
+	if _, ok := plan.Store.(*localStore); ok {
+		return strings.TrimPrefix(plan.Snapshot.Location, "file://"), nil
+	}
+
+	snapshotDir, err := snapshotDir(e.config, true)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get the snapshot dir")
+	}
+
+	logrus.Infof("Retrieving etcd snapshot %s from %s", plan.Snapshot.Name, plan.Store.Name())
+	snapshotPath, err := plan.Store.Download(ctx, plan.Snapshot.Name, snapshotDir)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to retrieve etcd snapshot %s from %s", plan.Snapshot.Name, plan.Store.Name())
+	}
+	logrus.Infof("Retrieved etcd snapshot %s to %s", plan.Snapshot.Name, filepath.Dir(snapshotPath))
+	return snapshotPath, nil
+}
@@ -0,0 +1,142 @@
+package etcd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wangxiaochuang/k3s/pkg/daemons/config"
+)
+
+// retentionPolicy describes which snapshots are kept when retention is applied.
+// A snapshot is kept if it is one of the newest Count snapshots, or if it is the
+// newest snapshot in one of the most recent Hourly, Daily or Weekly periods. If
+// MaxAge is set, snapshots older than MaxAge are removed even if another rule
+// would keep them. If only MaxAge is set, all snapshots younger than it are kept.
+// Remote stores normally apply the policy to the snapshots taken by this node; if
+// AllNodes is set, it is applied to the snapshots taken by every node.
+type retentionPolicy struct {
+	Count    int
+	MaxAge   time.Duration
+	Hourly   int
+	Daily    int
+	Weekly   int
+	AllNodes bool
+}
+
+// newRetentionPolicy returns the retention policy set in the configuration.
+func newRetentionPolicy(config *config.Control) retentionPolicy {
+	return retentionPolicy{
+		Count:  config.EtcdSnapshotRetention,
+		MaxAge: config.EtcdSnapshotMaxAge,
+		Hourly: config.EtcdSnapshotKeepHourly,
+		Daily:  config.EtcdSnapshotKeepDaily,
+		Weekly: config.EtcdSnapshotKeepWeekly,
+	}
+}
+
+// enabled returns true if any retention rule is set.
+func (p retentionPolicy) enabled() bool {
+	return p.Count >= 1 || p.MaxAge > 0 || p.tiered()
+}
+
+// tiered returns true if any grandfather-father-son tier is set.
+func (p retentionPolicy) tiered() bool {
+	return p.Hourly >= 1 || p.Daily >= 1 || p.Weekly >= 1
+}
+
+func (p retentionPolicy) String() string {
+	return fmt.Sprintf("retention: %d, max-age: %s, hourly: %d, daily: %d, weekly: %d", p.Count, p.MaxAge, p.Hourly, p.Daily, p.Weekly)
+}
+
+// retentionCandidate is a snapshot that retention may be applied to.
+type retentionCandidate struct {
+	Name string
+	Time time.Time
+}
+
+// expired returns the names of the candidates that should be removed under the policy.
+// The newest candidate is never removed, so that a node whose snapshots have stopped
+// is not left without any snapshot once they pass the maximum age.
+func (p retentionPolicy) expired(candidates []retentionCandidate, now time.Time) []string {
+	if !p.enabled() || len(candidates) == 0 {
+		return nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if !candidates[i].Time.Equal(candidates[j].Time) {
+			return candidates[i].Time.After(candidates[j].Time)
+		}
+		return candidates[i].Name > candidates[j].Name
+	})
+
+	keep := make(map[string]bool)
+	if p.Count < 1 && !p.tiered() {
+		for _, c := range candidates {
+			keep[c.Name] = true
+		}
+	}
+	for i := 0; i < p.Count && i < len(candidates); i++ {
+		keep[candidates[i].Name] = true
+	}
+	keepPeriods(keep, candidates, p.Hourly, "2006-01-02T15")
+	keepPeriods(keep, candidates, p.Daily, "2006-01-02")
+	keepPeriods(keep, candidates, p.Weekly, "")
+
+	var expired []string
+	for i, c := range candidates {
+		if i == 0 {
+			continue
+		}
+		if keep[c.Name] && (p.MaxAge <= 0 || now.Sub(c.Time) <= p.MaxAge) {
+			continue
+		}
+		expired = append(expired, c.Name)
+	}
+	return expired
+}
+
+// keepPeriods marks the newest candidate in each of the most recent periods as kept, stopping once
+// the given number of periods have been filled. Periods are identified by formatting the candidate
+// time in UTC with the given layout; an empty layout groups candidates by ISO week.
+func keepPeriods(keep map[string]bool, candidates []retentionCandidate, periods int, layout string) {
+	if periods < 1 {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, c := range candidates {
+		t := c.Time.UTC()
+		var period string
+		if layout == "" {
+			year, week := t.ISOWeek()
+			period = fmt.Sprintf("%d-W%02d", year, week)
+		} else {
+			period = t.Format(layout)
+		}
+		if seen[period] {
+			continue
+		}
+		if len(seen) == periods {
+			return
+		}
+		seen[period] = true
+		keep[c.Name] = true
+	}
+}
+
+// snapshotTime returns the time a snapshot was taken, parsed from the unix timestamp at the end
+// of its name. The given fallback time is returned if the name does not contain a timestamp.
+func snapshotTime(name string, fallback time.Time) time.Time {
+	name = trimCompressedExtension(strings.TrimSuffix(name, encryptedExtension))
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return fallback
+	}
+	ts, err := strconv.ParseInt(name[i+1:], 10, 64)
+	if err != nil || ts <= 0 {
+		return fallback
+	}
+	return time.Unix(ts, 0)
+}
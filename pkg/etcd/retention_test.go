@@ -0,0 +1,131 @@
+package etcd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testCandidate(name, timestamp string) retentionCandidate {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		panic(err)
+	}
+	return retentionCandidate{Name: name, Time: t}
+}
+
+func Test_UnitRetentionPolicyExpired(t *testing.T) {
+	now := testCandidate("now", "2024-01-10T12:00:00Z").Time
+
+	tests := []struct {
+		name       string
+		policy     retentionPolicy
+		candidates []retentionCandidate
+		want       []string
+	}{
+		{
+			name:   "no rules",
+			policy: retentionPolicy{},
+			candidates: []retentionCandidate{
+				testCandidate("a", "2024-01-10T11:00:00Z"),
+				testCandidate("b", "2024-01-01T11:00:00Z"),
+			},
+			want: nil,
+		},
+		{
+			name:   "count keeps the newest",
+			policy: retentionPolicy{Count: 2},
+			candidates: []retentionCandidate{
+				testCandidate("a", "2024-01-10T08:00:00Z"),
+				testCandidate("b", "2024-01-10T11:00:00Z"),
+				testCandidate("c", "2024-01-10T09:00:00Z"),
+				testCandidate("d", "2024-01-10T10:00:00Z"),
+			},
+			want: []string{"c", "a"},
+		},
+		{
+			name:   "max age alone",
+			policy: retentionPolicy{MaxAge: 24 * time.Hour},
+			candidates: []retentionCandidate{
+				testCandidate("a", "2024-01-10T11:00:00Z"),
+				testCandidate("b", "2024-01-09T06:00:00Z"),
+				testCandidate("c", "2024-01-08T10:00:00Z"),
+			},
+			want: []string{"b", "c"},
+		},
+		{
+			name:   "newest is never removed",
+			policy: retentionPolicy{MaxAge: 24 * time.Hour},
+			candidates: []retentionCandidate{
+				testCandidate("a", "2024-01-08T12:00:00Z"),
+				testCandidate("b", "2024-01-07T12:00:00Z"),
+			},
+			want: []string{"b"},
+		},
+		{
+			name:   "hourly keeps the newest in each hour",
+			policy: retentionPolicy{Hourly: 2},
+			candidates: []retentionCandidate{
+				testCandidate("a", "2024-01-10T12:00:00Z"),
+				testCandidate("b", "2024-01-10T11:30:00Z"),
+				testCandidate("c", "2024-01-10T11:00:00Z"),
+				testCandidate("d", "2024-01-10T10:30:00Z"),
+			},
+			want: []string{"c", "d"},
+		},
+		{
+			name:   "count and daily tiers are combined",
+			policy: retentionPolicy{Count: 1, Daily: 2},
+			candidates: []retentionCandidate{
+				testCandidate("a", "2024-01-10T10:00:00Z"),
+				testCandidate("b", "2024-01-10T08:00:00Z"),
+				testCandidate("c", "2024-01-09T20:00:00Z"),
+				testCandidate("d", "2024-01-09T10:00:00Z"),
+				testCandidate("e", "2024-01-08T10:00:00Z"),
+			},
+			want: []string{"b", "d", "e"},
+		},
+		{
+			name:   "weekly periods follow ISO weeks",
+			policy: retentionPolicy{Weekly: 2},
+			candidates: []retentionCandidate{
+				// Monday of 2024-W02
+				testCandidate("a", "2024-01-08T01:00:00Z"),
+				// Sunday of 2024-W01
+				testCandidate("b", "2024-01-07T23:00:00Z"),
+				testCandidate("c", "2024-01-06T12:00:00Z"),
+				// Monday of 2024-W01
+				testCandidate("d", "2024-01-01T12:00:00Z"),
+				// Sunday of 2023-W52
+				testCandidate("e", "2023-12-31T12:00:00Z"),
+			},
+			want: []string{"c", "d", "e"},
+		},
+		{
+			name:   "max age overrides tiers",
+			policy: retentionPolicy{Daily: 3, MaxAge: 36 * time.Hour},
+			candidates: []retentionCandidate{
+				testCandidate("a", "2024-01-10T10:00:00Z"),
+				testCandidate("b", "2024-01-09T10:00:00Z"),
+				testCandidate("c", "2024-01-08T10:00:00Z"),
+			},
+			want: []string{"c"},
+		},
+		{
+			name:   "equal times are ordered by name",
+			policy: retentionPolicy{Count: 1},
+			candidates: []retentionCandidate{
+				testCandidate("a", "2024-01-10T10:00:00Z"),
+				testCandidate("b", "2024-01-10T10:00:00Z"),
+			},
+			want: []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.expired(tt.candidates, now); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
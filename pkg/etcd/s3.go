@@ -2,32 +2,38 @@ package etcd
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/wangxiaochuang/k3s/pkg/daemons/config"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeapiserverflag "k8s.io/component-base/cli/flag"
 )
 
 // S3 maintains state for S3 functionality.
 type S3 struct {
-	config *config.Control
-	client *minio.Client
+	config   *config.Control
+	client   *minio.Client
+	sse      encrypt.ServerSide
+	tags     map[string]string
+	metadata map[string]string
 }
 
 // newS3 creates a new value of type s3 pointer with a
@@ -37,26 +43,28 @@ func NewS3(ctx context.Context, config *config.Control) (*S3, error) {
 	if config.EtcdS3BucketName == "" {
 		return nil, errors.New("s3 bucket name was not set")
 	}
-	tr := http.DefaultTransport
 
-	switch {
-	case config.EtcdS3EndpointCA != "":
-		trCA, err := setTransportCA(tr, config.EtcdS3EndpointCA, config.EtcdS3SkipSSLVerify)
-		if err != nil {
-			return nil, err
-		}
-		tr = trCA
-	case config.EtcdS3 && config.EtcdS3SkipSSLVerify:
-		tr.(*http.Transport).TLSClientConfig = &tls.Config{
-			InsecureSkipVerify: config.EtcdS3SkipSSLVerify,
-		}
+	sse, err := newS3ServerSideEncryption(config)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := parseS3KeyValues("tag", config.EtcdS3Tags)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := parseS3KeyValues("metadata", config.EtcdS3Metadata)
+	if err != nil {
+		return nil, err
 	}
 
-	var creds *credentials.Credentials
-	if len(config.EtcdS3AccessKey) == 0 && len(config.EtcdS3SecretKey) == 0 {
-		creds = credentials.NewIAM("") // for running on ec2 instance
-	} else {
-		creds = credentials.NewStaticV4(config.EtcdS3AccessKey, config.EtcdS3SecretKey, "")
+	tr, err := newS3Transport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := newS3Credentials(config)
+	if err != nil {
+		return nil, err
 	}
 
 	opt := minio.Options{
@@ -86,184 +94,335 @@ func NewS3(ctx context.Context, config *config.Control) (*S3, error) {
 	logrus.Infof("S3 bucket %s exists", config.EtcdS3BucketName)
 
 	return &S3{
-		config: config,
-		client: c,
+		config:   config,
+		client:   c,
+		sse:      sse,
+		tags:     tags,
+		metadata: metadata,
 	}, nil
 }
 
-// upload uploads the given snapshot to the configured S3
+// Name returns the name of the S3 snapshot store.
+func (s *S3) Name() string {
+	return s3StoreName
+}
+
+// Upload uploads the given snapshot to the configured S3
 // compatible backend.
-func (s *S3) upload(ctx context.Context, snapshot, extraMetadata string, now time.Time) (*snapshotFile, error) {
+func (s *S3) Upload(ctx context.Context, snapshot, extraMetadata string, revision int64, now time.Time) (*snapshotFile, error) {
 	logrus.Infof("Uploading snapshot %s to S3", snapshot)
-	basename := filepath.Base(snapshot)
-	var snapshotFileName string
-	var sf snapshotFile
-	if s.config.EtcdS3Folder != "" {
-		snapshotFileName = filepath.Join(s.config.EtcdS3Folder, basename)
-	} else {
-		snapshotFileName = basename
-	}
+	snapshotFileName := s.objectKey(filepath.Base(snapshot))
 
-	toCtx, cancel := context.WithTimeout(ctx, s.config.EtcdS3Timeout)
-	defer cancel()
-	opts := minio.PutObjectOptions{
-		ContentType: "application/zip",
-		NumThreads:  2,
+	checksum, err := readChecksumFile(snapshot)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
-	uploadInfo, err := s.client.FPutObject(toCtx, s.config.EtcdS3BucketName, snapshotFileName, snapshot, opts)
+
+	f, err := os.Open(snapshot)
 	if err != nil {
-		sf = snapshotFile{
-			Name:     filepath.Base(uploadInfo.Key),
+		return nil, err
+	}
+	defer f.Close()
+
+	opts := s.putObjectOptions(snapshotFileName, revision)
+	if checksum != "" {
+		opts.UserMetadata[checksumMetadataKey] = checksum
+	}
+	err = s.putObject(ctx, snapshotFileName, f, opts)
+	return s.uploadResult(ctx, snapshotFileName, extraMetadata, checksum, now, err)
+}
+
+// uploadResult returns the snapshot file recording the outcome of an upload to the given key.
+// A failed upload is recorded through the status of the returned snapshotFile.
+func (s *S3) uploadResult(ctx context.Context, key, extraMetadata, checksum string, now time.Time, uploadErr error) (*snapshotFile, error) {
+	basename := filepath.Base(key)
+	if uploadErr != nil {
+		logrus.Errorf("Error received during snapshot upload to S3: %s", uploadErr)
+		return &snapshotFile{
+			Name:     basename,
 			Metadata: extraMetadata,
-			NodeName: "s3",
+			NodeName: s3StoreName,
 			CreatedAt: &metav1.Time{
 				Time: now,
 			},
-			Message: base64.StdEncoding.EncodeToString([]byte(err.Error())),
+			Message: base64.StdEncoding.EncodeToString([]byte(uploadErr.Error())),
 			Size:    0,
 			Status:  failedSnapshotStatus,
-			S3: &s3Config{
-				Endpoint:      s.config.EtcdS3Endpoint,
-				EndpointCA:    s.config.EtcdS3EndpointCA,
-				SkipSSLVerify: s.config.EtcdS3SkipSSLVerify,
-				Bucket:        s.config.EtcdS3BucketName,
-				Region:        s.config.EtcdS3Region,
-				Folder:        s.config.EtcdS3Folder,
-				Insecure:      s.config.EtcdS3Insecure,
-			},
-		}
-		logrus.Errorf("Error received during snapshot upload to S3: %s", err)
-	} else {
-		ca, err := time.Parse(time.RFC3339, uploadInfo.LastModified.Format(time.RFC3339))
-		if err != nil {
-			return nil, err
-		}
+			S3:      newS3Config(s.config),
+		}, nil
+	}
 
-		sf = snapshotFile{
-			Name:     filepath.Base(uploadInfo.Key),
-			Metadata: extraMetadata,
-			NodeName: "s3",
-			CreatedAt: &metav1.Time{
-				Time: ca,
-			},
-			Size:   uploadInfo.Size,
-			Status: successfulSnapshotStatus,
-			S3: &s3Config{
-				Endpoint:      s.config.EtcdS3Endpoint,
-				EndpointCA:    s.config.EtcdS3EndpointCA,
-				SkipSSLVerify: s.config.EtcdS3SkipSSLVerify,
-				Bucket:        s.config.EtcdS3BucketName,
-				Region:        s.config.EtcdS3Region,
-				Folder:        s.config.EtcdS3Folder,
-				Insecure:      s.config.EtcdS3Insecure,
-			},
-		}
+	toCtx, cancel := context.WithTimeout(ctx, s.config.EtcdS3Timeout)
+	defer cancel()
+	info, err := s.client.StatObject(toCtx, s.config.EtcdS3BucketName, key, minio.StatObjectOptions{ServerSideEncryption: s.customerEncryption()})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to retrieve information for uploaded S3 snapshot %s", key)
 	}
-	return &sf, nil
-}
 
-// download downloads the given snapshot from the configured S3
-// compatible backend.
-func (s *S3) Download(ctx context.Context) error {
-	var remotePath string
-	if s.config.EtcdS3Folder != "" {
-		remotePath = filepath.Join(s.config.EtcdS3Folder, s.config.ClusterResetRestorePath)
-	} else {
-		remotePath = s.config.ClusterResetRestorePath
+	ca, err := time.Parse(time.RFC3339, info.LastModified.Format(time.RFC3339))
+	if err != nil {
+		return nil, err
 	}
 
+	return &snapshotFile{
+		Name:     basename,
+		Metadata: extraMetadata,
+		NodeName: s3StoreName,
+		CreatedAt: &metav1.Time{
+			Time: ca,
+		},
+		Size:       info.Size,
+		Status:     successfulSnapshotStatus,
+		S3:         newS3Config(s.config),
+		Compressed: isCompressedName(strings.TrimSuffix(basename, encryptedExtension)),
+		Checksum:   checksum,
+		Encrypted:  strings.HasSuffix(basename, encryptedExtension),
+	}, nil
+}
+
+// Download downloads the given snapshot from the configured S3
+// compatible backend into the given directory. If a checksum was
+// recorded in the object metadata, the downloaded file is verified against it.
+func (s *S3) Download(ctx context.Context, name, dir string) (string, error) {
+	remotePath := s.objectKey(name)
+
 	logrus.Debugf("retrieving snapshot: %s", remotePath)
 	toCtx, cancel := context.WithTimeout(ctx, s.config.EtcdS3Timeout)
 	defer cancel()
 
-	r, err := s.client.GetObject(toCtx, s.config.EtcdS3BucketName, remotePath, minio.GetObjectOptions{})
+	r, err := s.client.GetObject(toCtx, s.config.EtcdS3BucketName, remotePath, minio.GetObjectOptions{ServerSideEncryption: s.customerEncryption()})
 	if err != nil {
-		return nil
+		return "", errors.Wrapf(err, "failed to retrieve S3 snapshot %s", remotePath)
 	}
 	defer r.Close()
 
-	snapshotDir, err := snapshotDir(s.config, true)
+	// GetObject does not contact the server, so check that the object exists before creating the local file.
+	stat, err := r.Stat()
 	if err != nil {
-		return errors.Wrap(err, "failed to get the snapshot dir")
+		return "", errors.Wrapf(err, "failed to retrieve S3 snapshot %s", remotePath)
 	}
 
-	fullSnapshotPath := filepath.Join(snapshotDir, s.config.ClusterResetRestorePath)
+	fullSnapshotPath := filepath.Join(dir, filepath.Base(name))
 	sf, err := os.Create(fullSnapshotPath)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer sf.Close()
 
-	stat, err := r.Stat()
+	h := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(sf, h), r, stat.Size); err != nil {
+		os.Remove(fullSnapshotPath)
+		return "", errors.Wrapf(err, "failed to download S3 snapshot %s", remotePath)
+	}
+
+	checksum := hex.EncodeToString(h.Sum(nil))
+	expected := objectChecksum(stat)
+	if expected == "" {
+		// streamed snapshots record their checksum in a separate object
+		if expected, err = s.readChecksumObject(toCtx, remotePath); err != nil {
+			logrus.Debugf("Unable to read checksum object for S3 snapshot %s: %v", remotePath, err)
+		}
+	}
+	if expected == "" {
+		logrus.Warnf("No checksum recorded for S3 snapshot %s, skipping integrity check", remotePath)
+	} else if !strings.EqualFold(expected, checksum) {
+		os.Remove(fullSnapshotPath)
+		return "", fmt.Errorf("checksum mismatch for S3 snapshot %s: expected sha256 %s, got %s", remotePath, expected, checksum)
+	}
+
+	if err := writeChecksumFile(fullSnapshotPath, checksum); err != nil {
+		return "", err
+	}
+
+	return fullSnapshotPath, os.Chmod(fullSnapshotPath, 0600)
+}
+
+// snapshotInfo returns the details of the named snapshot, without downloading it.
+func (s *S3) snapshotInfo(ctx context.Context, name string) (*snapshotFile, error) {
+	key := s.objectKey(name)
+
+	toCtx, cancel := context.WithTimeout(ctx, s.config.EtcdS3Timeout)
+	defer cancel()
+
+	info, err := s.client.StatObject(toCtx, s.config.EtcdS3BucketName, key, minio.StatObjectOptions{ServerSideEncryption: s.customerEncryption()})
 	if err != nil {
-		return err
+		return nil, errors.Wrapf(err, "failed to find S3 snapshot %s", key)
 	}
+	return &snapshotFile{
+		Name:     name,
+		Location: fmt.Sprintf("s3://%s/%s", s.config.EtcdS3BucketName, key),
+		NodeName: s3StoreName,
+		CreatedAt: &metav1.Time{
+			Time: info.LastModified,
+		},
+		Size:      info.Size,
+		Status:    successfulSnapshotStatus,
+		S3:        newS3Config(s.config),
+		Checksum:  objectChecksum(info),
+		Encrypted: strings.HasSuffix(key, encryptedExtension),
+	}, nil
+}
+
+// objectChecksum returns the snapshot checksum recorded in the object's user metadata, if any.
+func objectChecksum(info minio.ObjectInfo) string {
+	for k, v := range info.UserMetadata {
+		if strings.EqualFold(k, checksumMetadataKey) {
+			return v
+		}
+	}
+	return ""
+}
 
-	if _, err := io.CopyN(sf, r, stat.Size); err != nil {
-		return err
+// List provides a list of currently stored
+// snapshots in S3 along with their relevant
+// metadata.
+func (s *S3) List(ctx context.Context) (map[string]snapshotFile, error) {
+	snapshots := make(map[string]snapshotFile)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var loo minio.ListObjectsOptions
+	if s.config.EtcdS3Folder != "" {
+		loo = minio.ListObjectsOptions{
+			Prefix:    s.config.EtcdS3Folder,
+			Recursive: true,
+		}
 	}
 
-	s.config.ClusterResetRestorePath = fullSnapshotPath
+	objects := s.client.ListObjects(ctx, s.config.EtcdS3BucketName, loo)
 
-	return os.Chmod(fullSnapshotPath, 0600)
+	for obj := range objects {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if obj.Size == 0 || isChecksumFile(obj.Key) {
+			continue
+		}
+
+		ca, err := time.Parse(time.RFC3339, obj.LastModified.Format(time.RFC3339))
+		if err != nil {
+			return nil, err
+		}
+
+		sf := snapshotFile{
+			Name:     filepath.Base(obj.Key),
+			NodeName: s3StoreName,
+			CreatedAt: &metav1.Time{
+				Time: ca,
+			},
+			Size:      obj.Size,
+			S3:        newS3Config(s.config),
+			Status:    successfulSnapshotStatus,
+			Encrypted: strings.HasSuffix(obj.Key, encryptedExtension),
+		}
+		sfKey := generateSnapshotConfigMapKey(sf)
+		snapshots[sfKey] = sf
+	}
+	return snapshots, nil
+}
+
+// Delete removes the given snapshots from the configured S3 compatible backend.
+// Snapshots may be given either by name or by their full object key.
+func (s *S3) Delete(ctx context.Context, names []string) error {
+	logrus.Info("Removing the given etcd snapshot(s) from S3")
+	logrus.Debugf("Removing the given etcd snapshot(s) from S3: %v", names)
+
+	toCtx, cancel := context.WithTimeout(ctx, s.config.EtcdS3Timeout)
+	defer cancel()
+
+	for _, name := range names {
+		key := name
+		if s.config.EtcdS3Folder != "" && !strings.HasPrefix(name, s.config.EtcdS3Folder+"/") {
+			key = s.objectKey(name)
+		}
+		if err := s.client.RemoveObject(toCtx, s.config.EtcdS3BucketName, key, minio.RemoveObjectOptions{}); err != nil {
+			logrus.Errorf("Unable to delete snapshot %s: %v", key, err)
+		}
+		if err := s.client.RemoveObject(toCtx, s.config.EtcdS3BucketName, key+checksumExtension, minio.RemoveObjectOptions{}); err != nil {
+			logrus.Errorf("Unable to delete checksum of snapshot %s: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+// objectKey returns the key of the object holding the named snapshot.
+func (s *S3) objectKey(name string) string {
+	if s.config.EtcdS3Folder != "" {
+		return filepath.Join(s.config.EtcdS3Folder, name)
+	}
+	return name
 }
 
 // snapshotPrefix returns the prefix used in the
 // naming of the snapshots.
-func (s *S3) snapshotPrefix() string {
+func (s *S3) snapshotPrefix(snapshotName string) string {
 	nodeName := os.Getenv("NODE_NAME")
-	fullSnapshotPrefix := s.config.EtcdSnapshotName + "-" + nodeName
-	var prefix string
-	if s.config.EtcdS3Folder != "" {
-		prefix = filepath.Join(s.config.EtcdS3Folder, fullSnapshotPrefix)
-	} else {
-		prefix = fullSnapshotPrefix
-	}
-	return prefix
+	return s.objectKey(snapshotName + "-" + nodeName)
 }
 
-// snapshotRetention prunes snapshots in the configured S3 compatible backend for this specific node.
-func (s *S3) snapshotRetention(ctx context.Context) error {
-	if s.config.EtcdSnapshotRetention < 1 {
+// Retention prunes snapshots in the configured S3 compatible backend for this specific node,
+// or for all nodes if the policy applies to all nodes.
+func (s *S3) Retention(ctx context.Context, policy retentionPolicy, snapshotName string) error {
+	if !policy.enabled() {
 		return nil
 	}
-	logrus.Infof("Applying snapshot retention policy to snapshots stored in S3: retention: %d, snapshotPrefix: %s", s.config.EtcdSnapshotRetention, s.snapshotPrefix())
+	prefix := s.snapshotPrefix(snapshotName)
+	if policy.AllNodes {
+		prefix = s.objectKey(snapshotName + "-")
+	}
+	logrus.Infof("Applying snapshot retention policy to snapshots stored in S3: %s, snapshotPrefix: %s", policy, prefix)
 
-	var snapshotFiles []minio.ObjectInfo
+	var candidates []retentionCandidate
 
 	toCtx, cancel := context.WithTimeout(ctx, s.config.EtcdS3Timeout)
 	defer cancel()
 
 	loo := minio.ListObjectsOptions{
 		Recursive: true,
-		Prefix:    s.snapshotPrefix(),
+		Prefix:    prefix,
 	}
 	for info := range s.client.ListObjects(toCtx, s.config.EtcdS3BucketName, loo) {
 		if info.Err != nil {
 			return info.Err
 		}
-		snapshotFiles = append(snapshotFiles, info)
-	}
-
-	if len(snapshotFiles) <= s.config.EtcdSnapshotRetention {
-		return nil
+		if isChecksumFile(info.Key) {
+			continue
+		}
+		candidates = append(candidates, retentionCandidate{
+			Name: info.Key,
+			Time: snapshotTime(filepath.Base(info.Key), info.LastModified),
+		})
 	}
 
-	sort.Slice(snapshotFiles, func(i, j int) bool {
-		return snapshotFiles[i].Key < snapshotFiles[j].Key
-	})
-
-	delCount := len(snapshotFiles) - s.config.EtcdSnapshotRetention
-	for _, df := range snapshotFiles[:delCount] {
-		logrus.Infof("Removing S3 snapshot: %s", df.Key)
-		if err := s.client.RemoveObject(ctx, s.config.EtcdS3BucketName, df.Key, minio.RemoveObjectOptions{}); err != nil {
+	for _, key := range policy.expired(candidates, time.Now()) {
+		logrus.Infof("Removing S3 snapshot: %s", key)
+		if err := s.client.RemoveObject(ctx, s.config.EtcdS3BucketName, key, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+		if err := s.client.RemoveObject(ctx, s.config.EtcdS3BucketName, key+checksumExtension, minio.RemoveObjectOptions{}); err != nil {
 			return err
 		}
+		snapshotRetentionDeletions.WithLabelValues(s3StoreName).Inc()
 	}
 
 	return nil
 }
 
+// newS3Config returns the S3 settings recorded in the metadata of snapshots stored in S3.
+func newS3Config(config *config.Control) *s3Config {
+	return &s3Config{
+		Endpoint:      config.EtcdS3Endpoint,
+		EndpointCA:    config.EtcdS3EndpointCA,
+		SkipSSLVerify: config.EtcdS3SkipSSLVerify,
+		Bucket:        config.EtcdS3BucketName,
+		Region:        config.EtcdS3Region,
+		Folder:        config.EtcdS3Folder,
+		Insecure:      config.EtcdS3Insecure,
+	}
+}
+
 func readS3EndpointCA(endpointCA string) ([]byte, error) {
 	ca, err := base64.StdEncoding.DecodeString(endpointCA)
 	if err != nil {
@@ -272,21 +431,54 @@ func readS3EndpointCA(endpointCA string) ([]byte, error) {
 	return ca, nil
 }
 
-func setTransportCA(tr http.RoundTripper, endpointCA string, insecureSkipVerify bool) (http.RoundTripper, error) {
-	ca, err := readS3EndpointCA(endpointCA)
-	if err != nil {
-		return tr, err
+// newS3Transport returns the transport used for all S3 traffic. The transport is cloned from the
+// default transport, so that the TLS, proxy and connection settings configured for S3 do not affect
+// any other client in the process. If no proxy is configured for S3, the proxy environment variables
+// are honored as usual.
+func newS3Transport(config *config.Control) (*http.Transport, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.EtcdS3SkipSSLVerify,
 	}
-	if !isValidCertificate(ca) {
-		return tr, errors.New("endpoint-ca is not a valid x509 certificate")
+	if config.EtcdS3EndpointCA != "" {
+		ca, err := readS3EndpointCA(config.EtcdS3EndpointCA)
+		if err != nil {
+			return nil, err
+		}
+		if !isValidCertificate(ca) {
+			return nil, errors.New("endpoint-ca is not a valid x509 certificate")
+		}
+		certPool := x509.NewCertPool()
+		certPool.AppendCertsFromPEM(ca)
+		tlsConfig.RootCAs = certPool
 	}
+	if config.EtcdS3TLSMinVersion != "" {
+		minVersion, err := kubeapiserverflag.TLSVersion(config.EtcdS3TLSMinVersion)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid s3 tls-min-version")
+		}
+		tlsConfig.MinVersion = minVersion
+	}
+	tr.TLSClientConfig = tlsConfig
 
-	certPool := x509.NewCertPool()
-	certPool.AppendCertsFromPEM(ca)
+	if config.EtcdS3Proxy != "" {
+		proxyURL, err := url.Parse(config.EtcdS3Proxy)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid s3 proxy URL")
+		}
+		if proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid s3 proxy URL %q: must include a scheme and host", config.EtcdS3Proxy)
+		}
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
 
-	tr.(*http.Transport).TLSClientConfig = &tls.Config{
-		RootCAs:            certPool,
-		InsecureSkipVerify: insecureSkipVerify,
+	if config.EtcdS3MaxConns > 0 {
+		tr.MaxConnsPerHost = config.EtcdS3MaxConns
+	}
+	if config.EtcdS3MaxIdleConns > 0 {
+		tr.MaxIdleConns = config.EtcdS3MaxIdleConns
+		tr.MaxIdleConnsPerHost = config.EtcdS3MaxIdleConns
 	}
 
 	return tr, nil
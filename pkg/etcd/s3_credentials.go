@@ -0,0 +1,266 @@
+package etcd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/wangxiaochuang/k3s/pkg/daemons/config"
+	"github.com/wangxiaochuang/k3s/pkg/version"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	defaultAWSProfile     = "default"
+	defaultSTSEndpoint    = "https://sts.amazonaws.com"
+	awsAccessKeyID        = "aws_access_key_id"
+	awsSecretAccessKey    = "aws_secret_access_key"
+	awsRoleARN            = "role_arn"
+	awsWebIdentityToken   = "web_identity_token_file"
+	awsCredentialsDirName = ".aws"
+
+	stsAPIVersion = "2011-06-15"
+	// webIdentityExpiryWindow is how long before they expire that assumed role credentials are refreshed.
+	webIdentityExpiryWindow = time.Minute
+)
+
+// newS3Credentials returns the credentials used to access S3. Credentials given explicitly in the
+// configuration are used in preference to all other sources. These are, in order: static access and
+// secret keys with an optional session token, a role assumed using a web identity token file, a profile
+// in a shared credentials file, and a profile in a shared config file. If none of these are set, the
+// default shared credentials and config files are tried, followed by the IAM sources available to the
+// instance, which include a web identity set in the environment.
+func newS3Credentials(config *config.Control) (*credentials.Credentials, error) {
+	profile := config.EtcdS3Profile
+	if profile == "" {
+		profile = defaultAWSProfile
+	}
+
+	switch {
+	case config.EtcdS3AccessKey != "" || config.EtcdS3SecretKey != "":
+		return credentials.NewStaticV4(config.EtcdS3AccessKey, config.EtcdS3SecretKey, config.EtcdS3SessionToken), nil
+	case config.EtcdS3WebIdentityFile != "" || config.EtcdS3RoleARN != "":
+		if config.EtcdS3WebIdentityFile == "" || config.EtcdS3RoleARN == "" {
+			return nil, errors.New("s3 web identity requires both a role ARN and a web identity token file")
+		}
+		return credentials.New(newWebIdentityProvider(config, config.EtcdS3RoleARN, config.EtcdS3WebIdentityFile)), nil
+	case config.EtcdS3CredentialsFile != "":
+		if _, err := loadAWSProfile(config.EtcdS3CredentialsFile, profile); err != nil {
+			return nil, err
+		}
+		return credentials.New(newFileCredentials(config.EtcdS3CredentialsFile, profile)), nil
+	case config.EtcdS3ConfigFile != "":
+		provider, err := newConfigFileProvider(config, config.EtcdS3ConfigFile, profile)
+		if err != nil {
+			return nil, err
+		}
+		return credentials.New(provider), nil
+	}
+
+	// Fall back to the default locations used by the AWS tools, and then to IAM.
+	var providers []credentials.Provider
+	if home, err := os.UserHomeDir(); err == nil {
+		credentialsFile := filepath.Join(home, awsCredentialsDirName, "credentials")
+		if _, err := loadAWSProfile(credentialsFile, profile); err == nil {
+			logrus.Infof("Using S3 credentials from profile %s in %s", profile, credentialsFile)
+			providers = append(providers, newFileCredentials(credentialsFile, profile))
+		}
+		configFile := filepath.Join(home, awsCredentialsDirName, "config")
+		if provider, err := newConfigFileProvider(config, configFile, profile); err == nil {
+			logrus.Infof("Using S3 credentials from profile %s in %s", profile, configFile)
+			providers = append(providers, provider)
+		}
+	}
+	// The instance metadata service is local, so it is not reached through the S3 transport and its proxy.
+	providers = append(providers, &credentials.IAM{
+		Client: &http.Client{Transport: http.DefaultTransport},
+	})
+	return credentials.NewChainCredentials(providers), nil
+}
+
+// newConfigFileProvider returns a provider for a profile in a shared config file. The profile
+// may either assume a role using a web identity token file, or hold keys directly, in which case
+// the file is re-read whenever it changes.
+func newConfigFileProvider(config *config.Control, path, profile string) (credentials.Provider, error) {
+	section := configFileProfile(profile)
+	values, err := loadAWSProfile(path, section)
+	if err != nil {
+		return nil, err
+	}
+	roleARN := values.Key(awsRoleARN).String()
+	tokenFile := values.Key(awsWebIdentityToken).String()
+	if roleARN != "" || tokenFile != "" {
+		if roleARN == "" || tokenFile == "" {
+			return nil, fmt.Errorf("profile %s in %s must set both %s and %s to assume a role", profile, path, awsRoleARN, awsWebIdentityToken)
+		}
+		return newWebIdentityProvider(config, roleARN, tokenFile), nil
+	}
+	return newFileCredentials(path, section), nil
+}
+
+// configFileProfile returns the name of the section holding the given profile in a shared config
+// file, where profiles other than the default are named "profile <name>".
+func configFileProfile(profile string) string {
+	if profile == defaultAWSProfile {
+		return profile
+	}
+	return "profile " + profile
+}
+
+// loadAWSProfile returns the named section of an AWS shared credentials or config file.
+func loadAWSProfile(path, section string) (*ini.Section, error) {
+	file, err := ini.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	values, err := file.GetSection(section)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s not found in %s", section, path)
+	}
+	return values, nil
+}
+
+// newWebIdentityProvider returns a provider for a role assumed using the given web identity token file.
+// STS is not reached through the S3 transport, as the S3 proxy and endpoint CA apply only to the S3
+// endpoint; requests use the system roots and the proxy environment variables instead.
+func newWebIdentityProvider(config *config.Control, roleARN, tokenFile string) credentials.Provider {
+	stsEndpoint := config.EtcdS3STSEndpoint
+	if stsEndpoint == "" {
+		stsEndpoint = defaultSTSEndpoint
+	}
+	logrus.Infof("Using S3 credentials for role %s assumed with web identity token %s", roleARN, tokenFile)
+	return &webIdentityCredentials{
+		client:    &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone(), Timeout: config.EtcdS3Timeout},
+		endpoint:  stsEndpoint,
+		roleARN:   roleARN,
+		tokenFile: tokenFile,
+	}
+}
+
+// webIdentityCredentials provides credentials for a role assumed by calling AssumeRoleWithWebIdentity on
+// the STS endpoint. The token file is read each time the credentials are refreshed, so that rotated tokens
+// are used.
+type webIdentityCredentials struct {
+	credentials.Expiry
+
+	client    *http.Client
+	endpoint  string
+	roleARN   string
+	tokenFile string
+}
+
+// assumeRoleWithWebIdentityResponse is the response to an STS AssumeRoleWithWebIdentity request.
+type assumeRoleWithWebIdentityResponse struct {
+	Result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"Credentials"`
+	} `xml:"AssumeRoleWithWebIdentityResult"`
+}
+
+func (w *webIdentityCredentials) Retrieve() (credentials.Value, error) {
+	token, err := ioutil.ReadFile(w.tokenFile)
+	if err != nil {
+		return credentials.Value{}, errors.Wrap(err, "failed to read web identity token file")
+	}
+
+	form := url.Values{}
+	form.Set("Action", "AssumeRoleWithWebIdentity")
+	form.Set("Version", stsAPIVersion)
+	form.Set("RoleArn", w.roleARN)
+	form.Set("RoleSessionName", version.Program+"-etcd-snapshot")
+	form.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+
+	resp, err := w.client.PostForm(w.endpoint, form)
+	if err != nil {
+		return credentials.Value{}, errors.Wrap(err, "failed to assume role with web identity")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return credentials.Value{}, fmt.Errorf("failed to assume role %s with web identity: %s: %s", w.roleARN, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	result := &assumeRoleWithWebIdentityResponse{}
+	if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return credentials.Value{}, errors.Wrap(err, "failed to decode AssumeRoleWithWebIdentity response")
+	}
+	creds := result.Result.Credentials
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return credentials.Value{}, fmt.Errorf("no credentials returned for role %s", w.roleARN)
+	}
+
+	w.SetExpiration(creds.Expiration, webIdentityExpiryWindow)
+	return credentials.Value{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+// fileCredentials provides credentials from a profile in a shared credentials or config file.
+// The credentials expire whenever the file is modified, so that rotated keys are picked up
+// without a restart.
+type fileCredentials struct {
+	credentials.FileAWSCredentials
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+func newFileCredentials(path, profile string) *fileCredentials {
+	return &fileCredentials{
+		FileAWSCredentials: credentials.FileAWSCredentials{
+			Filename: path,
+			Profile:  profile,
+		},
+	}
+}
+
+func (f *fileCredentials) Retrieve() (credentials.Value, error) {
+	info, err := os.Stat(f.Filename)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	value, err := f.FileAWSCredentials.Retrieve()
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	if value.AccessKeyID == "" || value.SecretAccessKey == "" {
+		return credentials.Value{}, fmt.Errorf("profile %s in %s does not contain %s and %s", f.Profile, f.Filename, awsAccessKeyID, awsSecretAccessKey)
+	}
+
+	f.mu.Lock()
+	f.modTime = info.ModTime()
+	f.mu.Unlock()
+
+	return value, nil
+}
+
+func (f *fileCredentials) IsExpired() bool {
+	info, err := os.Stat(f.Filename)
+	if err != nil {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !info.ModTime().Equal(f.modTime)
+}
@@ -0,0 +1,247 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// minS3PartSize is the smallest part size accepted by S3 for all but the last part of an upload.
+	minS3PartSize = 5 * 1024 * 1024
+	// maxS3Parts is the largest number of parts that a single S3 upload may be split into.
+	maxS3Parts = 10000
+)
+
+// partSize returns the configured size of each part of a multipart upload, in bytes.
+func (s *S3) partSize() int {
+	size := s.config.EtcdS3PartSize * 1024 * 1024
+	if size < minS3PartSize {
+		return minS3PartSize
+	}
+	return size
+}
+
+// concurrency returns the configured number of parts to upload in parallel.
+func (s *S3) concurrency() int {
+	if s.config.EtcdS3Concurrency < 1 {
+		return 1
+	}
+	return s.config.EtcdS3Concurrency
+}
+
+// partTimeout returns the timeout for each attempt to upload a single part,
+// falling back to the general S3 timeout if none is configured.
+func (s *S3) partTimeout() time.Duration {
+	if s.config.EtcdS3PartTimeout > 0 {
+		return s.config.EtcdS3PartTimeout
+	}
+	return s.config.EtcdS3Timeout
+}
+
+// UploadStream uploads a snapshot read from the given reader to the configured S3 compatible
+// backend, under the given name. The checksum of the snapshot is only known once the upload
+// has completed, so it is stored alongside the snapshot in a separate checksum object.
+func (s *S3) UploadStream(ctx context.Context, name string, r io.Reader, extraMetadata string, revision int64, now time.Time) (*snapshotFile, error) {
+	logrus.Infof("Streaming snapshot %s to S3", name)
+	snapshotFileName := s.objectKey(name)
+
+	h := sha256.New()
+	if err := s.putObject(ctx, snapshotFileName, io.TeeReader(r, h), s.putObjectOptions(snapshotFileName, revision)); err != nil {
+		return s.uploadResult(ctx, snapshotFileName, extraMetadata, "", now, err)
+	}
+
+	checksum := hex.EncodeToString(h.Sum(nil))
+	if err := s.putChecksumObject(ctx, snapshotFileName, checksum, revision); err != nil {
+		logrus.Warnf("Failed to store checksum of S3 snapshot %s: %v", snapshotFileName, err)
+	}
+	return s.uploadResult(ctx, snapshotFileName, extraMetadata, checksum, now, nil)
+}
+
+// putChecksumObject stores the checksum of the given snapshot in an object alongside it,
+// in the same format as the local checksum file.
+func (s *S3) putChecksumObject(ctx context.Context, key, checksum string, revision int64) error {
+	toCtx, cancel := context.WithTimeout(ctx, s.config.EtcdS3Timeout)
+	defer cancel()
+	data := fmt.Sprintf("%s  %s\n", checksum, filepath.Base(key))
+	opts := s.putObjectOptions(key+checksumExtension, revision)
+	opts.ContentType = "text/plain"
+	_, err := s.client.PutObject(toCtx, s.config.EtcdS3BucketName, key+checksumExtension, strings.NewReader(data), int64(len(data)), opts)
+	return err
+}
+
+// readChecksumObject returns the checksum held in the checksum object stored alongside the given snapshot.
+func (s *S3) readChecksumObject(ctx context.Context, key string) (string, error) {
+	r, err := s.client.GetObject(ctx, s.config.EtcdS3BucketName, key+checksumExtension, minio.GetObjectOptions{ServerSideEncryption: s.customerEncryption()})
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("checksum object for %s is empty", key)
+	}
+	return fields[0], nil
+}
+
+// putObject uploads the contents of the reader to the given key as a multipart upload. The reader
+// is consumed one part at a time, so its length does not need to be known in advance. Each part is
+// uploaded with its own timeout and is retried on failure; if any part cannot be uploaded, the
+// whole upload is aborted so that no partial object is left behind.
+func (s *S3) putObject(ctx context.Context, key string, r io.Reader, opts minio.PutObjectOptions) error {
+	core := &minio.Core{Client: s.client}
+
+	toCtx, cancel := context.WithTimeout(ctx, s.config.EtcdS3Timeout)
+	uploadID, err := core.NewMultipartUpload(toCtx, s.config.EtcdS3BucketName, key, opts)
+	cancel()
+	if err != nil {
+		return errors.Wrap(err, "failed to start multipart upload")
+	}
+
+	parts, err := s.putObjectParts(ctx, core, key, uploadID, r)
+	if err != nil {
+		// use a fresh context, as the upload may have failed because the parent was cancelled
+		abortCtx, cancel := context.WithTimeout(context.Background(), s.config.EtcdS3Timeout)
+		defer cancel()
+		if abortErr := core.AbortMultipartUpload(abortCtx, s.config.EtcdS3BucketName, key, uploadID); abortErr != nil {
+			logrus.Warnf("Failed to abort multipart upload of S3 snapshot %s: %v", key, abortErr)
+		}
+		return err
+	}
+
+	toCtx, cancel = context.WithTimeout(ctx, s.config.EtcdS3Timeout)
+	defer cancel()
+	if _, err := core.CompleteMultipartUpload(toCtx, s.config.EtcdS3BucketName, key, uploadID, parts, minio.PutObjectOptions{}); err != nil {
+		return errors.Wrap(err, "failed to complete multipart upload")
+	}
+	return nil
+}
+
+// putObjectParts reads the reader in part-sized chunks and uploads up to the configured
+// number of parts concurrently, returning the completed parts in order.
+func (s *S3) putObjectParts(ctx context.Context, core *minio.Core, key, uploadID string, r io.Reader) ([]minio.CompletePart, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		parts    []minio.CompletePart
+		firstErr error
+	)
+	setErr := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	// Each slot in the buffer pool holds the buffer of a part that may be uploading, so that at most
+	// the configured number of part buffers are allocated, and are reused once their part is done.
+	partSize := s.partSize()
+	bufs := make(chan []byte, s.concurrency())
+	for i := 0; i < cap(bufs); i++ {
+		bufs <- nil
+	}
+	for partNumber := 1; ; partNumber++ {
+		if partNumber > maxS3Parts {
+			setErr(fmt.Errorf("snapshot exceeds the maximum of %d parts of %d bytes; increase the S3 part size", maxS3Parts, partSize))
+			break
+		}
+
+		var buf []byte
+		select {
+		case buf = <-bufs:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			setErr(ctx.Err())
+			break
+		}
+		if buf == nil {
+			buf = make([]byte, partSize)
+		}
+
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF && partNumber > 1 {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			setErr(errors.Wrap(err, "failed to read snapshot"))
+			break
+		}
+
+		wg.Add(1)
+		go func(partNumber int, buf []byte, n int) {
+			defer wg.Done()
+			defer func() { bufs <- buf }()
+			part, err := s.putObjectPart(ctx, core, key, uploadID, partNumber, buf[:n])
+			if err != nil {
+				setErr(err)
+				return
+			}
+			mu.Lock()
+			parts = append(parts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+			mu.Unlock()
+		}(partNumber, buf, n)
+
+		if n < partSize {
+			break
+		}
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+// putObjectPart uploads a single part, retrying it up to the configured number of times.
+func (s *S3) putObjectPart(ctx context.Context, core *minio.Core, key, uploadID string, partNumber int, data []byte) (minio.ObjectPart, error) {
+	var err error
+	for attempt := 0; attempt <= s.config.EtcdS3PartRetries; attempt++ {
+		if attempt > 0 {
+			logrus.Warnf("Retrying upload of part %d of S3 snapshot %s after error: %v", partNumber, key, err)
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-ctx.Done():
+				return minio.ObjectPart{}, ctx.Err()
+			}
+		}
+
+		toCtx, cancel := context.WithTimeout(ctx, s.partTimeout())
+		var part minio.ObjectPart
+		part, err = core.PutObjectPart(toCtx, s.config.EtcdS3BucketName, key, uploadID, partNumber, bytes.NewReader(data), int64(len(data)), "", "", s.customerEncryption())
+		cancel()
+		if err == nil {
+			return part, nil
+		}
+		if ctx.Err() != nil {
+			return minio.ObjectPart{}, ctx.Err()
+		}
+	}
+	return minio.ObjectPart{}, errors.Wrapf(err, "failed to upload part %d after %d attempts", partNumber, s.config.EtcdS3PartRetries+1)
+}
@@ -0,0 +1,216 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/wangxiaochuang/k3s/pkg/daemons/config"
+)
+
+const testUploadID = "test-upload"
+
+// s3Stub is a minimal S3 stand-in that implements the multipart upload API. Each part
+// fails the given number of times before it is accepted.
+type s3Stub struct {
+	mu       sync.Mutex
+	failures map[int]int
+	attempts map[int]int
+	parts    map[int][]byte
+	object   []byte
+	aborted  bool
+}
+
+func newS3Stub(failures map[int]int) *s3Stub {
+	return &s3Stub{
+		failures: failures,
+		attempts: map[int]int{},
+		parts:    map[int][]byte{},
+	}
+}
+
+func (st *s3Stub) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	_, initiate := query["uploads"]
+	_, upload := query["uploadId"]
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	switch {
+	case req.Method == http.MethodPost && initiate:
+		writeS3Response(rw, http.StatusOK, fmt.Sprintf("<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>snapshot</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", testUploadID))
+	case req.Method == http.MethodPut && upload:
+		partNumber, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil {
+			writeS3Response(rw, http.StatusBadRequest, "<Error><Code>InvalidArgument</Code><Message>invalid part number</Message></Error>")
+			return
+		}
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeS3Response(rw, http.StatusBadRequest, "<Error><Code>IncompleteBody</Code><Message>failed to read part</Message></Error>")
+			return
+		}
+		st.attempts[partNumber]++
+		if st.attempts[partNumber] <= st.failures[partNumber] {
+			writeS3Response(rw, http.StatusBadRequest, "<Error><Code>BadDigest</Code><Message>injected failure</Message></Error>")
+			return
+		}
+		st.parts[partNumber] = data
+		rw.Header().Set("ETag", fmt.Sprintf("\"etag-%d\"", partNumber))
+		rw.WriteHeader(http.StatusOK)
+	case req.Method == http.MethodPost && upload:
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.NewDecoder(req.Body).Decode(&complete); err != nil {
+			writeS3Response(rw, http.StatusBadRequest, "<Error><Code>MalformedXML</Code><Message>invalid request</Message></Error>")
+			return
+		}
+		var object []byte
+		for _, part := range complete.Parts {
+			object = append(object, st.parts[part.PartNumber]...)
+		}
+		st.object = object
+		writeS3Response(rw, http.StatusOK, "<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>snapshot</Key><ETag>\"etag\"</ETag></CompleteMultipartUploadResult>")
+	case req.Method == http.MethodDelete && upload:
+		st.aborted = true
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Response(rw, http.StatusNotImplemented, "<Error><Code>NotImplemented</Code><Message>not implemented</Message></Error>")
+	}
+}
+
+func writeS3Response(rw http.ResponseWriter, status int, body string) {
+	rw.Header().Set("Content-Type", "application/xml")
+	rw.WriteHeader(status)
+	rw.Write([]byte(xml.Header + body))
+}
+
+// newTestS3 returns an S3 store that uploads to the given stub in parts of the minimum size.
+func newTestS3(t *testing.T, stub *s3Stub) *S3 {
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+
+	client, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+		Creds:        credentials.NewStaticV4("access", "secret", ""),
+		Secure:       false,
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &S3{
+		config: &config.Control{
+			EtcdS3BucketName:  "bucket",
+			EtcdS3Timeout:     30 * time.Second,
+			EtcdS3PartSize:    minS3PartSize / 1024 / 1024,
+			EtcdS3Concurrency: 2,
+			EtcdS3PartRetries: 1,
+		},
+		client: client,
+	}
+}
+
+func testSnapshotData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func Test_UnitPutObject(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int
+		failures    map[int]int
+		wantErr     bool
+		wantAborted bool
+		wantParts   []int
+	}{
+		{
+			name:      "single part",
+			size:      1024,
+			wantParts: []int{1},
+		},
+		{
+			name:      "multiple parts",
+			size:      2*minS3PartSize + 1234,
+			wantParts: []int{1, 2, 3},
+		},
+		{
+			name:      "part retried",
+			size:      2*minS3PartSize + 1234,
+			failures:  map[int]int{2: 1},
+			wantParts: []int{1, 2, 3},
+		},
+		{
+			name:        "part failed and upload aborted",
+			size:        2*minS3PartSize + 1234,
+			failures:    map[int]int{2: 2},
+			wantErr:     true,
+			wantAborted: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newS3Stub(tt.failures)
+			s := newTestS3(t, stub)
+			data := testSnapshotData(tt.size)
+
+			err := s.putObject(context.Background(), "snapshot", bytes.NewReader(data), minio.PutObjectOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("putObject() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			stub.mu.Lock()
+			defer stub.mu.Unlock()
+			if stub.aborted != tt.wantAborted {
+				t.Errorf("upload aborted = %v, want %v", stub.aborted, tt.wantAborted)
+			}
+			for partNumber, failures := range tt.failures {
+				if want := failures + 1; !tt.wantErr && stub.attempts[partNumber] != want {
+					t.Errorf("part %d attempts = %d, want %d", partNumber, stub.attempts[partNumber], want)
+				}
+				if want := s.config.EtcdS3PartRetries + 1; tt.wantErr && stub.attempts[partNumber] != want {
+					t.Errorf("part %d attempts = %d, want %d", partNumber, stub.attempts[partNumber], want)
+				}
+			}
+			if tt.wantErr {
+				if stub.object != nil {
+					t.Errorf("upload was completed after a part failed")
+				}
+				return
+			}
+
+			var parts []int
+			for partNumber := range stub.parts {
+				parts = append(parts, partNumber)
+			}
+			sort.Ints(parts)
+			if fmt.Sprint(parts) != fmt.Sprint(tt.wantParts) {
+				t.Errorf("uploaded parts = %v, want %v", parts, tt.wantParts)
+			}
+			if !bytes.Equal(stub.object, data) {
+				t.Errorf("uploaded object does not match the snapshot: got %d bytes, want %d", len(stub.object), len(data))
+			}
+		})
+	}
+}
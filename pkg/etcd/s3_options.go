@@ -0,0 +1,141 @@
+package etcd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/pkg/errors"
+	"github.com/wangxiaochuang/k3s/pkg/daemons/config"
+	"github.com/wangxiaochuang/k3s/pkg/version"
+)
+
+const (
+	// sseS3 and sseKMS are the accepted values of the S3 server-side encryption option,
+	// matching the values of the x-amz-server-side-encryption header.
+	sseS3  = "AES256"
+	sseKMS = "aws:kms"
+	// sseCKeySize is the size of the customer-provided key used for SSE-C.
+	sseCKeySize = 32
+
+	nodeMetadataKey     = "Snapshot-Node"
+	versionMetadataKey  = "Snapshot-Version"
+	revisionMetadataKey = "Snapshot-Revision"
+)
+
+// newS3ServerSideEncryption returns the server-side encryption to request for uploaded snapshots,
+// or nil if none is configured. A customer-provided key takes precedence over the other methods,
+// and setting a KMS key ID implies SSE-KMS.
+func newS3ServerSideEncryption(config *config.Control) (encrypt.ServerSide, error) {
+	if config.EtcdS3SSECKeyFile != "" {
+		if config.EtcdS3SSE != "" || config.EtcdS3SSEKMSKeyID != "" {
+			return nil, errors.New("s3 SSE-C cannot be combined with SSE-S3 or SSE-KMS")
+		}
+		key, err := readS3SSECKey(config.EtcdS3SSECKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return encrypt.NewSSEC(key)
+	}
+
+	switch config.EtcdS3SSE {
+	case "":
+		if config.EtcdS3SSEKMSKeyID == "" {
+			return nil, nil
+		}
+		return encrypt.NewSSEKMS(config.EtcdS3SSEKMSKeyID, nil)
+	case sseKMS:
+		return encrypt.NewSSEKMS(config.EtcdS3SSEKMSKeyID, nil)
+	case sseS3:
+		if config.EtcdS3SSEKMSKeyID != "" {
+			return nil, fmt.Errorf("s3 SSE KMS key ID cannot be used with %s server-side encryption", sseS3)
+		}
+		return encrypt.NewSSE(), nil
+	}
+	return nil, fmt.Errorf("invalid s3 server-side encryption %q: must be %s or %s", config.EtcdS3SSE, sseS3, sseKMS)
+}
+
+// readS3SSECKey reads the SSE-C customer key from the given file. The file may hold
+// the raw 32 byte key, or the key encoded as base64.
+func readS3SSECKey(keyFile string) ([]byte, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read s3 SSE-C key file")
+	}
+	if len(data) == sseCKeySize {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != sseCKeySize {
+		return nil, fmt.Errorf("s3 SSE-C key file %s must contain a %d byte key, or the key encoded as base64", keyFile, sseCKeySize)
+	}
+	return key, nil
+}
+
+// parseS3KeyValues parses a list of key=value pairs, as given to the S3 tag and metadata options.
+func parseS3KeyValues(option string, pairs []string) (map[string]string, error) {
+	values := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid s3 %s %q: must be in the form key=value", option, pair)
+		}
+		values[kv[0]] = kv[1]
+	}
+	return values, nil
+}
+
+// putObjectOptions returns the options used for all snapshot uploads. The content type is set from the
+// name of the snapshot. Along with any configured metadata, the name of this node, the version and the
+// etcd revision of the snapshot are recorded in the object metadata.
+func (s *S3) putObjectOptions(name string, revision int64) minio.PutObjectOptions {
+	metadata := map[string]string{
+		nodeMetadataKey:    os.Getenv("NODE_NAME"),
+		versionMetadataKey: version.Program + " " + version.Version,
+	}
+	if revision > 0 {
+		metadata[revisionMetadataKey] = strconv.FormatInt(revision, 10)
+	}
+	for k, v := range s.metadata {
+		metadata[k] = v
+	}
+
+	return minio.PutObjectOptions{
+		ContentType:          snapshotContentType(name),
+		UserMetadata:         metadata,
+		UserTags:             s.tags,
+		StorageClass:         s.config.EtcdS3StorageClass,
+		ServerSideEncryption: s.sse,
+	}
+}
+
+// snapshotContentType returns the content type of the named snapshot. Encrypted and uncompressed
+// snapshots have no more specific type than a stream of bytes.
+func snapshotContentType(name string) string {
+	switch {
+	case strings.HasSuffix(name, encryptedExtension):
+		return "application/octet-stream"
+	case strings.HasSuffix(name, compressedExtensions[zipCompression]):
+		return "application/zip"
+	case strings.HasSuffix(name, compressedExtensions[gzipCompression]):
+		return "application/gzip"
+	case strings.HasSuffix(name, compressedExtensions[zstdCompression]):
+		return "application/zstd"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// customerEncryption returns the configured server-side encryption if it uses a customer-provided
+// key, which must also be sent when reading objects back, or when uploading individual parts.
+func (s *S3) customerEncryption() encrypt.ServerSide {
+	if s.sse != nil && s.sse.Type() == encrypt.SSEC {
+		return s.sse
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package etcd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// snapshotHandlers registers the snapshot API on the supervisor router. All snapshot operations require
+// a client authenticated by the apiserver as a member of the system:masters group, such as the admin
+// kubeconfig. Responses hold the affected snapshots as a JSON list of snapshotFile records.
+func (e *ETCD) snapshotHandlers(router *mux.Router) {
+	router.Path("/db/snapshot").Methods(http.MethodPost).Handler(e.snapshotAuthMiddleware(e.saveSnapshotHandler()))
+	router.Path("/db/snapshots").Methods(http.MethodGet).Handler(e.snapshotAuthMiddleware(e.listSnapshotsHandler()))
+	router.Path("/db/snapshots/prune").Methods(http.MethodPost).Handler(e.snapshotAuthMiddleware(e.pruneSnapshotsHandler()))
+	router.Path("/db/snapshots/{name}").Methods(http.MethodDelete).Handler(e.snapshotAuthMiddleware(e.deleteSnapshotHandler()))
+}
+
+// snapshotAuthMiddleware rejects requests that are not authenticated as a member of the system:masters group.
+func (e *ETCD) snapshotAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if e.config.Runtime.Authenticator == nil {
+			http.Error(rw, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		resp, ok, err := e.config.Runtime.Authenticator.AuthenticateRequest(req)
+		if err != nil {
+			logrus.Errorf("Failed to authenticate etcd snapshot request: %v", err)
+		}
+		if !ok || err != nil {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		for _, group := range resp.User.GetGroups() {
+			if group == user.SystemPrivilegedGroup {
+				next.ServeHTTP(rw, req)
+				return
+			}
+		}
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+	})
+}
+
+// saveSnapshotHandler takes an on-demand snapshot. The snapshot name prefix may be set with the name query parameter.
+// If saving the snapshot to any store failed, the failures are returned with a 5xx status.
+func (e *ETCD) saveSnapshotHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if e.config.EtcdDisableSnapshots {
+			http.Error(rw, "etcd snapshots are disabled", http.StatusConflict)
+			return
+		}
+
+		schedule := defaultSnapshotSchedule(e.config)
+		if name := req.URL.Query().Get("name"); name != "" {
+			if strings.ContainsAny(name, "/\\") {
+				http.Error(rw, "invalid snapshot name", http.StatusBadRequest)
+				return
+			}
+			schedule.Name = name
+		}
+
+		if err := e.preSnapshotSetup(req.Context(), e.config); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		results, err := e.snapshot(req.Context(), schedule)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(results) == 0 {
+			http.Error(rw, "snapshot was not taken: snapshots cannot be taken by etcd learners", http.StatusConflict)
+			return
+		}
+		if failures := failedSnapshotMessages(results); len(failures) > 0 {
+			http.Error(rw, strings.Join(failures, "; "), http.StatusInternalServerError)
+			return
+		}
+		writeSnapshotFiles(rw, http.StatusCreated, results)
+	})
+}
+
+// listSnapshotsHandler lists the snapshots held by S3 if it is enabled, or otherwise by the local and mirror directories.
+func (e *ETCD) listSnapshotsHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		snapshots, err := e.ListSnapshots(req.Context())
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeSnapshotFiles(rw, http.StatusOK, sortedSnapshotFiles(snapshots))
+	})
+}
+
+// pruneSnapshotsHandler applies the configured retention policy, and lists the snapshots that remain.
+func (e *ETCD) pruneSnapshotsHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if err := e.PruneSnapshots(req.Context()); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		snapshots, err := e.ListSnapshots(req.Context())
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeSnapshotFiles(rw, http.StatusOK, sortedSnapshotFiles(snapshots))
+	})
+}
+
+// deleteSnapshotHandler removes the named snapshot from S3 if it is enabled, or otherwise from the local and
+// mirror directories, and returns the snapshot that was removed.
+func (e *ETCD) deleteSnapshotHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		name := mux.Vars(req)["name"]
+		sf, err := e.findSnapshot(req.Context(), name)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if sf == nil {
+			http.Error(rw, "snapshot "+name+" not found", http.StatusNotFound)
+			return
+		}
+		if err := e.DeleteSnapshots(req.Context(), []string{name}); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeSnapshotFiles(rw, http.StatusOK, []snapshotFile{*sf})
+	})
+}
+
+// findSnapshot returns the named snapshot, or nil if it is not held by any store.
+func (e *ETCD) findSnapshot(ctx context.Context, name string) (*snapshotFile, error) {
+	snapshots, err := e.ListSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Snapshots are keyed by store as well as name, so they must be matched by name.
+	for _, sf := range sortedSnapshotFiles(snapshots) {
+		if sf.Name == name {
+			return &sf, nil
+		}
+	}
+	return nil, nil
+}
+
+// failedSnapshotMessages returns a message for each of the given snapshot records that failed.
+func failedSnapshotMessages(results []snapshotFile) []string {
+	var messages []string
+	for _, sf := range results {
+		if sf.Status != failedSnapshotStatus {
+			continue
+		}
+		message := sf.Message
+		if decoded, err := base64.StdEncoding.DecodeString(sf.Message); err == nil {
+			message = string(decoded)
+		}
+		messages = append(messages, fmt.Sprintf("failed to save snapshot %s to %s: %s", sf.Name, sf.NodeName, message))
+	}
+	return messages
+}
+
+// sortedSnapshotFiles returns the given snapshots ordered by name.
+func sortedSnapshotFiles(snapshots map[string]snapshotFile) []snapshotFile {
+	files := make([]snapshotFile, 0, len(snapshots))
+	for _, sf := range snapshots {
+		files = append(files, sf)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files
+}
+
+func writeSnapshotFiles(rw http.ResponseWriter, status int, files []snapshotFile) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(files); err != nil {
+		logrus.Errorf("Failed to write etcd snapshot response: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	k3sv1 "github.com/wangxiaochuang/k3s/pkg/apis/k3s.cattle.io/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// snapshotFileResync is the interval at which ETCDSnapshotFile resources are resynced, so
+// that the removal of snapshots that could not previously be removed is retried.
+const snapshotFileResync = 10 * time.Minute
+
+// registerSnapshotHandlers starts the controller that removes snapshots from the node or store
+// holding them once their ETCDSnapshotFile resource is deleted.
+func (e *ETCD) registerSnapshotHandlers(ctx context.Context) error {
+	client, err := e.snapshotFileClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, snapshotFileResync)
+	informer := factory.ForResource(snapshotFileResource).Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			e.onSnapshotFileChange(ctx, obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			e.onSnapshotFileChange(ctx, obj)
+		},
+	})
+	factory.Start(ctx.Done())
+	return nil
+}
+
+func (e *ETCD) onSnapshotFileChange(ctx context.Context, obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok || u.GetDeletionTimestamp() == nil {
+		return
+	}
+	file, err := fromUnstructuredSnapshotFile(u)
+	if err != nil {
+		logrus.Errorf("Failed to decode ETCDSnapshotFile %s: %v", u.GetName(), err)
+		return
+	}
+	if !hasSnapshotFileFinalizer(file) {
+		return
+	}
+	if err := e.removeSnapshotFile(ctx, file); err != nil {
+		logrus.Errorf("Failed to remove etcd snapshot for deleted ETCDSnapshotFile %s: %v", file.Name, err)
+	}
+}
+
+// removeSnapshotFile removes the snapshot described by a deleted ETCDSnapshotFile from the node or store
+// holding it, and then removes the finalizer so that the deletion can complete. Snapshots held locally by
+// another node are left for that node to remove, unless the node no longer exists.
+func (e *ETCD) removeSnapshotFile(ctx context.Context, file *k3sv1.ETCDSnapshotFile) error {
+	sf := fromSnapshotFileObject(file)
+	nodeName := os.Getenv("NODE_NAME")
+
+	switch {
+	case sf.Status == failedSnapshotStatus:
+		// failed snapshots were never saved, so there is nothing to remove.
+	case sf.NodeName == nodeName || remoteStoreEnabled(e.config, sf.NodeName):
+		stores, storeErrs := e.snapshotStores(ctx)
+		if err := storeErrs[sf.NodeName]; err != nil {
+			return err
+		}
+		for _, store := range stores {
+			if store.Name() != sf.NodeName {
+				continue
+			}
+			logrus.Infof("Removing %s etcd snapshot %s for deleted ETCDSnapshotFile %s", store.Name(), sf.Name, file.Name)
+			if err := store.Delete(ctx, []string{sf.Name}); err != nil {
+				return err
+			}
+		}
+	default:
+		if _, err := e.config.Runtime.Core.Core().V1().Node().Get(sf.NodeName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+			return err
+		}
+		logrus.Infof("Removing ETCDSnapshotFile %s for snapshot %s held by deleted node %s", file.Name, sf.Name, sf.NodeName)
+	}
+
+	client, err := e.snapshotFileClient(ctx)
+	if err != nil {
+		return err
+	}
+	return removeSnapshotFileFinalizer(ctx, client.Resource(snapshotFileResource), file.Name)
+}
+
+// migrateSnapshotConfigMap creates ETCDSnapshotFile resources for the snapshots recorded in the snapshot
+// ConfigMap used by earlier releases, and removes the ConfigMap once all of them have been migrated.
+func (e *ETCD) migrateSnapshotConfigMap(ctx context.Context) error {
+	configMaps := e.config.Runtime.Core.Core().V1().ConfigMap()
+	snapshotConfigMap, err := configMaps.Get(metav1.NamespaceSystem, snapshotConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	logrus.Infof("Migrating %d etcd snapshot records from %s ConfigMap to ETCDSnapshotFile resources", len(snapshotConfigMap.Data), snapshotConfigMapName)
+	for key, value := range snapshotConfigMap.Data {
+		var sf snapshotFile
+		if err := json.Unmarshal([]byte(value), &sf); err != nil {
+			logrus.Warnf("Skipping invalid etcd snapshot record %s in %s ConfigMap: %v", key, snapshotConfigMapName, err)
+			continue
+		}
+		if sf.Status == "" {
+			// records saved by older versions did not set a status, and were only added for saved snapshots.
+			sf.Status = successfulSnapshotStatus
+		}
+		if err := e.addSnapshotData(ctx, sf); err != nil {
+			return errors.Wrapf(err, "failed to migrate etcd snapshot record %s", key)
+		}
+	}
+
+	if err := configMaps.Delete(metav1.NamespaceSystem, snapshotConfigMapName, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	logrus.Infof("Removed %s ConfigMap after migrating etcd snapshot records", snapshotConfigMapName)
+	return nil
+}
@@ -0,0 +1,111 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/wangxiaochuang/k3s/pkg/version"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// snapshotClaimTTL is the lifetime of the lease attached to each snapshot claim, in seconds. Claims
+// only need to outlive the difference between the times at which servers run the same schedule.
+const snapshotClaimTTL = 3600
+
+var snapshotClaimPrefix = version.Program + "/etcd/snapshot-claims/"
+
+// addScheduledSnapshot adds a cron entry that takes a snapshot on the given schedule. Each run is
+// passed the time it was scheduled for by the cron, rather than the time it started, so that all
+// members claim the same run however long they take to get to it. Entries must be added before the
+// cron is started.
+func (e *ETCD) addScheduledSnapshot(ctx context.Context, spec string, schedule snapshotSchedule) error {
+	var id cron.EntryID
+	id, err := e.cron.AddFunc(spec, func() {
+		scheduled := e.cron.Entry(id).Prev
+		if scheduled.IsZero() {
+			scheduled = time.Now()
+		}
+		if err := e.scheduledSnapshot(ctx, schedule, scheduled); err != nil {
+			logrus.Errorf("Failed to take %s snapshot: %v", schedule.Name, err)
+		}
+	})
+	return err
+}
+
+// scheduledSnapshot takes a snapshot on the given schedule. If scheduled snapshots are coordinated,
+// the snapshot is only taken if this member claims the run scheduled at the given time before any
+// other member. As each coordinated run is then taken by a single member, retention is applied to
+// the scheduled snapshots taken by all members. On-demand snapshots never claim a run, so their
+// retention only ever applies to the snapshots taken by this node.
+func (e *ETCD) scheduledSnapshot(ctx context.Context, schedule snapshotSchedule, scheduled time.Time) error {
+	if err := e.preSnapshotSetup(ctx, e.config); err != nil {
+		return err
+	}
+	if e.config.EtcdSnapshotCoordinated {
+		claimed, err := e.claimScheduledSnapshot(ctx, schedule.Name, scheduled)
+		if err != nil {
+			return errors.Wrapf(err, "failed to claim scheduled snapshot %s", schedule.Name)
+		}
+		if !claimed {
+			return nil
+		}
+		schedule.Policy.AllNodes = true
+	}
+	_, err := e.snapshot(ctx, schedule)
+	return err
+}
+
+// claimScheduledSnapshot attempts to claim the snapshot with the given name prefix scheduled at the
+// given time, returning true if this member should take it. Only healthy voting members may claim a
+// snapshot. Each scheduled run is claimed through a key holding its scheduled time, which is created
+// by the first member to reach it, and expires with its lease once all members have run the schedule.
+func (e *ETCD) claimScheduledSnapshot(ctx context.Context, name string, scheduled time.Time) (bool, error) {
+	status, err := e.client.Status(ctx, localEndpoint(e.config))
+	if err != nil {
+		return false, errors.Wrap(err, "failed to check etcd status")
+	}
+	if status.IsLearner {
+		logrus.Debugf("Not claiming scheduled snapshot %s: etcd member is a learner", name)
+		return false, nil
+	}
+	if len(status.Errors) > 0 {
+		logrus.Warnf("Not claiming scheduled snapshot %s: etcd member is unhealthy: %s", name, strings.Join(status.Errors, ", "))
+		return false, nil
+	}
+
+	lease, err := e.client.Grant(ctx, snapshotClaimTTL)
+	if err != nil {
+		return false, err
+	}
+
+	nodeName := os.Getenv("NODE_NAME")
+	key := fmt.Sprintf("%s%s/%d", snapshotClaimPrefix, name, scheduled.Unix())
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, nodeName, clientv3.WithLease(lease.ID))).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	if resp.Succeeded {
+		logrus.Infof("Claimed scheduled snapshot %s", name)
+		return true, nil
+	}
+
+	if _, err := e.client.Revoke(ctx, lease.ID); err != nil {
+		logrus.Debugf("Failed to revoke unused snapshot claim lease: %v", err)
+	}
+	owner := "another member"
+	if rr := resp.Responses[0].GetResponseRange(); rr != nil && len(rr.Kvs) > 0 {
+		owner = string(rr.Kvs[0].Value)
+	}
+	logrus.Infof("Scheduled snapshot %s has been claimed by %s", name, owner)
+	return false, nil
+}
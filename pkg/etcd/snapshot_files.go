@@ -0,0 +1,428 @@
+package etcd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	k3sv1 "github.com/wangxiaochuang/k3s/pkg/apis/k3s.cattle.io/v1"
+	"github.com/wangxiaochuang/k3s/pkg/crd"
+	"github.com/wangxiaochuang/k3s/pkg/version"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+)
+
+var (
+	// snapshotStorageNodeLabel holds the node or remote store name of the snapshot, so that the
+	// ETCDSnapshotFile resources for a single node or store can be listed.
+	snapshotStorageNodeLabel = "etcd." + version.Program + ".cattle.io/snapshot-storage-node"
+	// snapshotFileFinalizer prevents an ETCDSnapshotFile from being removed until the
+	// snapshot has been removed from the node or store holding it.
+	snapshotFileFinalizer = "etcd." + version.Program + ".cattle.io/snapshot-file"
+
+	snapshotFileResource = k3sv1.SchemeGroupVersion.WithResource(k3sv1.ETCDSnapshotFileResourceName)
+
+	invalidObjectNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+)
+
+// snapshotFileClient returns a client for the local apiserver, used to manage ETCDSnapshotFile
+// resources. The CRD is created or updated the first time the client is requested.
+func (e *ETCD) snapshotFileClient(ctx context.Context) (dynamic.Interface, error) {
+	e.snapshotFilesLock.Lock()
+	defer e.snapshotFilesLock.Unlock()
+
+	if e.snapshotFiles != nil {
+		return e.snapshotFiles, nil
+	}
+
+	restConfig, err := clientcmd.BuildConfigFromFlags("", e.config.Runtime.KubeConfigAdmin)
+	if err != nil {
+		return nil, err
+	}
+	if err := crd.Create(ctx, restConfig); err != nil {
+		return nil, errors.Wrap(err, "failed to create ETCDSnapshotFile CRD")
+	}
+	client, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	e.snapshotFiles = client
+	return client, nil
+}
+
+// snapshotFileObjectName returns the name of the ETCDSnapshotFile resource for the given snapshot.
+// Snapshots with the same name may be held by several stores, so the name is suffixed with a hash
+// of the node or store name.
+func snapshotFileObjectName(sf snapshotFile) string {
+	name := invalidObjectNameChars.ReplaceAllString(strings.ToLower(sf.Name), "-")
+	if len(name) > 240 {
+		name = name[:240]
+	}
+	digest := sha256.Sum256([]byte(sf.NodeName))
+	return strings.Trim(name, "-.") + "-" + hex.EncodeToString(digest[:])[:6]
+}
+
+// toSnapshotFileObject returns the ETCDSnapshotFile resource for the given snapshot.
+func toSnapshotFileObject(sf snapshotFile) *k3sv1.ETCDSnapshotFile {
+	ready := sf.Status != failedSnapshotStatus
+	obj := &k3sv1.ETCDSnapshotFile{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: k3sv1.SchemeGroupVersion.String(),
+			Kind:       k3sv1.ETCDSnapshotFileKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       snapshotFileObjectName(sf),
+			Labels:     map[string]string{snapshotStorageNodeLabel: sf.NodeName},
+			Finalizers: []string{snapshotFileFinalizer},
+		},
+		Spec: k3sv1.ETCDSnapshotSpec{
+			SnapshotName: sf.Name,
+			NodeName:     sf.NodeName,
+			Location:     sf.Location,
+			Compressed:   sf.Compressed,
+			Encrypted:    sf.Encrypted,
+			Checksum:     sf.Checksum,
+		},
+		Status: k3sv1.ETCDSnapshotStatus{
+			ReadyToUse:   &ready,
+			CreationTime: sf.CreatedAt,
+			Size:         sf.Size,
+		},
+	}
+
+	if sf.Metadata != "" {
+		if m, err := base64.StdEncoding.DecodeString(sf.Metadata); err != nil {
+			logrus.Warnf("Unable to decode metadata of etcd snapshot %s: %v", sf.Name, err)
+		} else if err := json.Unmarshal(m, &obj.Spec.Metadata); err != nil {
+			logrus.Warnf("Unable to unmarshal metadata of etcd snapshot %s: %v", sf.Name, err)
+		}
+	}
+
+	if sf.S3 != nil {
+		obj.Spec.S3 = &k3sv1.ETCDSnapshotS3{
+			Endpoint:      sf.S3.Endpoint,
+			EndpointCA:    sf.S3.EndpointCA,
+			SkipSSLVerify: sf.S3.SkipSSLVerify,
+			Bucket:        sf.S3.Bucket,
+			Region:        sf.S3.Region,
+			Folder:        sf.S3.Folder,
+			Insecure:      sf.S3.Insecure,
+		}
+	}
+
+	if !ready {
+		message, err := base64.StdEncoding.DecodeString(sf.Message)
+		if err != nil {
+			message = []byte(sf.Message)
+		}
+		obj.Status.Error = &k3sv1.ETCDSnapshotError{
+			Time:    sf.CreatedAt,
+			Message: string(message),
+		}
+	}
+
+	return obj
+}
+
+// fromSnapshotFileObject returns the snapshot described by the given ETCDSnapshotFile resource.
+func fromSnapshotFileObject(obj *k3sv1.ETCDSnapshotFile) snapshotFile {
+	sf := snapshotFile{
+		Name:       obj.Spec.SnapshotName,
+		Location:   obj.Spec.Location,
+		NodeName:   obj.Spec.NodeName,
+		CreatedAt:  obj.Status.CreationTime,
+		Size:       obj.Status.Size,
+		Status:     successfulSnapshotStatus,
+		Compressed: obj.Spec.Compressed,
+		Encrypted:  obj.Spec.Encrypted,
+		Checksum:   obj.Spec.Checksum,
+	}
+
+	if len(obj.Spec.Metadata) > 0 {
+		if m, err := json.Marshal(obj.Spec.Metadata); err == nil {
+			sf.Metadata = base64.StdEncoding.EncodeToString(m)
+		}
+	}
+
+	if obj.Spec.S3 != nil {
+		sf.S3 = &s3Config{
+			Endpoint:      obj.Spec.S3.Endpoint,
+			EndpointCA:    obj.Spec.S3.EndpointCA,
+			SkipSSLVerify: obj.Spec.S3.SkipSSLVerify,
+			Bucket:        obj.Spec.S3.Bucket,
+			Region:        obj.Spec.S3.Region,
+			Folder:        obj.Spec.S3.Folder,
+			Insecure:      obj.Spec.S3.Insecure,
+		}
+	}
+
+	if obj.Status.ReadyToUse != nil && !*obj.Status.ReadyToUse {
+		sf.Status = failedSnapshotStatus
+		if obj.Status.Error != nil {
+			sf.Message = base64.StdEncoding.EncodeToString([]byte(obj.Status.Error.Message))
+		}
+	}
+
+	return sf
+}
+
+func toUnstructuredSnapshotFile(obj *k3sv1.ETCDSnapshotFile) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: content}, nil
+}
+
+func fromUnstructuredSnapshotFile(u *unstructured.Unstructured) (*k3sv1.ETCDSnapshotFile, error) {
+	obj := &k3sv1.ETCDSnapshotFile{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// addSnapshotData creates or updates the ETCDSnapshotFile resource for the given snapshot.
+// If the core controllers are not yet ready, the snapshot is queued and recorded once they are.
+func (e *ETCD) addSnapshotData(ctx context.Context, sf snapshotFile) error {
+	if !e.coreReady() {
+		e.queueSnapshotData(ctx, &sf, false)
+		return nil
+	}
+	client, err := e.snapshotFileClient(ctx)
+	if err != nil {
+		return err
+	}
+	return saveSnapshotFileObject(ctx, client.Resource(snapshotFileResource), toSnapshotFileObject(sf))
+}
+
+// saveSnapshotFileObject creates the given ETCDSnapshotFile resource, or replaces the spec and status of
+// the existing resource with the same name.
+func saveSnapshotFileObject(ctx context.Context, client dynamic.ResourceInterface, obj *k3sv1.ETCDSnapshotFile) error {
+	return retry.OnError(retry.DefaultBackoff, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		existing, err := client.Get(ctx, obj.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			u, err := toUnstructuredSnapshotFile(obj)
+			if err != nil {
+				return err
+			}
+			_, err = client.Create(ctx, u, metav1.CreateOptions{})
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		current, err := fromUnstructuredSnapshotFile(existing)
+		if err != nil {
+			return err
+		}
+		if current.Labels == nil {
+			current.Labels = map[string]string{}
+		}
+		for k, v := range obj.Labels {
+			current.Labels[k] = v
+		}
+		current.Spec = obj.Spec
+		current.Status = obj.Status
+		if current.DeletionTimestamp == nil && !hasSnapshotFileFinalizer(current) {
+			current.Finalizers = append(current.Finalizers, snapshotFileFinalizer)
+		}
+
+		u, err := toUnstructuredSnapshotFile(current)
+		if err != nil {
+			return err
+		}
+		_, err = client.Update(ctx, u, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func hasSnapshotFileFinalizer(obj *k3sv1.ETCDSnapshotFile) bool {
+	for _, f := range obj.Finalizers {
+		if f == snapshotFileFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// removeSnapshotFileObject removes the finalizer from the named ETCDSnapshotFile resource, and deletes it.
+// This is used when the snapshot is no longer held by its node or store, so there is nothing to clean up.
+func removeSnapshotFileObject(ctx context.Context, client dynamic.ResourceInterface, name string) error {
+	if err := removeSnapshotFileFinalizer(ctx, client, name); err != nil {
+		return err
+	}
+	if err := client.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// removeSnapshotFileFinalizer removes the snapshot finalizer from the named ETCDSnapshotFile resource.
+func removeSnapshotFileFinalizer(ctx context.Context, client dynamic.ResourceInterface, name string) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		u, err := client.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var finalizers []string
+		for _, f := range u.GetFinalizers() {
+			if f != snapshotFileFinalizer {
+				finalizers = append(finalizers, f)
+			}
+		}
+		if len(finalizers) == len(u.GetFinalizers()) {
+			return nil
+		}
+		u.SetFinalizers(finalizers)
+		_, err = client.Update(ctx, u, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// ReconcileSnapshotData reconciles the ETCDSnapshotFile resources for this node and enabled remote stores.
+// It will reconcile snapshots from disk locally always, and will attempt to list and reconcile snapshots
+// from every enabled remote snapshot store. Resources are created for snapshots that are not yet recorded,
+// and removed for snapshots that are no longer held by their node or store.
+// If the core controllers are not yet ready, reconciliation is deferred until they are.
+func (e *ETCD) ReconcileSnapshotData(ctx context.Context) error {
+	if !e.coreReady() {
+		e.queueSnapshotData(ctx, nil, true)
+		return nil
+	}
+
+	logrus.Info("Reconciling ETCDSnapshotFile resources")
+	defer logrus.Info("Reconciliation of ETCDSnapshotFile resources complete")
+
+	client, err := e.snapshotFileClient(ctx)
+	if err != nil {
+		return err
+	}
+	snapshotFiles := client.Resource(snapshotFileResource)
+
+	// snapshots holds the snapshots held by this node and the stores that were listed, keyed by resource name.
+	snapshots := make(map[string]snapshotFile)
+
+	// listedStores records the stores that we were successful at listing snapshots from, to eliminate accidental
+	// removal of resources for remote snapshots due to misconfigured credentials/details
+	listedStores := make(map[string]bool)
+
+	stores, storeErrs := e.snapshotStores(ctx)
+	for name, err := range storeErrs {
+		logrus.Errorf("error initializing %s snapshot store for reconciliation: %v", name, err)
+	}
+
+	for _, store := range stores {
+		storeSnapshots, err := store.List(ctx)
+		if err != nil {
+			// The local snapshot directory must always be listable
+			if _, ok := store.(*localStore); ok {
+				return err
+			}
+			logrus.Errorf("error retrieving %s snapshots for reconciliation: %v", store.Name(), err)
+			continue
+		}
+		for _, sf := range storeSnapshots {
+			snapshots[snapshotFileObjectName(sf)] = sf
+		}
+		listedStores[store.Name()] = true
+	}
+
+	nodeName := os.Getenv("NODE_NAME")
+	storageNodes := []string{nodeName}
+	for _, name := range []string{s3StoreName, mirrorStoreName} {
+		if remoteStoreEnabled(e.config, name) {
+			storageNodes = append(storageNodes, name)
+		}
+	}
+
+	list, err := snapshotFiles.List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s in (%s)", snapshotStorageNodeLabel, strings.Join(storageNodes, ",")),
+	})
+	if err != nil {
+		return err
+	}
+
+	// failedSnapshots holds the failed snapshots recorded for this node, or recorded for remote stores by
+	// this node, grouped by node or store name.
+	failedSnapshots := make(map[string][]snapshotFile)
+	recorded := make(map[string]bool)
+
+	for i := range list.Items {
+		obj, err := fromUnstructuredSnapshotFile(&list.Items[i])
+		if err != nil {
+			return err
+		}
+		if obj.DeletionTimestamp != nil {
+			continue
+		}
+		sf := fromSnapshotFileObject(obj)
+
+		if sf.Status == failedSnapshotStatus {
+			if sf.NodeName == nodeName || strings.HasPrefix(sf.Name, e.config.EtcdSnapshotName+"-"+nodeName) {
+				failedSnapshots[sf.NodeName] = append(failedSnapshots[sf.NodeName], sf)
+			}
+			continue
+		}
+
+		recorded[obj.Name] = true
+		if sf.NodeName != nodeName && !listedStores[sf.NodeName] {
+			continue
+		}
+		if _, ok := snapshots[obj.Name]; !ok {
+			logrus.Debugf("Removing ETCDSnapshotFile %s for snapshot %s no longer held by %s", obj.Name, sf.Name, sf.NodeName)
+			if err := removeSnapshotFileObject(ctx, snapshotFiles, obj.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Apply the failed snapshot retention policy to failed snapshots from each node or store
+	if e.config.EtcdSnapshotRetention >= 1 {
+		for _, failed := range failedSnapshots {
+			sort.Slice(failed, func(i, j int) bool {
+				return failed[i].Name > failed[j].Name
+			})
+			if len(failed) <= e.config.EtcdSnapshotRetention {
+				continue
+			}
+			for _, sf := range failed[e.config.EtcdSnapshotRetention:] {
+				if err := removeSnapshotFileObject(ctx, snapshotFiles, snapshotFileObjectName(sf)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// create resources for snapshots that are on disk or in a remote store, but are not yet recorded as successful.
+	for name, sf := range snapshots {
+		if recorded[name] {
+			continue
+		}
+		sf.Status = successfulSnapshotStatus // if the snapshot is on disk or in S3, it was successful.
+		if err := saveSnapshotFileObject(ctx, snapshotFiles, toSnapshotFileObject(sf)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
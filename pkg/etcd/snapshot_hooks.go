@@ -0,0 +1,123 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	preSnapshotHookEvent  = "pre-snapshot"
+	postSnapshotHookEvent = "post-snapshot"
+
+	// defaultSnapshotWebhookTimeout bounds webhook requests when no hook timeout is configured.
+	defaultSnapshotWebhookTimeout = time.Minute
+)
+
+// snapshotHookEvent is the document passed to snapshot hooks as JSON. Pre-snapshot hooks are passed
+// the snapshot that is about to be taken. Post-snapshot hooks are passed every snapshot record saved
+// by the attempt, one for each store, along with any error that stopped the attempt.
+type snapshotHookEvent struct {
+	Event     string         `json:"event"`
+	Snapshots []snapshotFile `json:"snapshots"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// preSnapshotHooks calls the configured pre-snapshot hooks in order. If any hook fails, the
+// remaining hooks are not called and an error is returned, so that the snapshot is not taken.
+func (e *ETCD) preSnapshotHooks(ctx context.Context, sf snapshotFile) error {
+	if len(e.config.EtcdSnapshotPreHooks) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(&snapshotHookEvent{
+		Event:     preSnapshotHookEvent,
+		Snapshots: []snapshotFile{sf},
+	})
+	if err != nil {
+		return err
+	}
+	for _, hook := range e.config.EtcdSnapshotPreHooks {
+		if err := e.runSnapshotHook(ctx, hook, preSnapshotHookEvent, body); err != nil {
+			return errors.Wrapf(err, "snapshot %s vetoed by pre-snapshot hook %s", sf.Name, hook)
+		}
+	}
+	return nil
+}
+
+// postSnapshotHooks calls all of the configured post-snapshot hooks with the results of a snapshot,
+// or with the error that prevented it. Hook failures are only logged, as the attempt is already over.
+func (e *ETCD) postSnapshotHooks(ctx context.Context, snapshots []snapshotFile, snapshotErr error) {
+	if len(e.config.EtcdSnapshotPostHooks) == 0 {
+		return
+	}
+	event := &snapshotHookEvent{
+		Event:     postSnapshotHookEvent,
+		Snapshots: snapshots,
+	}
+	if snapshotErr != nil {
+		event.Error = snapshotErr.Error()
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		logrus.Errorf("Failed to marshal post-snapshot hook event: %v", err)
+		return
+	}
+	for _, hook := range e.config.EtcdSnapshotPostHooks {
+		if err := e.runSnapshotHook(ctx, hook, postSnapshotHookEvent, body); err != nil {
+			logrus.Errorf("Post-snapshot hook %s failed: %v", hook, err)
+		}
+	}
+}
+
+// runSnapshotHook calls a single hook with the given event. Hooks given as http or https URLs are sent
+// the event in the body of a POST request, and fail if they do not return a 2xx status. Other hooks
+// are run as executables with the event on stdin, and fail if they exit with a non-zero status.
+func (e *ETCD) runSnapshotHook(ctx context.Context, hook, event string, body []byte) error {
+	if e.config.EtcdSnapshotHookTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.config.EtcdSnapshotHookTimeout)
+		defer cancel()
+	}
+
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Snapshot-Hook-Event", event)
+		client := &http.Client{Timeout: defaultSnapshotWebhookTimeout}
+		if e.config.EtcdSnapshotHookTimeout > 0 {
+			client.Timeout = e.config.EtcdSnapshotHookTimeout
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("webhook returned status %s", resp.Status)
+		}
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(), "SNAPSHOT_HOOK_EVENT="+event)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if out := strings.TrimSpace(string(output)); out != "" {
+			return errors.Wrap(err, out)
+		}
+		return err
+	}
+	return nil
+}
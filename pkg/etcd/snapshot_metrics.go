@@ -0,0 +1,140 @@
+package etcd
+
+import (
+	"time"
+
+	"github.com/wangxiaochuang/k3s/pkg/version"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+// Snapshot metrics are registered with the legacy registry, which is served at /db/metrics on the
+// supervisor port if etcd-snapshot-metrics is set. Metrics for a single destination are labelled local,
+// mirror or s3.
+const (
+	snapshotMetricsSubsystem = "etcd_snapshot"
+	localDestination         = "local"
+)
+
+var (
+	snapshotLastSuccess = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      version.Program,
+			Subsystem:      snapshotMetricsSubsystem,
+			Name:           "last_success_timestamp_seconds",
+			Help:           "Time of the last successful etcd snapshot saved to each destination, as seconds since the epoch.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"destination"},
+	)
+	snapshotSize = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      version.Program,
+			Subsystem:      snapshotMetricsSubsystem,
+			Name:           "size_bytes",
+			Help:           "Size of the last successful etcd snapshot saved to each destination.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"destination"},
+	)
+	snapshotFailures = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      version.Program,
+			Subsystem:      snapshotMetricsSubsystem,
+			Name:           "failures_total",
+			Help:           "Number of etcd snapshots that could not be saved to each destination.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"destination"},
+	)
+	snapshotSaveDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      version.Program,
+			Subsystem:      snapshotMetricsSubsystem,
+			Name:           "save_duration_seconds",
+			Help:           "Time taken to save an etcd snapshot from the datastore.",
+			Buckets:        metrics.ExponentialBuckets(0.5, 2, 12),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"status"},
+	)
+	snapshotUploadDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      version.Program,
+			Subsystem:      snapshotMetricsSubsystem,
+			Name:           "upload_duration_seconds",
+			Help:           "Time taken to save an etcd snapshot to each destination.",
+			Buckets:        metrics.ExponentialBuckets(0.5, 2, 12),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"destination", "status"},
+	)
+	snapshotCompressionRatio = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace:      version.Program,
+			Subsystem:      snapshotMetricsSubsystem,
+			Name:           "compression_ratio",
+			Help:           "Ratio of the compressed to the uncompressed size of the last compressed etcd snapshot.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	snapshotRetentionDeletions = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      version.Program,
+			Subsystem:      snapshotMetricsSubsystem,
+			Name:           "retention_deletions_total",
+			Help:           "Number of etcd snapshots removed from each destination by the retention policy.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"destination"},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(
+		snapshotLastSuccess,
+		snapshotSize,
+		snapshotFailures,
+		snapshotSaveDuration,
+		snapshotUploadDuration,
+		snapshotCompressionRatio,
+		snapshotRetentionDeletions,
+	)
+}
+
+// snapshotDestination returns the destination label for the given snapshot store
+// or snapshot node name.
+func snapshotDestination(name string) string {
+	switch name {
+	case s3StoreName, mirrorStoreName:
+		return name
+	}
+	return localDestination
+}
+
+// recordSnapshotMetrics records the outcome of saving a snapshot to a single destination.
+func recordSnapshotMetrics(sf snapshotFile) {
+	destination := snapshotDestination(sf.NodeName)
+	if sf.Status != successfulSnapshotStatus {
+		snapshotFailures.WithLabelValues(destination).Inc()
+		return
+	}
+	createdAt := time.Now()
+	if sf.CreatedAt != nil {
+		createdAt = sf.CreatedAt.Time
+	}
+	snapshotLastSuccess.WithLabelValues(destination).Set(float64(createdAt.Unix()))
+	snapshotSize.WithLabelValues(destination).Set(float64(sf.Size))
+}
+
+// observeSnapshotDuration records the time since the given start in the histogram, with the given labels.
+func observeSnapshotDuration(histogram *metrics.HistogramVec, start time.Time, labels ...string) {
+	histogram.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+}
+
+// recordCompressionRatio records the ratio between the sizes of a compressed snapshot and the original.
+func recordCompressionRatio(size, compressedSize int64) {
+	if size > 0 {
+		snapshotCompressionRatio.Set(float64(compressedSize) / float64(size))
+	}
+}
@@ -0,0 +1,78 @@
+package etcd
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// coreReady returns true if the core controllers have been started and the apiserver is reachable,
+// so that snapshot metadata can be recorded.
+func (e *ETCD) coreReady() bool {
+	select {
+	case <-e.config.Runtime.CoreReady:
+		return true
+	default:
+		return false
+	}
+}
+
+// queueSnapshotData holds the given snapshot record, and whether or not snapshot data needs to be reconciled,
+// until the core controllers are ready. Records for the same snapshot replace any that are already queued.
+func (e *ETCD) queueSnapshotData(ctx context.Context, sf *snapshotFile, reconcile bool) {
+	e.snapshotQueueLock.Lock()
+	defer e.snapshotQueueLock.Unlock()
+
+	if sf != nil {
+		if e.snapshotQueue == nil {
+			e.snapshotQueue = map[string]snapshotFile{}
+		}
+		e.snapshotQueue[snapshotFileObjectName(*sf)] = *sf
+		logrus.Infof("Core controllers are not ready; queued etcd snapshot record for %s", sf.Name)
+	}
+	if reconcile {
+		e.snapshotQueueReconcile = true
+		logrus.Info("Core controllers are not ready; deferring reconciliation of ETCDSnapshotFile resources")
+	}
+
+	if !e.snapshotQueueWaiting {
+		e.snapshotQueueWaiting = true
+		go e.flushSnapshotData(ctx)
+	}
+}
+
+// flushSnapshotData waits for the core controllers to become ready, and then records the queued snapshots
+// and reconciles snapshot data if requested. If the context is cancelled first, queued records are kept,
+// and will be flushed by the next call to queueSnapshotData.
+func (e *ETCD) flushSnapshotData(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		e.snapshotQueueLock.Lock()
+		if n := len(e.snapshotQueue); n > 0 {
+			logrus.Warnf("Context cancelled before core controllers were ready; %d etcd snapshot records were not recorded", n)
+		}
+		e.snapshotQueueWaiting = false
+		e.snapshotQueueLock.Unlock()
+		return
+	case <-e.config.Runtime.CoreReady:
+	}
+
+	e.snapshotQueueLock.Lock()
+	queue, reconcile := e.snapshotQueue, e.snapshotQueueReconcile
+	e.snapshotQueue, e.snapshotQueueReconcile, e.snapshotQueueWaiting = nil, false, false
+	e.snapshotQueueLock.Unlock()
+
+	if len(queue) > 0 {
+		logrus.Infof("Recording %d queued etcd snapshot records", len(queue))
+	}
+	for _, sf := range queue {
+		if err := e.addSnapshotData(ctx, sf); err != nil {
+			logrus.Errorf("Failed to record queued etcd snapshot %s: %v", sf.Name, err)
+		}
+	}
+	if reconcile {
+		if err := e.ReconcileSnapshotData(ctx); err != nil {
+			logrus.Errorf("Failed to reconcile ETCDSnapshotFile resources: %v", err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package etcd
+
+import (
+	"context"
+	"time"
+
+	"github.com/wangxiaochuang/k3s/pkg/daemons/config"
+)
+
+// snapshotSchedule holds the settings used to take a snapshot: the name prefix, the format the
+// snapshot is compressed with, if any, the remote stores it is copied to, and the retention policy
+// applied to snapshots with the same name prefix once it has been saved.
+type snapshotSchedule struct {
+	Name        string
+	Compression string
+	S3          bool
+	Mirror      bool
+	Policy      retentionPolicy
+}
+
+// defaultSnapshotSchedule returns the schedule set by the global snapshot configuration, which is
+// used for on-demand snapshots and for snapshots taken at the configured cron interval.
+func defaultSnapshotSchedule(config *config.Control) snapshotSchedule {
+	return snapshotSchedule{
+		Name:        config.EtcdSnapshotName,
+		Compression: snapshotCompressionFormat(config, config.EtcdSnapshotCompress),
+		S3:          config.EtcdS3,
+		Mirror:      config.EtcdSnapshotMirrorDir != "",
+		Policy:      newRetentionPolicy(config),
+	}
+}
+
+// newSnapshotSchedule returns the settings of an additional snapshot schedule. The global compression
+// format is used if the schedule does not set its own, and the global retention policy is used if the
+// schedule sets none of its own retention rules. The schedule is expected to have been validated, so that
+// it only requests the remote stores that are configured globally.
+func newSnapshotSchedule(config *config.Control, s config.EtcdSnapshotSchedule) snapshotSchedule {
+	maxAge, _ := time.ParseDuration(s.MaxAge)
+	policy := retentionPolicy{
+		Count:  s.Retention,
+		MaxAge: maxAge,
+		Hourly: s.KeepHourly,
+		Daily:  s.KeepDaily,
+		Weekly: s.KeepWeekly,
+	}
+	if !policy.enabled() {
+		policy = newRetentionPolicy(config)
+	}
+
+	compression := s.Compression
+	if compression == "" {
+		compression = snapshotCompressionFormat(config, s.Compress)
+	}
+	return snapshotSchedule{
+		Name:        s.Name,
+		Compression: compression,
+		S3:          s.S3,
+		Mirror:      s.Mirror,
+		Policy:      policy,
+	}
+}
+
+// snapshotCompressionFormat returns the configured compression format, which enables compression on its
+// own. If no format is configured, zip is used if compress is set, or an empty string is returned if
+// snapshots are not compressed.
+func snapshotCompressionFormat(config *config.Control, compress bool) string {
+	if config.EtcdSnapshotCompression != "" {
+		return config.EtcdSnapshotCompression
+	}
+	if compress {
+		return zipCompression
+	}
+	return ""
+}
+
+// scheduleStores returns the snapshot stores that the given schedule saves snapshots to. As with
+// snapshotStores, the local store is always first, and remote stores that could not be
+// initialized are returned in the error map.
+func (e *ETCD) scheduleStores(ctx context.Context, schedule snapshotSchedule) ([]SnapshotStore, map[string]error) {
+	stores, storeErrs := e.snapshotStores(ctx)
+
+	enabled := map[string]bool{
+		s3StoreName:     schedule.S3,
+		mirrorStoreName: schedule.Mirror,
+	}
+	var scheduleStores []SnapshotStore
+	for _, store := range stores {
+		if selected, remote := enabled[store.Name()]; !remote || selected {
+			scheduleStores = append(scheduleStores, store)
+		}
+	}
+	for name := range storeErrs {
+		if !enabled[name] {
+			delete(storeErrs, name)
+		}
+	}
+	return scheduleStores, storeErrs
+}
@@ -0,0 +1,403 @@
+package etcd
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/wangxiaochuang/k3s/pkg/daemons/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	s3StoreName     = "s3"
+	mirrorStoreName = "mirror"
+
+	// copyTempExtension and compressTempExtension are the suffixes of snapshot files that are
+	// still being copied or compressed, and are renamed into place once they are complete.
+	copyTempExtension     = ".tmp"
+	compressTempExtension = ".part"
+)
+
+// isSnapshotFile returns true if the given file in a snapshot directory holds a complete snapshot,
+// rather than a checksum sidecar file or a copy that is in progress or was interrupted.
+func isSnapshotFile(name string) bool {
+	return !isChecksumFile(name) && !strings.HasSuffix(name, copyTempExtension) && !strings.HasSuffix(name, compressTempExtension)
+}
+
+// SnapshotStore is a destination that etcd snapshots can be shipped to. Snapshots are
+// always saved to the local snapshot directory first, and are then uploaded to each
+// of the configured stores.
+type SnapshotStore interface {
+	// Name returns the name of the store. Snapshots held by stores other than the
+	// local snapshot directory use the store name as their node name.
+	Name() string
+	// Upload copies the given snapshot, taken at the given etcd revision, into the store.
+	// A failed transfer is reported through the status of the returned snapshotFile; an
+	// error is only returned if the result could not be determined at all.
+	Upload(ctx context.Context, snapshotPath, extraMetadata string, revision int64, now time.Time) (*snapshotFile, error)
+	// Download retrieves the named snapshot into the given directory, verifying its
+	// checksum if one was recorded, and returns the full path to the retrieved file.
+	Download(ctx context.Context, name, dir string) (string, error)
+	// List returns the snapshots held by the store, keyed by their ConfigMap key.
+	List(ctx context.Context) (map[string]snapshotFile, error)
+	// Delete removes the named snapshots from the store.
+	Delete(ctx context.Context, names []string) error
+	// Retention removes the snapshots taken by this node with the given name
+	// prefix that are not kept by the retention policy.
+	Retention(ctx context.Context, policy retentionPolicy, snapshotName string) error
+}
+
+// snapshotStores returns the local snapshot store, followed by any remote stores enabled in
+// the configuration. Remote stores that could not be initialized are returned in the error map,
+// keyed by store name, so that the caller can record the failure.
+func (e *ETCD) snapshotStores(ctx context.Context) ([]SnapshotStore, map[string]error) {
+	stores := []SnapshotStore{&localStore{config: e.config}}
+	storeErrs := map[string]error{}
+
+	if e.config.EtcdSnapshotMirrorDir != "" {
+		if ms, err := newMirrorStore(e.config); err != nil {
+			storeErrs[mirrorStoreName] = err
+		} else {
+			stores = append(stores, ms)
+		}
+	}
+
+	if e.config.EtcdS3 {
+		if err := e.initS3IfNil(ctx); err != nil {
+			storeErrs[s3StoreName] = err
+		} else {
+			stores = append(stores, e.s3)
+		}
+	}
+
+	return stores, storeErrs
+}
+
+// primaryStores returns the stores that snapshots are listed from and deleted from. When S3 is
+// enabled, only S3 is used, as it was before snapshot stores were pluggable; otherwise the local
+// snapshot directory and the mirror directory, if configured, are used.
+func (e *ETCD) primaryStores(ctx context.Context) ([]SnapshotStore, error) {
+	stores, storeErrs := e.snapshotStores(ctx)
+	if e.config.EtcdS3 {
+		if err, ok := storeErrs[s3StoreName]; ok {
+			return nil, err
+		}
+		for _, store := range stores {
+			if store.Name() == s3StoreName {
+				return []SnapshotStore{store}, nil
+			}
+		}
+	}
+	for _, err := range storeErrs {
+		return nil, err
+	}
+	return stores, nil
+}
+
+// remoteStoreEnabled returns true if the given node name belongs to a remote
+// snapshot store that is enabled in the configuration.
+func remoteStoreEnabled(config *config.Control, nodeName string) bool {
+	switch nodeName {
+	case s3StoreName:
+		return config.EtcdS3
+	case mirrorStoreName:
+		return config.EtcdSnapshotMirrorDir != ""
+	}
+	return false
+}
+
+// localStore stores snapshots in the local snapshot directory.
+type localStore struct {
+	config *config.Control
+}
+
+func (l *localStore) Name() string {
+	return os.Getenv("NODE_NAME")
+}
+
+// Upload records the given snapshot in the local snapshot directory. Snapshots are saved
+// directly into this directory, so the file is only copied if it was saved elsewhere.
+func (l *localStore) Upload(ctx context.Context, snapshotPath, extraMetadata string, revision int64, now time.Time) (*snapshotFile, error) {
+	snapshotDir, err := snapshotDir(l.config, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the snapshot dir")
+	}
+
+	if filepath.Dir(snapshotPath) != snapshotDir {
+		dest := filepath.Join(snapshotDir, filepath.Base(snapshotPath))
+		if err := copySnapshotWithChecksum(snapshotPath, dest); err != nil {
+			return nil, err
+		}
+		snapshotPath = dest
+	}
+
+	f, err := os.Stat(snapshotPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to retrieve snapshot information from local snapshot")
+	}
+
+	checksum, err := readChecksumFile(snapshotPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return &snapshotFile{
+		Name:     f.Name(),
+		Metadata: extraMetadata,
+		Location: "file://" + snapshotPath,
+		NodeName: l.Name(),
+		CreatedAt: &metav1.Time{
+			Time: f.ModTime(),
+		},
+		Status:     successfulSnapshotStatus,
+		Size:       f.Size(),
+		Compressed: isCompressedName(strings.TrimSuffix(f.Name(), encryptedExtension)),
+		Checksum:   checksum,
+		Encrypted:  strings.HasSuffix(f.Name(), encryptedExtension),
+	}, nil
+}
+
+func (l *localStore) Download(ctx context.Context, name, dir string) (string, error) {
+	snapshotDir, err := snapshotDir(l.config, false)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get the snapshot dir")
+	}
+	snapshotPath := filepath.Join(snapshotDir, name)
+	if dir != snapshotDir {
+		dest := filepath.Join(dir, name)
+		if err := copySnapshotWithChecksum(snapshotPath, dest); err != nil {
+			return "", err
+		}
+		if _, err := verifySnapshotChecksum(dest); err != nil {
+			os.Remove(dest)
+			return "", err
+		}
+		return dest, nil
+	}
+	if _, err := verifySnapshotChecksum(snapshotPath); err != nil {
+		return "", err
+	}
+	return snapshotPath, nil
+}
+
+// List provides a list of the currently stored snapshots on disk along with their relevant metadata.
+func (l *localStore) List(ctx context.Context) (map[string]snapshotFile, error) {
+	snapshots := make(map[string]snapshotFile)
+	snapshotDir, err := snapshotDir(l.config, true)
+	if err != nil {
+		return snapshots, errors.Wrap(err, "failed to get the snapshot dir")
+	}
+	return listSnapshotDir(snapshotDir, l.Name())
+}
+
+func (l *localStore) Delete(ctx context.Context, names []string) error {
+	snapshotDir, err := snapshotDir(l.config, false)
+	if err != nil {
+		return errors.Wrap(err, "failed to get the snapshot dir")
+	}
+
+	logrus.Info("Removing the given locally stored etcd snapshot(s)")
+	logrus.Debugf("Attempting to remove the given locally stored etcd snapshot(s): %v", names)
+
+	return deleteSnapshotDirFiles(snapshotDir, names)
+}
+
+func (l *localStore) Retention(ctx context.Context, policy retentionPolicy, snapshotName string) error {
+	snapshotDir, err := snapshotDir(l.config, false)
+	if err != nil {
+		return errors.Wrap(err, "failed to get the snapshot dir")
+	}
+	return snapshotRetention(policy, localDestination, snapshotName, os.Getenv("NODE_NAME"), snapshotDir)
+}
+
+// mirrorStore copies snapshots to an additional directory, such as a path on an NFS mount.
+// The directory may be shared by multiple servers.
+type mirrorStore struct {
+	config *config.Control
+	dir    string
+}
+
+// newMirrorStore creates a mirror store for the configured mirror directory, which must already exist.
+func newMirrorStore(config *config.Control) (*mirrorStore, error) {
+	s, err := os.Stat(config.EtcdSnapshotMirrorDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to check snapshot mirror dir")
+	}
+	if !s.IsDir() {
+		return nil, fmt.Errorf("snapshot mirror path must be a directory: %s", config.EtcdSnapshotMirrorDir)
+	}
+	return &mirrorStore{
+		config: config,
+		dir:    config.EtcdSnapshotMirrorDir,
+	}, nil
+}
+
+func (m *mirrorStore) Name() string {
+	return mirrorStoreName
+}
+
+func (m *mirrorStore) Upload(ctx context.Context, snapshotPath, extraMetadata string, revision int64, now time.Time) (*snapshotFile, error) {
+	logrus.Infof("Copying snapshot %s to mirror directory %s", snapshotPath, m.dir)
+	dest := filepath.Join(m.dir, filepath.Base(snapshotPath))
+	sf := &snapshotFile{
+		Name:       filepath.Base(snapshotPath),
+		Metadata:   extraMetadata,
+		Location:   "file://" + dest,
+		NodeName:   mirrorStoreName,
+		Compressed: isCompressedName(strings.TrimSuffix(snapshotPath, encryptedExtension)),
+		Encrypted:  strings.HasSuffix(snapshotPath, encryptedExtension),
+	}
+
+	if err := copySnapshotWithChecksum(snapshotPath, dest); err != nil {
+		logrus.Errorf("Error received during snapshot copy to mirror directory: %v", err)
+		sf.CreatedAt = &metav1.Time{Time: now}
+		sf.Message = base64.StdEncoding.EncodeToString([]byte(err.Error()))
+		sf.Status = failedSnapshotStatus
+		return sf, nil
+	}
+
+	f, err := os.Stat(dest)
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := readChecksumFile(dest)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sf.CreatedAt = &metav1.Time{Time: f.ModTime()}
+	sf.Size = f.Size()
+	sf.Status = successfulSnapshotStatus
+	sf.Checksum = checksum
+	return sf, nil
+}
+
+func (m *mirrorStore) Download(ctx context.Context, name, dir string) (string, error) {
+	dest := filepath.Join(dir, name)
+	if err := copySnapshotWithChecksum(filepath.Join(m.dir, name), dest); err != nil {
+		return "", err
+	}
+	if _, err := verifySnapshotChecksum(dest); err != nil {
+		os.Remove(dest)
+		return "", err
+	}
+	return dest, nil
+}
+
+func (m *mirrorStore) List(ctx context.Context) (map[string]snapshotFile, error) {
+	return listSnapshotDir(m.dir, mirrorStoreName)
+}
+
+func (m *mirrorStore) Delete(ctx context.Context, names []string) error {
+	logrus.Infof("Removing the given etcd snapshot(s) from mirror directory %s", m.dir)
+	return deleteSnapshotDirFiles(m.dir, names)
+}
+
+func (m *mirrorStore) Retention(ctx context.Context, policy retentionPolicy, snapshotName string) error {
+	if policy.AllNodes {
+		return snapshotRetention(policy, mirrorStoreName, snapshotName, "", m.dir)
+	}
+	return snapshotRetention(policy, mirrorStoreName, snapshotName, os.Getenv("NODE_NAME"), m.dir)
+}
+
+// listSnapshotDir returns the snapshot files in the given directory, attributed to the given node name.
+func listSnapshotDir(dir, nodeName string) (map[string]snapshotFile, error) {
+	snapshots := make(map[string]snapshotFile)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !isSnapshotFile(f.Name()) {
+			continue
+		}
+		sf := snapshotFile{
+			Name:     f.Name(),
+			Location: "file://" + filepath.Join(dir, f.Name()),
+			NodeName: nodeName,
+			CreatedAt: &metav1.Time{
+				Time: f.ModTime(),
+			},
+			Size:      f.Size(),
+			Status:    successfulSnapshotStatus,
+			Encrypted: strings.HasSuffix(f.Name(), encryptedExtension),
+		}
+		if checksum, err := readChecksumFile(filepath.Join(dir, f.Name())); err == nil {
+			sf.Checksum = checksum
+		}
+		sfKey := generateSnapshotConfigMapKey(sf)
+		snapshots[sfKey] = sf
+	}
+
+	return snapshots, nil
+}
+
+// deleteSnapshotDirFiles removes the named snapshots from the given directory, skipping any that do not exist.
+func deleteSnapshotDirFiles(dir string, names []string) error {
+	for _, s := range names {
+		// check if the given snapshot exists. If it does,
+		// remove it, otherwise continue.
+		sf := filepath.Join(dir, filepath.Base(s))
+		if _, err := os.Stat(sf); os.IsNotExist(err) {
+			logrus.Infof("Snapshot %s, does not exist", s)
+			continue
+		}
+		if err := os.Remove(sf); err != nil {
+			return err
+		}
+		if err := os.Remove(sf + checksumExtension); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		logrus.Debug("Removed snapshot ", s)
+	}
+	return nil
+}
+
+// copySnapshotWithChecksum copies a snapshot file to the destination path,
+// along with its sidecar checksum file if one exists.
+func copySnapshotWithChecksum(src, dest string) error {
+	if err := copySnapshotFile(src, dest); err != nil {
+		return err
+	}
+	if err := copySnapshotFile(src+checksumExtension, dest+checksumExtension); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// copySnapshotFile copies a snapshot file to the destination path. The file is written under
+// a temporary name and renamed into place so that a partial copy is never visible.
+func copySnapshotFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dest + copyTempExtension
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
@@ -7,11 +7,14 @@ import (
 	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/rancher/wrangler/pkg/generated/controllers/core"
+	"github.com/sirupsen/logrus"
 	"github.com/wangxiaochuang/k3s/pkg/cli/cmds"
 	"github.com/wangxiaochuang/k3s/pkg/daemons/config"
 	"github.com/wangxiaochuang/k3s/pkg/daemons/control"
 	"github.com/wangxiaochuang/k3s/pkg/datadir"
 	"github.com/wangxiaochuang/k3s/pkg/util"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
@@ -34,10 +37,15 @@ func StartServer(ctx context.Context, config *Config, cfg *cmds.Server) error {
 		return err
 	}
 
+	coreReady := make(chan struct{})
+	config.ControlConfig.Runtime.CoreReady = coreReady
+
 	if err := control.Server(ctx, &config.ControlConfig); err != nil {
 		return errors.Wrap(err, "starting kubernetes")
 	}
 
+	go startCore(ctx, config.ControlConfig.Runtime, coreReady)
+
 	return errors.New("xxxxxxx")
 }
 
@@ -80,3 +88,27 @@ func setNoProxyEnv(config *config.Control) error {
 	os.Unsetenv("no_proxy")
 	return os.Setenv("NO_PROXY", strings.Join(envList, ","))
 }
+
+// startCore waits for the apiserver to become ready, and then sets a core controller factory for it on the
+// runtime, closing coreReady once the factory can be used. Until then, the etcd snapshot and alarm handlers
+// queue or skip their writes to the apiserver.
+func startCore(ctx context.Context, runtime *config.ControlRuntime, coreReady chan struct{}) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-runtime.APIServerReady:
+	}
+
+	restConfig, err := clientcmd.BuildConfigFromFlags("", runtime.KubeConfigAdmin)
+	if err != nil {
+		logrus.Errorf("Failed to load admin kubeconfig for core controllers: %v", err)
+		return
+	}
+	sc, err := core.NewFactoryFromConfig(restConfig)
+	if err != nil {
+		logrus.Errorf("Failed to create core controllers: %v", err)
+		return
+	}
+	runtime.Core = sc
+	close(coreReady)
+}
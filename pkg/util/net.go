@@ -48,17 +48,33 @@ func GetFirst4(elems []net.IP) (net.IP, error) {
 }
 
 func GetFirst4String(elems []string) (string, error) {
+	ip, err := GetFirst4(parseIPStrings(elems))
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+// GetFirstString returns the first valid IP address of either family, and true if it is an IPv6 address.
+func GetFirstString(elems []string) (string, bool, error) {
+	for _, ip := range parseIPStrings(elems) {
+		if ip == nil {
+			continue
+		}
+		return ip.String(), ip.To4() == nil, nil
+	}
+	return "", false, errors.New("no IP address found")
+}
+
+// parseIPStrings parses a list of comma-separated IP address strings. Invalid addresses are returned as nil.
+func parseIPStrings(elems []string) []net.IP {
 	ips := []net.IP{}
 	for _, elem := range elems {
 		for _, v := range strings.Split(elem, ",") {
 			ips = append(ips, net.ParseIP(v))
 		}
 	}
-	ip, err := GetFirst4(ips)
-	if err != nil {
-		return "", err
-	}
-	return ip.String(), nil
+	return ips
 }
 
 func JoinIP4Nets(elems []*net.IPNet) string {